@@ -0,0 +1,60 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+// lintConfig checks the Fluent Bit configuration in the current environment and prints what it finds.
+// It fails if the configuration cannot be parsed or there are any errors, warnings alone do not fail it.
+func lintConfig(args []string) int {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	format := flags.String("format", common.LintFormatText, "The format of the findings, text or json")
+	configFile := flags.String("config", "", "The Fluent Bit configuration to check, defaults to the one Fluent Bit is started with")
+	_ = flags.Parse(args)
+
+	common.LoadEnvironment()
+
+	path := *configFile
+	if path == "" {
+		path = common.GetConfigFile()
+	}
+
+	config, err := common.ParseConfigFile(path)
+	if err != nil {
+		log.Errorw("Unable to parse Fluent Bit config", "error", err, "config", path)
+
+		return 1
+	}
+
+	findings := common.NewLinterFromDefaults().Lint(config)
+	if err := common.WriteFindings(os.Stdout, findings, *format); err != nil {
+		log.Errorw("Unable to write findings", "error", err)
+
+		return 1
+	}
+
+	if common.HasErrors(findings) {
+		return 1
+	}
+
+	return 0
+}
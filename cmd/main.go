@@ -35,6 +35,16 @@ var (
 )
 
 func main() {
+	// Subcommands to help with debugging, otherwise we run as normal
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "render-config":
+			os.Exit(renderConfig(os.Args[2:]))
+		case "lint":
+			os.Exit(lintConfig(os.Args[2:]))
+		}
+	}
+
 	ignoreExisting := flag.Bool("ignoreExisting", true, "Ignore any existing rebalance reports, if false will process then exit")
 	flag.Parse()
 
@@ -49,8 +59,8 @@ func main() {
 		"ignoreExisting", *ignoreExisting, "environment", os.Environ())
 
 	config := couchbase.NewWatcherConfigFromDefaults()
-	if err := config.CreateRebalanceDir(); err != nil {
-		log.Errorw("Issue with creating rebalance output directory", "error", err, "config", config)
+	if err := config.CreateOutputDirs(); err != nil {
+		log.Errorw("Issue with creating output directories", "error", err, "config", config)
 	}
 
 	// To simplify integration testing we add a special mode
@@ -60,6 +70,10 @@ func main() {
 			log.Errorw("Unable to process existing files in CB directory", "error", err, "config", config)
 		}
 
+		if err := config.Close(); err != nil {
+			log.Errorw("Unable to finish raising alerts", "error", err, "config", config)
+		}
+
 		log.Info("Processed all existing ones so exiting")
 
 		os.Exit(0)
@@ -0,0 +1,62 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+// renderConfig prints the effective Fluent Bit configuration as the child process would see it:
+// everything included and every variable expanded, including the memory buffer limits.
+// Everything else is logged so only the configuration is on standard output.
+func renderConfig(args []string) int {
+	flags := flag.NewFlagSet("render-config", flag.ExitOnError)
+	format := flags.String("format", common.ConfigFormatClassic, "The format to print, classic or yaml")
+	annotate := flags.Bool("annotate", false, "Annotate each line with the file and line it is from")
+	configFile := flags.String("config", "", "The Fluent Bit configuration to render, defaults to the one Fluent Bit is started with")
+	_ = flags.Parse(args)
+
+	common.LoadEnvironment()
+
+	path := *configFile
+	if path == "" {
+		path = common.GetConfigFile()
+	}
+
+	config, err := common.ParseConfigFile(path)
+	if err != nil {
+		log.Errorw("Unable to parse Fluent Bit config", "error", err, "config", path)
+
+		return 1
+	}
+
+	// The memory buffer and storage limits depend on the inputs and outputs so must be for the config being rendered
+	common.CheckAndEnableMemoryBufLimits(path)
+	common.CheckAndEnableStorageLimits(path)
+
+	options := common.RenderOptions{Format: *format, Annotate: *annotate, Resolver: common.NewVariableResolver(config)}
+	if err := common.RenderConfig(os.Stdout, config, options); err != nil {
+		log.Errorw("Unable to render Fluent Bit config", "error", err, "config", path)
+
+		return 1
+	}
+
+	return 0
+}
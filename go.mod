@@ -11,7 +11,11 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
 
-require github.com/josephburnett/jd v1.7.1
+require (
+	github.com/josephburnett/jd v1.7.1
+	github.com/klauspost/compress v1.18.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/go-openapi/jsonpointer v0.19.5 // indirect
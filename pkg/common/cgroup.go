@@ -0,0 +1,101 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultCgroupRoot is where the cgroup filesystem is mounted, a container sees its own cgroup at the root.
+const DefaultCgroupRoot = "/sys/fs/cgroup"
+
+const (
+	// cgroup v2 has a single hierarchy with "max" for no limit.
+	cgroupV2MemoryLimit = "memory.max"
+	// cgroup v1 has a memory controller hierarchy with a huge page aligned number for no limit.
+	cgroupV1MemoryLimit = "memory/memory.limit_in_bytes"
+	// Anything this large is the v1 equivalent of no limit, it is more memory than any machine has.
+	cgroupUnlimitedBytes = int64(1) << 62
+	bytesPerMegabyte     = 1 << 20
+)
+
+var (
+	// ErrInvalidMemoryLimit indicates a memory limit that is not a positive number.
+	ErrInvalidMemoryLimit = errors.New("invalid memory limit")
+	// ErrNoMemoryLimit indicates the container can use all the memory of the machine.
+	ErrNoMemoryLimit = errors.New("no memory limit")
+)
+
+// MemoryLimit is the memory available to the container and where it came from.
+type MemoryLimit struct {
+	Megabytes int
+	// Source is the environment variable or cgroup file the limit was read from.
+	Source string
+}
+
+// GetContainerMemoryLimit returns the memory limit of the container, CONTAINER_LIMITS_MEMORY_MEGABYTES takes precedence
+// over the cgroup limit under the root.
+func GetContainerMemoryLimit(cgroupRoot string) (*MemoryLimit, error) {
+	if value := os.Getenv(ContainerLimitsMemEnvVar); value != "" {
+		megabytes, err := strconv.Atoi(value)
+		if err != nil || megabytes <= 0 {
+			return nil, fmt.Errorf("%w: %s=%q", ErrInvalidMemoryLimit, ContainerLimitsMemEnvVar, value)
+		}
+
+		return &MemoryLimit{Megabytes: megabytes, Source: ContainerLimitsMemEnvVar}, nil
+	}
+
+	return ReadCgroupMemoryLimit(cgroupRoot)
+}
+
+// ReadCgroupMemoryLimit returns the cgroup v2 memory limit, or the cgroup v1 one if there is no v2 limit.
+// It returns ErrNoMemoryLimit if neither is present or the container is unlimited.
+func ReadCgroupMemoryLimit(root string) (*MemoryLimit, error) {
+	for _, name := range []string{cgroupV2MemoryLimit, cgroupV1MemoryLimit} {
+		path := filepath.Join(root, name)
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to read memory limit: %w", err)
+		}
+
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return nil, fmt.Errorf("%w: %s is max", ErrNoMemoryLimit, path)
+		}
+
+		bytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("%w: %s: %q", ErrInvalidMemoryLimit, path, value)
+		}
+
+		if bytes >= cgroupUnlimitedBytes {
+			return nil, fmt.Errorf("%w: %s is %d", ErrNoMemoryLimit, path, bytes)
+		}
+
+		return &MemoryLimit{Megabytes: int(bytes / bytesPerMegabyte), Source: path}, nil
+	}
+
+	return nil, fmt.Errorf("%w: no cgroup memory limit under %s", ErrNoMemoryLimit, root)
+}
@@ -17,6 +17,7 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -24,6 +25,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/couchbase/fluent-bit/pkg/logging"
 	"github.com/fsnotify/fsnotify"
@@ -48,6 +50,54 @@ const (
 	rebalanceLocationDefault = "/tmp/rebalance-logs"
 	bufferLocationEnvVar     = "STORAGE_BUFFER_PATH"
 	bufferLocationDefault    = "/tmp/buffer"
+	// StorageBufferMaxBytesEnvVar caps the size of the filesystem buffer, zero (the default) disables it.
+	StorageBufferMaxBytesEnvVar = "STORAGE_BUFFER_MAX_BYTES"
+	// StorageBufferIntervalEnvVar is how often the size of the filesystem buffer is checked.
+	StorageBufferIntervalEnvVar = "STORAGE_BUFFER_CHECK_INTERVAL"
+	// StorageBufferRemoveOrphansEnvVar removes the oldest chunks of Fluent Bit processes that are no longer running to keep within the cap.
+	StorageBufferRemoveOrphansEnvVar = "STORAGE_BUFFER_REMOVE_ORPHANS"
+	// StorageTotalLimitSizeEnvVar is set to the storage.total_limit_size of each output if the buffer is capped.
+	StorageTotalLimitSizeEnvVar = "STORAGE_TOTAL_LIMIT_SIZE"
+	// GeneratedConfigDirEnvVar is a scratch directory to generate the config Fluent Bit is started with in, rather than the mounted one.
+	GeneratedConfigDirEnvVar = "COUCHBASE_LOGS_GENERATED_CONFIG_DIR"
+	// Retention of the pre-processed rebalance reports.
+	RebalanceMaxFilesEnvVar = "COUCHBASE_LOGS_REBALANCE_MAX_FILES"
+	RebalanceMaxBytesEnvVar = "COUCHBASE_LOGS_REBALANCE_MAX_BYTES"
+	RebalanceMaxAgeEnvVar   = "COUCHBASE_LOGS_REBALANCE_MAX_AGE"
+	RebalanceMinAgeEnvVar   = "COUCHBASE_LOGS_REBALANCE_MIN_AGE"
+	// Comma-separated globs of the files in the rebalance directory to process or ignore.
+	RebalanceIncludeEnvVar = "COUCHBASE_LOGS_REBALANCE_INCLUDE"
+	RebalanceExcludeEnvVar = "COUCHBASE_LOGS_REBALANCE_EXCLUDE"
+	// RebalanceExplodeEnvVar writes a record per report section rather than one for the whole report.
+	RebalanceExplodeEnvVar = "COUCHBASE_LOGS_REBALANCE_EXPLODE"
+	// PreprocessDirsEnvVar lists extra directories to pre-process as <processor>:<watch dir>[:<output dir>],...
+	PreprocessDirsEnvVar = "COUCHBASE_LOGS_PREPROCESS_DIRS"
+	// JSONTypesEnvVar lists the types of JSON document to register as preprocessors as <type>[=<timestamp path>],...
+	JSONTypesEnvVar = "COUCHBASE_LOGS_JSON_TYPES"
+	// LogRootsEnvVar lists the log directories of multiple nodes as [<node>=]<dir>,... instead of COUCHBASE_LOGS.
+	LogRootsEnvVar = "COUCHBASE_LOGS_ROOTS"
+	// RedactionEnvVar enables redaction of <ud> tagged user data in the watcher: sha1 or hmac.
+	RedactionEnvVar = "COUCHBASE_LOGS_REDACTION"
+	// RedactionSaltFileEnvVar is the salt (or HMAC key), the same file the Lua redaction filter uses by default.
+	RedactionSaltFileEnvVar  = "COUCHBASE_LOGS_REDACTION_SALT_FILE"
+	redactionSaltFileDefault = "redaction.salt"
+	// RedactFilesEnvVar lists the log files, as patterns relative to the logs directory, to mirror with redaction applied.
+	RedactFilesEnvVar       = "COUCHBASE_LOGS_REDACT_FILES"
+	RedactIntervalEnvVar    = "COUCHBASE_LOGS_REDACT_INTERVAL"
+	redactedLocationEnvVar  = "COUCHBASE_LOGS_REDACTED_DIR"
+	redactedLocationDefault = "/tmp/redacted-logs"
+	// RebalanceAlertsEnvVar enables alerts for failed or stuck rebalances.
+	RebalanceAlertsEnvVar = "COUCHBASE_LOGS_REBALANCE_ALERTS"
+	// Alerts for failed or stuck rebalances are written to their own directory so they can be tailed with a dedicated tag.
+	rebalanceAlertLocationEnvVar  = "COUCHBASE_LOGS_REBALANCE_ALERT_DIR"
+	rebalanceAlertLocationDefault = "/tmp/rebalance-alerts"
+	// RebalanceAlertWebhookEnvVar is an optional URL each alert is also posted to.
+	RebalanceAlertWebhookEnvVar = "COUCHBASE_LOGS_REBALANCE_ALERT_WEBHOOK"
+	// The schema of the records wrapping rebalance reports and other JSON documents.
+	OutputFieldsEnvVar          = "COUCHBASE_LOGS_OUTPUT_FIELDS"
+	OutputTimestampFormatEnvVar = "COUCHBASE_LOGS_OUTPUT_TIMESTAMP_FORMAT"
+	OutputReportNameEnvVar      = "COUCHBASE_LOGS_OUTPUT_REPORT_NAME"
+	OutputStaticFieldsEnvVar    = "COUCHBASE_LOGS_OUTPUT_STATIC_FIELDS"
 	// KubernetesConfigEnvVar should only be used for testing.
 	KubernetesConfigEnvVar  = "COUCHBASE_K8S_CONFIG_DIR"
 	kubernetesConfigDefault = "/etc/podinfo"
@@ -63,6 +113,8 @@ const (
 	AuditEnabledEnvVar = "AUDIT_ENABLED"
 	// Memory Buf limits enabled environment variable.
 	MemBufLimitsEnabledEnvVar = "MEM_BUF_LIMITS_ENABLED"
+	// Relative weights of the inputs when sharing memory, e.g. MBL_AUDIT=2,MBL_METAKV=0.5.
+	MemBufLimitWeightsEnvVar = "MEM_BUF_LIMIT_WEIGHTS"
 	// Allowance for fluent bit memory estimation.
 	FluentBitMemoryMultiplier float32 = 1.2
 )
@@ -88,6 +140,18 @@ func GetStorageBufferDir() string {
 	return GetDirectory(bufferLocationDefault, bufferLocationEnvVar)
 }
 
+// GetStorageBufferMaxBytes returns the cap on the size of the filesystem buffer, zero if there is none.
+func GetStorageBufferMaxBytes() int64 {
+	return GetInt64(0, StorageBufferMaxBytesEnvVar)
+}
+
+// GetStorageBufferRemoveOrphans returns whether orphaned chunks can be removed to keep the buffer within its cap.
+func GetStorageBufferRemoveOrphans() bool {
+	remove, _ := strconv.ParseBool(os.Getenv(StorageBufferRemoveOrphansEnvVar))
+
+	return remove
+}
+
 func GetDynamicConfigDir() string {
 	return GetDirectory(dynamicConfigDefault, DynamicConfigEnvVar)
 }
@@ -98,6 +162,11 @@ func GetConfigFile() string {
 	return GetDirectory(filepath.Join(fluentBitConfigDir, configFileDefault), ConfigFileEnvVar)
 }
 
+// GetGeneratedConfigDir returns the directory to generate the Fluent Bit config in, empty to use the config as it is.
+func GetGeneratedConfigDir() string {
+	return os.Getenv(GeneratedConfigDirEnvVar)
+}
+
 func GetBinaryPath() string {
 	return GetDirectory(binaryDefault, binaryEnvVar)
 }
@@ -106,6 +175,12 @@ func GetLogsDir() string {
 	return GetDirectory(logsLocationDefault, logsLocationEnvVar)
 }
 
+// GetLogRoots returns the log directories of multiple nodes.
+// Returns empty string if not configured.
+func GetLogRoots() string {
+	return os.Getenv(LogRootsEnvVar)
+}
+
 func GetRebalanceReportDir() string {
 	couchbaseLogDir := GetLogsDir()
 
@@ -116,6 +191,99 @@ func GetRebalanceOutputDir() string {
 	return GetDirectory(rebalanceLocationDefault, rebalanceLocationEnvVar)
 }
 
+// GetRebalanceInclude returns the patterns of rebalance files to process.
+// Returns empty string if not configured.
+func GetRebalanceInclude() string {
+	return os.Getenv(RebalanceIncludeEnvVar)
+}
+
+// GetRebalanceExclude returns the patterns of rebalance files to ignore.
+// Returns empty string if not configured.
+func GetRebalanceExclude() string {
+	return os.Getenv(RebalanceExcludeEnvVar)
+}
+
+func GetRebalanceExplode() bool {
+	explode, _ := strconv.ParseBool(os.Getenv(RebalanceExplodeEnvVar))
+
+	return explode
+}
+
+// GetJSONTypes returns the types of JSON document to pre-process.
+// Returns empty string if none are configured.
+func GetJSONTypes() string {
+	return os.Getenv(JSONTypesEnvVar)
+}
+
+// GetPreprocessDirs returns the extra directories to pre-process.
+// Returns empty string if none are configured.
+func GetPreprocessDirs() string {
+	return os.Getenv(PreprocessDirsEnvVar)
+}
+
+// GetRedaction returns the redaction mode for user data.
+// Returns empty string if redaction is not enabled.
+func GetRedaction() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv(RedactionEnvVar)))
+}
+
+func GetRedactionSaltFile() string {
+	fluentBitConfigDir := GetDynamicConfigDir()
+
+	return GetDirectory(filepath.Join(fluentBitConfigDir, redactionSaltFileDefault), RedactionSaltFileEnvVar)
+}
+
+// GetRedactFiles returns the log files to mirror with redaction applied.
+// Returns empty string if none are configured.
+func GetRedactFiles() string {
+	return os.Getenv(RedactFilesEnvVar)
+}
+
+func GetRedactedOutputDir() string {
+	return GetDirectory(redactedLocationDefault, redactedLocationEnvVar)
+}
+
+// GetRebalanceAlerts returns true if alerts for failed or stuck rebalances are enabled, they are disabled by default.
+func GetRebalanceAlerts() bool {
+	alerts, _ := strconv.ParseBool(os.Getenv(RebalanceAlertsEnvVar))
+
+	return alerts
+}
+
+func GetRebalanceAlertDir() string {
+	return GetDirectory(rebalanceAlertLocationDefault, rebalanceAlertLocationEnvVar)
+}
+
+// GetRebalanceAlertWebhook returns the URL to post rebalance alerts to.
+// Returns empty string if not configured.
+func GetRebalanceAlertWebhook() string {
+	return os.Getenv(RebalanceAlertWebhookEnvVar)
+}
+
+// GetOutputFields returns the renamed output fields as <field>=<name>,...
+// Returns empty string if not configured.
+func GetOutputFields() string {
+	return os.Getenv(OutputFieldsEnvVar)
+}
+
+// GetOutputTimestampFormat returns the format of output timestamps.
+// Returns empty string if not configured.
+func GetOutputTimestampFormat() string {
+	return os.Getenv(OutputTimestampFormatEnvVar)
+}
+
+// GetOutputReportName returns whether the output report name is the full path or base name.
+// Returns empty string if not configured.
+func GetOutputReportName() string {
+	return os.Getenv(OutputReportNameEnvVar)
+}
+
+// GetOutputStaticFields returns the static fields to add to every output record as <field>=<environment variable>,...
+// Returns empty string if not configured.
+func GetOutputStaticFields() string {
+	return os.Getenv(OutputStaticFieldsEnvVar)
+}
+
 func GetKubernetesConfigDir() string {
 	return GetDirectory(kubernetesConfigDefault, KubernetesConfigEnvVar)
 }
@@ -186,33 +354,43 @@ func memoryBufferLimitEnabled() bool {
 	return false
 }
 
-// Sets memory buffer limits if enabled.
-func CheckAndEnableMemoryBufLimits() {
+// Sets memory buffer limits if enabled, calculated for the Fluent Bit config at the path.
+func CheckAndEnableMemoryBufLimits(configPath string) {
 	setMemoryBufLimitDefaults()
 
 	if memoryBufferLimitEnabled() {
-		updateMemoryBufLimits()
+		updateMemoryBufLimits(configPath)
 	}
 }
 
-// updateDefaultMemoryBufLimits calculates the.
-func updateMemoryBufLimits() {
-	memoryLimit := os.Getenv(ContainerLimitsMemEnvVar)
-	if memoryLimit == "" {
+// updateMemoryBufLimits calculates the limits for the config from the container memory limit.
+func updateMemoryBufLimits(configPath string) {
+	memoryLimit, err := GetContainerMemoryLimit(DefaultCgroupRoot)
+	if errors.Is(err, ErrNoMemoryLimit) {
+		log.Infow("No container memory limit found, not updating memory buffer limits", "reason", err)
+		setMemoryBufLimitDefaults()
+
+		return
+	} else if err != nil && os.Getenv(ContainerLimitsMemEnvVar) != "" {
+		log.Fatalw("Unable to get container memory limit", "error", err)
+	} else if err != nil {
+		// A cgroup that cannot be read is no reason to stop the sidecar, run as if there was no limit.
+		log.Warnw("Unable to read container memory limit, not updating memory buffer limits", "error", err)
 		setMemoryBufLimitDefaults()
 
 		return
 	}
 
-	memoryMB, err := strconv.Atoi(memoryLimit)
+	memoryMB := memoryLimit.Megabytes
+	log.Infow("Using container memory limit", "limit", fmt.Sprintf("%dMB", memoryMB), "source", memoryLimit.Source)
 
+	fbConfig, err := ParseConfigFile(configPath)
 	if err != nil {
-		log.Fatalw("Unable to convert environment memory limit to int", ContainerLimitsMemEnvVar, memoryLimit)
-	}
+		// Fluent Bit may well accept a config we cannot parse so leave it to decide, as if there was no limit.
+		log.Warnw("Unable to parse fb config file, not updating memory buffer limits", "error", err, "config", configPath)
+		setMemoryBufLimitDefaults()
 
-	fbConfig, err := BuildConfigFile(GetConfigFile())
-	if err != nil {
-		log.Fatalw("Failed to parse fb config file", "error", err)
+		return
 	}
 
 	memBufConfig := CreateMemBufLimitConfig(fbConfig)
@@ -229,21 +407,18 @@ func updateMemoryBufLimits() {
 		return
 	}
 
-	perInputMemLimit := calculatePerInputMemoryLimit(memoryMB, memBufConfig.NumInputs, memBufConfig.NumOutputs)
-
-	megabyteString := fmt.Sprintf("%dMB", perInputMemLimit)
-	log.Info("Setting new memory buffer limits ", perInputMemLimit)
-
-	for _, k := range memBufConfig.MemBufLimitNames {
-		os.Setenv(k, megabyteString)
+	weights, err := ParseMemBufLimitWeights(os.Getenv(MemBufLimitWeightsEnvVar))
+	if err != nil {
+		log.Fatalw("Failed to parse memory buffer limit weights", MemBufLimitWeightsEnvVar, os.Getenv(MemBufLimitWeightsEnvVar), "error", err)
 	}
-}
 
-// https://docs.fluentbit.io/manual/v/1.0/configuration/memory_usage#estimating
-func calculatePerInputMemoryLimit(totalMemory, inputs, outputs int) int {
-	estimatedMemoryUsage := float32(inputs+2*outputs) * FluentBitMemoryMultiplier
+	estimate := EstimateMemoryBufLimits(fbConfig, memoryMB, weights)
+	log.Infow("Setting new memory buffer limits", "total", memoryMB, "overhead", estimate.OverheadMB, "overheads", estimate.Overheads, "shares", estimate.Shares)
 
-	return totalMemory / int(estimatedMemoryUsage)
+	for _, limit := range estimate.Limits {
+		log.Infow("Memory buffer limit", "variable", limit.Variable, "limit", fmt.Sprintf("%dMB", limit.LimitMB), "explanation", limit.Explanation)
+		os.Setenv(limit.Variable, fmt.Sprintf("%dMB", limit.LimitMB))
+	}
 }
 
 // Some extra processing of specific "fluentbit.couchbase.com" annotations ones:
@@ -291,6 +466,40 @@ func GetDirectory(defaultValue, environmentVariable string) string {
 	return path.Clean(directoryName)
 }
 
+// GetInt64 returns the integer value of the environment variable or the default if it is unset or invalid.
+func GetInt64(defaultValue int64, environmentVariable string) int64 {
+	value := os.Getenv(environmentVariable)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Warnw("Invalid integer in environment variable so defaulting", "environmentVariable", environmentVariable, "value", value, "defaultValue", defaultValue, "error", err)
+
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// GetDuration returns the duration value (e.g. "90s", "24h") of the environment variable or the default if it is unset or invalid.
+func GetDuration(defaultValue time.Duration, environmentVariable string) time.Duration {
+	value := os.Getenv(environmentVariable)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warnw("Invalid duration in environment variable so defaulting", "environmentVariable", environmentVariable, "value", value, "defaultValue", defaultValue, "error", err)
+
+		return defaultValue
+	}
+
+	return parsed
+}
+
 func IsValidEvent(event fsnotify.Event) bool {
 	// Inspired by https://github.com/jimmidyson/configmap-reload
 	return event.Op&fsnotify.Create == fsnotify.Create
@@ -16,8 +16,10 @@
 package common_test
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/couchbase/fluent-bit/pkg/common"
@@ -99,7 +101,7 @@ func TestHandlesEnvMemBufLimits(t *testing.T) {
 	os.Setenv("STDOUT_MATCH", "*")
 	os.Setenv("ES_MATCH", "*")
 
-	common.CheckAndEnableMemoryBufLimits()
+	common.CheckAndEnableMemoryBufLimits(common.GetConfigFile())
 
 	for _, key := range keys {
 		if os.Getenv(key) != expected {
@@ -116,7 +118,7 @@ func TestHandlesEnvMemBufLimits(t *testing.T) {
 
 	os.Setenv(common.AuditEnabledEnvVar, "false")
 
-	common.CheckAndEnableMemoryBufLimits()
+	common.CheckAndEnableMemoryBufLimits(common.GetConfigFile())
 
 	for _, key := range keys {
 		if os.Getenv(key) != expected {
@@ -130,7 +132,7 @@ func TestHandlesEnvMemBufLimits(t *testing.T) {
 
 	// Test if no memory buffer limits exist to be set
 	os.Setenv(common.ConfigFileEnvVar, "../../test/example/test-fluent-bit-simple.conf")
-	common.CheckAndEnableMemoryBufLimits()
+	common.CheckAndEnableMemoryBufLimits(common.GetConfigFile())
 
 	expected = "false"
 
@@ -142,3 +144,33 @@ func TestHandlesEnvMemBufLimits(t *testing.T) {
 		}
 	}
 }
+
+func TestReadCgroupMemoryLimit(t *testing.T) {
+	t.Parallel()
+
+	for root, expected := range map[string]int{"v2": 512, "v1": 1024} {
+		limit, err := common.ReadCgroupMemoryLimit(filepath.Join("testdata/cgroup", root))
+		if err != nil {
+			t.Fatalf("%s: unable to read limit: %v", root, err)
+		}
+
+		if limit.Megabytes != expected {
+			t.Errorf("%s: %dMB != %dMB", root, limit.Megabytes, expected)
+		}
+
+		// The file is logged so it is clear where the limit came from
+		if !strings.HasPrefix(limit.Source, filepath.Join("testdata/cgroup", root)) {
+			t.Errorf("%s: unexpected source %q", root, limit.Source)
+		}
+	}
+
+	for _, root := range []string{"v2-unlimited", "v1-unlimited", "missing"} {
+		if _, err := common.ReadCgroupMemoryLimit(filepath.Join("testdata/cgroup", root)); !errors.Is(err, common.ErrNoMemoryLimit) {
+			t.Errorf("%s: expected no memory limit but got %v", root, err)
+		}
+	}
+
+	if _, err := common.ReadCgroupMemoryLimit("testdata/cgroup/invalid"); !errors.Is(err, common.ErrInvalidMemoryLimit) {
+		t.Errorf("expected invalid memory limit but got %v", err)
+	}
+}
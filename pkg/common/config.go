@@ -0,0 +1,271 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Section types of a Fluent Bit configuration, always upper case.
+const (
+	SectionService         = "SERVICE"
+	SectionInput           = "INPUT"
+	SectionFilter          = "FILTER"
+	SectionOutput          = "OUTPUT"
+	SectionParser          = "PARSER"
+	SectionMultilineParser = "MULTILINE_PARSER"
+	SectionPlugins         = "PLUGINS"
+	SectionUpstream        = "UPSTREAM"
+	SectionCustom          = "CUSTOM"
+	// SectionNode is a server of the preceding UPSTREAM section.
+	SectionNode = "NODE"
+)
+
+// Configuration file formats.
+const (
+	ConfigFormatClassic = "classic"
+	ConfigFormatYAML    = "yaml"
+)
+
+var (
+	// ErrInvalidConfig indicates a Fluent Bit configuration could not be parsed.
+	ErrInvalidConfig = errors.New("invalid fluent bit config")
+	// ErrIncludeCycle indicates a configuration file includes itself, directly or indirectly.
+	ErrIncludeCycle = errors.New("include cycle")
+
+	sectionTypes = []string{
+		SectionService, SectionInput, SectionFilter, SectionOutput, SectionParser,
+		SectionMultilineParser, SectionPlugins, SectionUpstream, SectionCustom, SectionNode,
+	}
+)
+
+// Position is where something was read from so errors can point at it.
+type Position struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// Node is a top level element of a configuration file: a section, directive or comment.
+type Node interface {
+	Pos() Position
+}
+
+// Comment is a whole line comment, the text is everything after the #.
+type Comment struct {
+	Text     string
+	Position Position
+}
+
+func (c *Comment) Pos() Position {
+	return c.Position
+}
+
+// Entry is a key/value pair of a section, the key keeps its original case.
+type Entry struct {
+	Key   string
+	Value string
+	// Structured is true if the value is flow style YAML, e.g. processors, as there is no classic equivalent.
+	Structured bool
+	// Comments are the ones immediately before the entry.
+	Comments []*Comment
+	Position Position
+}
+
+// Section is a [TYPE] section and its entries in order.
+type Section struct {
+	// Type is always upper case, e.g. INPUT.
+	Type string
+	// Header is the type as written, e.g. Input.
+	Header   string
+	Entries  []*Entry
+	Position Position
+}
+
+func (s *Section) Pos() Position {
+	return s.Position
+}
+
+// Entry returns the first entry with the key, ignoring case as Fluent Bit does, or nil if there is none.
+func (s *Section) Entry(key string) *Entry {
+	for _, entry := range s.Entries {
+		if strings.EqualFold(entry.Key, key) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Get returns the value of the first entry with the key, empty if there is none.
+func (s *Section) Get(key string) string {
+	if entry := s.Entry(key); entry != nil {
+		return entry.Value
+	}
+
+	return ""
+}
+
+// Name returns the plugin name of the section.
+func (s *Section) Name() string {
+	return s.Get("Name")
+}
+
+// NewSection creates an empty section of the type, e.g. to add a plugin to a configuration.
+func NewSection(sectionType string) *Section {
+	return &Section{Type: strings.ToUpper(sectionType), Header: strings.ToUpper(sectionType)}
+}
+
+// Set changes the value of the first entry with the key, keeping its comments and position, or adds an entry if there is none.
+func (s *Section) Set(key, value string) {
+	if entry := s.Entry(key); entry != nil {
+		entry.Value = value
+		entry.Structured = false
+
+		return
+	}
+
+	s.Add(key, value)
+}
+
+// Add adds an entry to the end of the section even if there are others with the key, e.g. a repeated Path.
+func (s *Section) Add(key, value string) {
+	s.Entries = append(s.Entries, &Entry{Key: key, Value: value, Position: s.Position})
+}
+
+// Include is an @include directive, Files are the files it resolved to if includes have been followed.
+type Include struct {
+	Path     string
+	Files    []*ConfigFile
+	Position Position
+}
+
+func (i *Include) Pos() Position {
+	return i.Position
+}
+
+// Set is an @set directive defining a variable.
+type Set struct {
+	Key      string
+	Value    string
+	Position Position
+}
+
+func (s *Set) Pos() Position {
+	return s.Position
+}
+
+// ConfigFile is a parsed configuration file with its nodes in order, both formats are parsed into the same nodes.
+type ConfigFile struct {
+	Path   string
+	Format string
+	Nodes  []Node
+}
+
+// Walk calls visit for every node in order, following any includes that have been resolved.
+func (c *ConfigFile) Walk(visit func(Node)) {
+	for _, node := range c.Nodes {
+		visit(node)
+
+		if include, ok := node.(*Include); ok {
+			for _, file := range include.Files {
+				file.Walk(visit)
+			}
+		}
+	}
+}
+
+// Sections returns every section in order, including those from included files.
+func (c *ConfigFile) Sections() []*Section {
+	var sections []*Section
+
+	c.Walk(func(node Node) {
+		if section, ok := node.(*Section); ok {
+			sections = append(sections, section)
+		}
+	})
+
+	return sections
+}
+
+// SectionsOf returns every section of the type in order, including those from included files.
+func (c *ConfigFile) SectionsOf(sectionType string) []*Section {
+	var sections []*Section
+
+	for _, section := range c.Sections() {
+		if section.Type == strings.ToUpper(sectionType) {
+			sections = append(sections, section)
+		}
+	}
+
+	return sections
+}
+
+func (c *ConfigFile) Inputs() []*Section {
+	return c.SectionsOf(SectionInput)
+}
+
+func (c *ConfigFile) Outputs() []*Section {
+	return c.SectionsOf(SectionOutput)
+}
+
+// Insert adds the nodes immediately before the node, which can be in an included file, or at the end of this file if it is nil.
+// It returns false if the node cannot be found.
+func (c *ConfigFile) Insert(before Node, nodes ...Node) bool {
+	if before == nil {
+		c.Nodes = append(c.Nodes, nodes...)
+
+		return true
+	}
+
+	for i, node := range c.Nodes {
+		if node == before {
+			c.Nodes = slices.Insert(c.Nodes, i, nodes...)
+
+			return true
+		}
+
+		if include, ok := node.(*Include); ok {
+			for _, file := range include.Files {
+				if file.Insert(before, nodes...) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Variables returns every @set directive in order, including those from included files.
+func (c *ConfigFile) Variables() []*Set {
+	var variables []*Set
+
+	c.Walk(func(node Node) {
+		if set, ok := node.(*Set); ok {
+			variables = append(variables, set)
+		}
+	})
+
+	return variables
+}
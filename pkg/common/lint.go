@@ -0,0 +1,299 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Severity of a lint finding.
+type Severity string
+
+const (
+	// SeverityError will break logging, e.g. records going to the wrong place.
+	SeverityError Severity = "error"
+	// SeverityWarning is likely to be a mistake but logging still works.
+	SeverityWarning Severity = "warning"
+)
+
+// Output formats of lint findings.
+const (
+	LintFormatText = "text"
+	LintFormatJSON = "json"
+)
+
+// ErrUnknownLintFormat indicates an output format for findings other than text or JSON.
+var ErrUnknownLintFormat = errors.New("unknown lint format")
+
+// Finding is a problem found by a lint rule.
+type Finding struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	Position Position `json:"position"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s (%s)", f.Position, f.Severity, f.Message, f.Rule)
+}
+
+// lintRule checks the whole configuration, the resolver has every variable the configuration sets.
+type lintRule func(l *Linter, config *ConfigFile, resolver *VariableResolver) []Finding
+
+// Linter checks a configuration for the mistakes we keep making that only show up at runtime.
+type Linter struct {
+	// LogDirs are the directories tail inputs are expected to read from: the Couchbase logs and our own output directories.
+	LogDirs []string
+	// AuditEnabled is false if there are no audit logs to read.
+	AuditEnabled bool
+}
+
+// NewLinterFromDefaults creates a linter for the environment.
+func NewLinterFromDefaults() *Linter {
+	dirs := []string{GetLogsDir(), GetRebalanceOutputDir(), GetRedactedOutputDir(), GetRebalanceAlertDir()}
+
+	// Only the directories are needed, the node names are checked by the watcher
+	for _, root := range strings.Split(GetLogRoots(), ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			_, dir, named := strings.Cut(root, "=")
+			if !named {
+				dir = root
+			}
+
+			dirs = append(dirs, strings.TrimSpace(dir))
+		}
+	}
+
+	return &Linter{LogDirs: dirs, AuditEnabled: GetAuditEnabled()}
+}
+
+// Lint runs every rule over the configuration, the findings are in order of where they are.
+func (l *Linter) Lint(config *ConfigFile) []Finding {
+	resolver := NewVariableResolver(config)
+
+	var findings []Finding
+
+	for _, rule := range []lintRule{lintNoMatch, lintMemBufLimit, lintTailPath, lintAuditDisabled, lintDuplicateTag} {
+		findings = append(findings, rule(l, config, resolver)...)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Position.File != findings[j].Position.File {
+			return findings[i].Position.File < findings[j].Position.File
+		}
+
+		return findings[i].Position.Line < findings[j].Position.Line
+	})
+
+	return findings
+}
+
+// HasErrors returns true if any of the findings are errors.
+func HasErrors(findings []Finding) bool {
+	for _, finding := range findings {
+		if finding.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteFindings writes the findings as text, one per line, or as a JSON array.
+func WriteFindings(out io.Writer, findings []Finding, format string) error {
+	switch format {
+	case LintFormatText, "":
+		for _, finding := range findings {
+			if _, err := fmt.Fprintln(out, finding); err != nil {
+				return fmt.Errorf("unable to write findings: %w", err)
+			}
+		}
+	case LintFormatJSON:
+		// Always an array, even if empty
+		if findings == nil {
+			findings = []Finding{}
+		}
+
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(findings); err != nil {
+			return fmt.Errorf("unable to write findings: %w", err)
+		}
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownLintFormat, format)
+	}
+
+	return nil
+}
+
+// entryPosition returns where the entry is, or the section if it does not have one.
+func entryPosition(section *Section, key string) Position {
+	if entry := section.Entry(key); entry != nil {
+		return entry.Position
+	}
+
+	return section.Position
+}
+
+// lintNoMatch finds outputs that never get any records as their match is no-match, they still use resources.
+func lintNoMatch(_ *Linter, config *ConfigFile, resolver *VariableResolver) []Finding {
+	var findings []Finding
+
+	for _, output := range config.Outputs() {
+		if outputEnabled(output, resolver) {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			Rule:     "no-match",
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("%s output does not match anything, its match %q resolves to %q", output.Name(), output.Get("Match"), resolver.Expand(output.Get("Match"))),
+			Position: entryPosition(output, "Match"),
+		})
+	}
+
+	return findings
+}
+
+// lintMemBufLimit finds inputs the memory buffer limit calculation cannot set a limit for.
+func lintMemBufLimit(_ *Linter, config *ConfigFile, resolver *VariableResolver) []Finding {
+	var findings []Finding
+
+	for _, input := range config.Inputs() {
+		limit := input.Get("Mem_Buf_Limit")
+
+		var message string
+
+		switch names := References(limit); {
+		case limit == "":
+			message = fmt.Sprintf("%s input has no Mem_Buf_Limit", input.Name())
+		case len(names) == 0:
+			message = fmt.Sprintf("%s input has a fixed Mem_Buf_Limit of %q rather than a ${MBL_*} variable", input.Name(), limit)
+		case resolver.IsSet(names[0]):
+			message = fmt.Sprintf("%s input Mem_Buf_Limit variable %q is set in the config so cannot be calculated", input.Name(), names[0])
+		default:
+			continue
+		}
+
+		findings = append(findings, Finding{Rule: "mem-buf-limit", Severity: SeverityWarning, Message: message, Position: entryPosition(input, "Mem_Buf_Limit")})
+	}
+
+	return findings
+}
+
+// lintTailPath finds tail inputs reading files that are neither Couchbase logs nor ones we create.
+func lintTailPath(l *Linter, config *ConfigFile, resolver *VariableResolver) []Finding {
+	var findings []Finding
+
+	for _, input := range config.Inputs() {
+		if !strings.EqualFold(input.Name(), "tail") {
+			continue
+		}
+
+		// Multiple paths are comma separated
+		for _, path := range strings.Split(resolver.Expand(input.Get("Path")), ",") {
+			if path = strings.TrimSpace(path); path == "" || l.isLogPath(path) {
+				continue
+			}
+
+			findings = append(findings, Finding{
+				Rule:     "tail-path",
+				Severity: SeverityWarning,
+				Message:  fmt.Sprintf("tail input path %q is not in any of the log directories: %s", path, strings.Join(l.LogDirs, ", ")),
+				Position: entryPosition(input, "Path"),
+			})
+		}
+	}
+
+	return findings
+}
+
+func (l *Linter) isLogPath(path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+
+	for _, dir := range l.LogDirs {
+		if relative, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path)); err == nil && !strings.HasPrefix(relative, "..") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lintAuditDisabled finds audit inputs when auditing is disabled, there is nothing for them to read.
+func lintAuditDisabled(l *Linter, config *ConfigFile, resolver *VariableResolver) []Finding {
+	if l.AuditEnabled {
+		return nil
+	}
+
+	var findings []Finding
+
+	for _, input := range config.Inputs() {
+		if !strings.HasSuffix(strings.ToUpper(resolver.Expand(input.Get("Path"))), "AUDIT.LOG") {
+			continue
+		}
+
+		findings = append(findings, Finding{
+			Rule:     "audit-disabled",
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("%s input reads the audit log but %s is not true", input.Name(), AuditEnabledEnvVar),
+			Position: entryPosition(input, "Path"),
+		})
+	}
+
+	return findings
+}
+
+// lintDuplicateTag finds inputs with the same tag, their records cannot be told apart.
+func lintDuplicateTag(_ *Linter, config *ConfigFile, resolver *VariableResolver) []Finding {
+	var findings []Finding
+
+	tags := map[string]Position{}
+
+	for _, input := range config.Inputs() {
+		tag := resolver.Expand(input.Get("Tag"))
+		if tag == "" {
+			continue
+		}
+
+		position := entryPosition(input, "Tag")
+
+		if first, found := tags[tag]; found {
+			findings = append(findings, Finding{
+				Rule:     "duplicate-tag",
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("tag %q is already used by the input at %s", tag, first),
+				Position: position,
+			})
+
+			continue
+		}
+
+		tags[tag] = position
+	}
+
+	return findings
+}
@@ -0,0 +1,101 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+
+	config, err := common.ParseConfig(strings.NewReader(`@set MBL_SET=5MB
+[INPUT]
+    Name          tail
+    Path          /logs/audit.log
+    Tag           couchbase.log.audit
+    Mem_Buf_Limit ${MBL_AUDIT}
+
+[INPUT]
+    Name          tail
+    Path          /logs/indexer.log,/var/log/messages
+    Tag           couchbase.log.audit
+    Mem_Buf_Limit ${MBL_SET}
+
+[INPUT]
+    Name tail
+    Path /tmp/rebalance-logs/*.json
+    Tag  couchbase.log.rebalance
+
+[OUTPUT]
+    Name  stdout
+    Match ${TEST_LINT_UNSET_MATCH}
+`), "lint.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	linter := &common.Linter{LogDirs: []string{"/logs", "/tmp/rebalance-logs"}, AuditEnabled: false}
+	findings := linter.Lint(config)
+
+	var found []string
+	for _, finding := range findings {
+		found = append(found, fmt.Sprintf("%d:%s:%s", finding.Position.Line, finding.Rule, finding.Severity))
+	}
+
+	expected := []string{
+		"4:audit-disabled:warning",
+		"10:tail-path:warning",
+		"11:duplicate-tag:error",
+		"12:mem-buf-limit:warning",
+		// The section as there is no entry
+		"14:mem-buf-limit:warning",
+		"21:no-match:warning",
+	}
+
+	if !slices.Equal(found, expected) {
+		t.Errorf("unexpected findings: %v", found)
+	}
+
+	if !common.HasErrors(findings) {
+		t.Errorf("expected errors")
+	}
+
+	var text strings.Builder
+	if err := common.WriteFindings(&text, findings[:1], common.LintFormatText); err != nil {
+		t.Fatalf("unable to write findings: %v", err)
+	}
+
+	if text.String() != "lint.conf:4: warning: tail input reads the audit log but AUDIT_ENABLED is not true (audit-disabled)\n" {
+		t.Errorf("unexpected text: %q", text.String())
+	}
+
+	var encoded strings.Builder
+	if err := common.WriteFindings(&encoded, findings, common.LintFormatJSON); err != nil {
+		t.Fatalf("unable to write findings: %v", err)
+	}
+
+	var decoded []common.Finding
+	if err := json.Unmarshal([]byte(encoded.String()), &decoded); err != nil || !slices.Equal(decoded, findings) {
+		t.Errorf("unexpected JSON %q: %v", encoded.String(), err)
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Estimates of memory used outside of the memory buffer limits, see
+// https://docs.fluentbit.io/manual/administration/memory-management#estimating
+const (
+	// An output can have as much again in flight as is buffered for it.
+	outputShares = 2
+	// A Lua filter has its own Lua state with the script loaded.
+	luaFilterMemoryMB = 8
+	// Filesystem storage keeps up to storage.max_chunks_up chunks of around 2MB in memory, shared by every input.
+	storageChunkMB     = 2
+	defaultMaxChunksUp = 128
+	// Network inputs receive bursts so get a larger share by default.
+	networkInputWeight = 2
+)
+
+var (
+	// ErrInvalidMemBufLimitWeight indicates the relative weights of the inputs could not be parsed.
+	ErrInvalidMemBufLimitWeight = errors.New("invalid memory buffer limit weight")
+
+	networkInputs = []string{"forward", "http", "tcp", "udp", "syslog", "opentelemetry", "mqtt"}
+)
+
+type MembufLimitConfig struct {
+	NumInputs        int
+	NumOutputs       int
+	MemBufLimitNames []string
+}
+
+// CreateMemBufLimitConfig takes a parsed config and returns
+// all memory buffer limit environment variables and
+// total number of enabled inputs and outputs.
+// Variables defined by @set are not included as the environment cannot change them.
+func CreateMemBufLimitConfig(config *ConfigFile) *MembufLimitConfig {
+	memBufConfig := &MembufLimitConfig{}
+	resolver := NewVariableResolver(config)
+
+	for _, input := range config.Inputs() {
+		if inputEnabled(input, resolver) {
+			memBufConfig.NumInputs++
+		}
+
+		for _, name := range References(input.Get("Mem_Buf_Limit")) {
+			if !resolver.IsSet(name) {
+				memBufConfig.MemBufLimitNames = append(memBufConfig.MemBufLimitNames, name)
+			}
+		}
+	}
+
+	for _, output := range config.Outputs() {
+		if outputEnabled(output, resolver) {
+			memBufConfig.NumOutputs++
+		}
+	}
+
+	return memBufConfig
+}
+
+// inputEnabled returns false for the audit log input if auditing is disabled as it will never read anything.
+func inputEnabled(input *Section, resolver *VariableResolver) bool {
+	return GetAuditEnabled() || !strings.HasSuffix(strings.ToUpper(resolver.Expand(input.Get("Path"))), "AUDIT.LOG")
+}
+
+// outputEnabled returns false if the output does not match anything, i.e. its match is empty or no-match.
+func outputEnabled(output *Section, resolver *VariableResolver) bool {
+	match := output.Get("Match")
+	if match == "" {
+		match = output.Get("Match_Regex")
+	}
+
+	match = resolver.Expand(match)
+
+	return match != "" && match != "no-match"
+}
+
+// MemoryEstimate is how the memory buffer limits were calculated so each one can be explained.
+type MemoryEstimate struct {
+	TotalMB int
+	// OverheadMB is the memory used outside of the buffers, Overheads says what for.
+	OverheadMB float64
+	Overheads  []string
+	// Shares is the total weight of the inputs and outputs sharing what is left.
+	Shares float64
+	Limits []MemBufLimit
+}
+
+// MemBufLimit is the value of an ${MBL_*} variable and why.
+type MemBufLimit struct {
+	Variable    string
+	LimitMB     int
+	Weight      float64
+	Explanation string
+}
+
+// inputShare is the weight of an input and the memory buffer limit variables it uses.
+type inputShare struct {
+	variables []string
+	weight    float64
+	reasons   []string
+}
+
+// ParseMemBufLimitWeights parses the relative weights of the inputs as a comma-separated list of <variable>=<weight>,
+// e.g. MBL_AUDIT=2,MBL_METAKV=0.5 gives the audit input four times the memory buffer of the metakv one.
+func ParseMemBufLimitWeights(value string) (map[string]float64, error) {
+	weights := map[string]float64{}
+
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		variable, weight, found := strings.Cut(entry, "=")
+
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if !found || err != nil || parsed <= 0 || math.IsInf(parsed, 0) {
+			return nil, fmt.Errorf("%w: %q is not <variable>=<positive number>", ErrInvalidMemBufLimitWeight, entry)
+		}
+
+		weights[strings.TrimSpace(variable)] = parsed
+	}
+
+	return weights, nil
+}
+
+// EstimateMemoryBufLimits shares the memory between the inputs, after what the plugins use themselves, in proportion to their weight.
+// An input is weighted by its plugin type and the configured weight of its variable.
+// Outputs have a share of double the weight of an input and filesystem storage inputs have no share
+// as Fluent Bit limits them with storage.max_chunks_up instead.
+func EstimateMemoryBufLimits(config *ConfigFile, totalMB int, weights map[string]float64) *MemoryEstimate {
+	estimate := &MemoryEstimate{TotalMB: totalMB}
+	resolver := NewVariableResolver(config)
+
+	var inputs []inputShare
+
+	filesystem := false
+
+	for _, input := range config.Inputs() {
+		share := estimate.inputShare(input, resolver, weights)
+		if strings.EqualFold(resolver.Expand(input.Get("storage.type")), "filesystem") {
+			filesystem = true
+		}
+
+		inputs = append(inputs, share)
+	}
+
+	estimate.addOverheads(config, resolver, filesystem)
+
+	for _, output := range config.Outputs() {
+		if outputEnabled(output, resolver) {
+			estimate.Shares += outputShares
+		}
+	}
+
+	// The multiplier is an allowance for everything else, rounded down as it always has been unless that leaves nothing
+	divisor := float64(float32(estimate.Shares) * FluentBitMemoryMultiplier)
+	if divisor <= 0 {
+		return estimate
+	}
+
+	divisor = max(math.Floor(divisor), min(divisor, 1))
+
+	perShare := (float64(totalMB) - estimate.OverheadMB) / divisor
+
+	for _, input := range inputs {
+		estimate.addLimits(input, perShare, divisor)
+	}
+
+	return estimate
+}
+
+// inputShare weighs the input and counts it towards the shares if it is enabled and uses the memory buffer limit.
+func (e *MemoryEstimate) inputShare(input *Section, resolver *VariableResolver, weights map[string]float64) inputShare {
+	share := inputShare{weight: 1}
+
+	for _, variable := range References(input.Get("Mem_Buf_Limit")) {
+		if !resolver.IsSet(variable) {
+			share.variables = append(share.variables, variable)
+		}
+	}
+
+	name := strings.ToLower(input.Name())
+	if slices.Contains(networkInputs, name) {
+		share.weight *= networkInputWeight
+		share.reasons = append(share.reasons, fmt.Sprintf("%s input weight %d", name, networkInputWeight))
+	}
+
+	for _, variable := range share.variables {
+		if weight, found := weights[variable]; found {
+			share.weight *= weight
+			share.reasons = append(share.reasons, fmt.Sprintf("configured weight %g", weight))
+
+			break
+		}
+	}
+
+	switch {
+	case !inputEnabled(input, resolver):
+		share.reasons = append(share.reasons, "not counted as audit is disabled")
+	case strings.EqualFold(resolver.Expand(input.Get("storage.type")), "filesystem"):
+		share.reasons = append(share.reasons, "not counted as filesystem storage is limited by storage.max_chunks_up")
+	default:
+		e.Shares += share.weight
+	}
+
+	if name == "tail" {
+		// Each file being read has a buffer that can grow up to the largest of these
+		buffer := max(parseSizeMB(resolver.Expand(input.Get("Buffer_Chunk_Size"))), parseSizeMB(resolver.Expand(input.Get("Buffer_Max_Size"))))
+		if buffer > 0 {
+			e.addOverhead(buffer, fmt.Sprintf("%s tail buffer %.2fMB", input.Position, buffer))
+		}
+	}
+
+	return share
+}
+
+func (e *MemoryEstimate) addOverheads(config *ConfigFile, resolver *VariableResolver, filesystem bool) {
+	for _, filter := range config.SectionsOf(SectionFilter) {
+		if strings.EqualFold(filter.Name(), "lua") {
+			e.addOverhead(luaFilterMemoryMB, fmt.Sprintf("%s Lua filter %dMB", filter.Position, luaFilterMemoryMB))
+		}
+	}
+
+	if !filesystem {
+		return
+	}
+
+	maxChunksUp := defaultMaxChunksUp
+
+	for _, service := range config.SectionsOf(SectionService) {
+		if value, err := strconv.Atoi(resolver.Expand(service.Get("storage.max_chunks_up"))); err == nil && value > 0 {
+			maxChunksUp = value
+		}
+	}
+
+	e.addOverhead(float64(maxChunksUp*storageChunkMB), fmt.Sprintf("filesystem storage %d chunks up x %dMB", maxChunksUp, storageChunkMB))
+}
+
+func (e *MemoryEstimate) addOverhead(megabytes float64, reason string) {
+	e.OverheadMB += megabytes
+	e.Overheads = append(e.Overheads, reason)
+}
+
+// addLimits sets the limit of each of the input's variables, if a variable is shared by inputs the smallest limit is used.
+func (e *MemoryEstimate) addLimits(input inputShare, perShare, divisor float64) {
+	limit := max(int(input.weight*perShare), 1)
+
+	explanation := fmt.Sprintf("weight %g x %.2fMB per share: (%dMB total - %.2fMB overhead) / %g (%g shares x %g rounded down)",
+		input.weight, perShare, e.TotalMB, e.OverheadMB, divisor, e.Shares, FluentBitMemoryMultiplier)
+	if len(input.reasons) > 0 {
+		explanation += ", " + strings.Join(input.reasons, ", ")
+	}
+
+	for _, variable := range input.variables {
+		index := slices.IndexFunc(e.Limits, func(existing MemBufLimit) bool { return existing.Variable == variable })
+
+		switch {
+		case index == -1:
+			e.Limits = append(e.Limits, MemBufLimit{Variable: variable, LimitMB: limit, Weight: input.weight, Explanation: explanation})
+		case limit < e.Limits[index].LimitMB:
+			e.Limits[index] = MemBufLimit{Variable: variable, LimitMB: limit, Weight: input.weight, Explanation: explanation}
+		}
+	}
+}
+
+// parseSizeMB parses a Fluent Bit size, e.g. 32k or 5MB, in megabytes, anything invalid is 0.
+func parseSizeMB(value string) float64 {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0
+	}
+
+	multiplier := 1.0
+	value = strings.TrimSuffix(value, "B")
+
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+
+	value = strings.TrimRight(value, "KMG")
+
+	size, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+
+	return size * multiplier / (1 << 20)
+}
@@ -0,0 +1,133 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestEstimateMemoryBufLimits(t *testing.T) {
+	t.Parallel()
+
+	config, err := common.ParseConfigFile("testdata/config/estimate/fluent-bit.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	weights, err := common.ParseMemBufLimitWeights("MBL_TEST_AUDIT=2, MBL_TEST_MEMCACHED=0.5")
+	if err != nil {
+		t.Fatalf("unable to parse weights: %v", err)
+	}
+
+	estimate := common.EstimateMemoryBufLimits(config, 1000, weights)
+
+	// 1MB tail buffer, 8MB Lua filter and 16 chunks of 2MB for filesystem storage
+	if estimate.OverheadMB != 41 || len(estimate.Overheads) != 3 {
+		t.Errorf("expected 41MB of overheads but got %gMB: %v", estimate.OverheadMB, estimate.Overheads)
+	}
+
+	// 0.5 + 2 + 2 for the forward input + 2 for the only output matching anything, the filesystem input has no share
+	if estimate.Shares != 6.5 {
+		t.Errorf("expected 6.5 shares but got %g", estimate.Shares)
+	}
+
+	// (1000 - 41) / floor(6.5 * 1.2) = 137MB per share
+	expected := map[string]int{"MBL_TEST_MEMCACHED": 68, "MBL_TEST_AUDIT": 274, "MBL_TEST_FORWARD": 274, "MBL_TEST_DEBUG": 137}
+	if len(estimate.Limits) != len(expected) {
+		t.Errorf("expected %d limits but got %+v", len(expected), estimate.Limits)
+	}
+
+	for _, limit := range estimate.Limits {
+		if limit.LimitMB != expected[limit.Variable] {
+			t.Errorf("%s: expected %dMB but got %dMB: %s", limit.Variable, expected[limit.Variable], limit.LimitMB, limit.Explanation)
+		}
+
+		if !strings.Contains(limit.Explanation, "137.00MB per share") {
+			t.Errorf("%s: explanation does not include the share: %s", limit.Variable, limit.Explanation)
+		}
+	}
+
+	if !strings.Contains(estimate.Limits[2].Explanation, "forward input weight 2") ||
+		!strings.Contains(estimate.Limits[3].Explanation, "filesystem storage") {
+		t.Errorf("explanations do not say why the weight is what it is: %+v", estimate.Limits)
+	}
+
+	for _, invalid := range []string{"MBL_TEST_AUDIT", "MBL_TEST_AUDIT=heavy", "MBL_TEST_AUDIT=0", "MBL_TEST_AUDIT=-1"} {
+		if _, err := common.ParseMemBufLimitWeights(invalid); !errors.Is(err, common.ErrInvalidMemBufLimitWeight) {
+			t.Errorf("%q: expected invalid weight error but got %v", invalid, err)
+		}
+	}
+}
+
+func TestEstimateMemoryBufLimitsMatchesFlatFormula(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("TEST_PARSER_STDOUT_MATCH", "*")
+	os.Setenv("TEST_PARSER_LOKI_MATCH", "no-match")
+
+	config, err := common.ParseConfigFile("testdata/config/fluent-bit.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	// Without any weights or overheads every input gets the same limit as before: 1000 / floor((2 + 2 * 1) * 1.2)
+	estimate := common.EstimateMemoryBufLimits(config, 1000, nil)
+	for _, limit := range estimate.Limits {
+		if limit.LimitMB != 250 {
+			t.Errorf("%s: expected 250MB but got %dMB: %s", limit.Variable, limit.LimitMB, limit.Explanation)
+		}
+	}
+
+	if len(estimate.Limits) != 2 {
+		t.Errorf("expected 2 limits but got %+v", estimate.Limits)
+	}
+}
+
+func TestCreateMemBufLimitConfig(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("TEST_PARSER_STDOUT_MATCH", "*")
+	os.Setenv("TEST_PARSER_LOKI_MATCH", "no-match")
+
+	// Both formats of the same configuration give the same result
+	for _, path := range []string{"testdata/config/fluent-bit.conf", "testdata/config/fluent-bit.yaml"} {
+		config, err := common.ParseConfigFile(path)
+		if err != nil {
+			t.Fatalf("unable to parse config: %v", err)
+		}
+
+		memBufConfig := common.CreateMemBufLimitConfig(config)
+
+		if memBufConfig.NumInputs != 2 {
+			t.Errorf("%s: expected 2 inputs but got %d", path, memBufConfig.NumInputs)
+		}
+
+		// Only stdout matches anything
+		if memBufConfig.NumOutputs != 1 {
+			t.Errorf("%s: expected 1 output but got %d", path, memBufConfig.NumOutputs)
+		}
+
+		if !slices.Equal(memBufConfig.MemBufLimitNames, []string{"MBL_TEST_INDEXER", "MBL_TEST_QUERY"}) {
+			t.Errorf("%s: unexpected memory buffer limits: %v", path, memBufConfig.MemBufLimitNames)
+		}
+	}
+}
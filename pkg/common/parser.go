@@ -18,210 +18,268 @@ package common
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strings"
 )
 
-type MembufLimitConfig struct {
-	NumInputs        int
-	NumOutputs       int
-	MemBufLimitNames []string
-}
+// Lines can be long, e.g. a Lua script inline, so allow more than the scanner default.
+const maxConfigLineLength = 1024 * 1024
 
-type ConfigFileParser struct {
-	ConfigFile *[]string
-	Inputs     [][]string
-	Outputs    [][]string
+// classicParser builds the nodes of a classic (INI-like) configuration a line at a time.
+type classicParser struct {
+	config   *ConfigFile
+	section  *Section
+	comments []*Comment
+	position Position
 }
 
-// Looks explicitly at ${UPPER_CASE} env vars
-// and extracts UPPER_CASE.
-func extractEnvVar(line string) string {
-	re := regexp.MustCompile(`\$\{([A-Z_]+)\}`) // check for env variables.
-	matches := re.FindAllStringSubmatch(line, -1)
+// ParseConfig parses a classic or YAML configuration, any includes are left unresolved.
+// YAML is detected from the file extension or, failing that, the contents.
+func ParseConfig(source io.Reader, path string) (*ConfigFile, error) {
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %q: %w", path, err)
+	}
 
-	if len(matches) > 0 && len(matches[0]) > 1 {
-		return matches[0][1]
+	if isYAMLConfig(path, data) {
+		return parseYAMLConfig(data, path)
 	}
 
-	return ""
+	return parseClassicConfig(bytes.NewReader(data), path)
 }
 
-// findNextPrefix returns the index of the line where the prefix first appears
-// -1 if it isn't found.
-func findNextPrefix(configFile *[]string, prefix string, searchFrom int) int {
-	length := len(*configFile)
-	for j := searchFrom; j < length; j++ {
-		nextLine := strings.ToUpper(strings.TrimSpace((*configFile)[j]))
-		if strings.HasPrefix(nextLine, prefix) {
-			return j
-		} else if strings.HasPrefix(nextLine, "[") {
-			return -1
+// isYAMLConfig returns true for .yaml and .yml files, for any other extension
+// it is YAML unless the first line that is not blank or a comment is a classic section or directive.
+func isYAMLConfig(path string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return true
+	case ".conf":
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
 		}
+
+		return !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "@") && strings.Contains(trimmed, ":")
 	}
 
-	return -1
+	return false
 }
 
-// since an input section might be for the audit logs but audit is disabled
-// or audit is enabled but there are no inputs for audit.
-func handleAuditInputs(startingIndex int, configFile *[]string) int {
-	if foundIndex := findNextPrefix(configFile, "PATH", startingIndex+1); foundIndex != -1 {
-		if strings.HasSuffix((*configFile)[foundIndex], "AUDIT.LOG") {
-			if GetAuditEnabled() {
-				return 1
-			}
+func parseClassicConfig(source io.Reader, path string) (*ConfigFile, error) {
+	parser := &classicParser{config: &ConfigFile{Path: path, Format: ConfigFormatClassic}, position: Position{File: path}}
+
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(nil, maxConfigLineLength)
+
+	for scanner.Scan() {
+		parser.position.Line++
 
-			return 0
+		if err := parser.parseLine(scanner.Text()); err != nil {
+			return nil, err
 		}
 	}
 
-	return 1
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %q: %w", path, err)
+	}
+
+	// Anything after the last entry is not part of it
+	parser.endComments()
+
+	return parser.config, nil
 }
 
-// CreateConfigFileParser returns a basic config parser.
-func CreateConfigFileParser(configFile *[]string) *ConfigFileParser {
-	parser := &ConfigFileParser{ConfigFile: configFile, Inputs: nil, Outputs: nil}
+func (p *classicParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, p.position, fmt.Sprintf(format, args...))
+}
 
-	return parser
+func (p *classicParser) parseLine(line string) error {
+	trimmed := strings.TrimSpace(line)
+
+	switch {
+	case trimmed == "":
+		return nil
+	case strings.HasPrefix(trimmed, "#"):
+		p.comments = append(p.comments, &Comment{Text: strings.TrimPrefix(trimmed, "#"), Position: p.position})
+
+		return nil
+	case strings.HasPrefix(trimmed, "@"):
+		return p.parseDirective(trimmed)
+	case strings.HasPrefix(trimmed, "["):
+		return p.parseHeader(trimmed)
+	default:
+		return p.parseEntry(trimmed)
+	}
 }
 
-// extractSection starts from `sectionStart` and returns a slice from
-// sectionStart to the end of file or the next section.
-func (p *ConfigFileParser) extractSection(sectionStart int) []string {
-	length := len(*p.ConfigFile)
+// parseDirective handles @include and @set, the directive itself is not case sensitive.
+func (p *classicParser) parseDirective(line string) error {
+	directive, argument, _ := strings.Cut(line, " ")
+	argument = strings.TrimSpace(argument)
 
-	var section []string
-	section = append(section, (*p.ConfigFile)[sectionStart])
-	i := sectionStart + 1
+	switch strings.ToLower(directive) {
+	case "@include":
+		if argument == "" {
+			return p.errorf("missing path for %s", directive)
+		}
 
-	for ; i < length; i++ {
-		nextLine := strings.ToUpper(strings.TrimSpace((*p.ConfigFile)[i]))
-		if strings.HasPrefix(nextLine, "[") {
-			break
+		// Includes can only contain whole sections so always end the current one
+		p.section = nil
+		p.add(&Include{Path: argument, Position: p.position})
+	case "@set":
+		key, value, found := strings.Cut(argument, "=")
+		if key = strings.TrimSpace(key); !found || key == "" {
+			return p.errorf("%s is not KEY=VALUE", directive)
 		}
 
-		section = append(section, nextLine)
+		p.add(&Set{Key: key, Value: strings.TrimSpace(value), Position: p.position})
+	default:
+		return p.errorf("unknown directive %q", directive)
 	}
 
-	return section
+	return nil
 }
 
-// BuildSection parses the config file into the parsers
-// Input and Output properties.
-func (p *ConfigFileParser) BuildSections() *ConfigFileParser {
-	for i := range *p.ConfigFile {
-		line := strings.ToUpper(strings.TrimSpace((*p.ConfigFile)[i]))
-		switch line {
-		case "[INPUT]":
-			p.Inputs = append(p.Inputs, p.extractSection(i))
-		case "[OUTPUT]":
-			p.Outputs = append(p.Outputs, p.extractSection(i))
-		}
+func (p *classicParser) parseHeader(line string) error {
+	if !strings.HasSuffix(line, "]") {
+		return p.errorf("unterminated section header %q", line)
 	}
 
-	return p
-}
+	header := strings.TrimSpace(line[1 : len(line)-1])
 
-// CreateMemBufLimitConfig takes a built configfile and returns
-// all mememory buffer limit environment variables and
-// total number of enabled inputs and outputs.
-func CreateMemBufLimitConfig(configFile *[]string) *MembufLimitConfig {
-	config := &MembufLimitConfig{NumOutputs: 0, NumInputs: 0, MemBufLimitNames: nil}
-	parser := CreateConfigFileParser(configFile).BuildSections()
-	outputCount := 0
-	inputCount := 0
+	sectionType := strings.ToUpper(header)
+	if !slices.Contains(sectionTypes, sectionType) {
+		return p.errorf("unknown section type %q", header)
+	}
 
-	for j, inputSection := range parser.Inputs { // for each inputs check
-		for i := range inputSection {
-			inputCount += handleAuditInputs(i, &parser.Inputs[j])
+	p.section = &Section{Type: sectionType, Header: header, Position: p.position}
+	p.add(p.section)
 
-			if foundIndex := findNextPrefix(&parser.Inputs[j], "MEM_BUF_LIMIT", i+1); foundIndex != -1 {
-				envVar := extractEnvVar(inputSection[foundIndex])
-				config.MemBufLimitNames = append(config.MemBufLimitNames, envVar)
+	return nil
+}
 
-				break
-			}
-		}
+func (p *classicParser) parseEntry(line string) error {
+	if p.section == nil {
+		return p.errorf("%q is not in a section", line)
 	}
 
-	for j, outputSection := range parser.Outputs {
-		for i := range outputSection {
-			if foundIndex := findNextPrefix(&parser.Outputs[j], "MATCH", i+1); foundIndex != -1 {
-				if envValue := os.Getenv(extractEnvVar(outputSection[foundIndex])); envValue != "" && envValue != "no-match" {
-					outputCount++
+	key, value, found := strings.Cut(line, " ")
+	if tab := strings.IndexByte(key, '\t'); tab != -1 {
+		key, value, found = line[:tab], line[tab+1:], true
+	}
 
-					break
-				}
-			}
-		}
+	if value = strings.TrimSpace(value); !found || value == "" {
+		return p.errorf("missing value for key %q", key)
 	}
 
-	config.NumInputs = inputCount
-	config.NumOutputs = outputCount
+	p.section.Entries = append(p.section.Entries, &Entry{Key: key, Value: value, Comments: p.comments, Position: p.position})
+	p.comments = nil
 
-	return config
+	return nil
 }
 
-// handleIncludeFilePaths takes the directory of the initial config file
-// and the file path of file which needs to be imported
-// to build a final path.
-func handleIncludeFilePaths(baseDir, includeFilePath string) string {
-	// swap any env variables for their real path
-	if configDirEnvVar := extractEnvVar(includeFilePath); configDirEnvVar != "" {
-		if filePath := os.Getenv(configDirEnvVar); filePath != "" {
-			includeFilePath = strings.Replace(includeFilePath, fmt.Sprintf("${%s}", configDirEnvVar), filePath, 1)
-		}
-	}
+// add appends a top level node, any comments before it stay where they were.
+func (p *classicParser) add(node Node) {
+	p.endComments()
+	p.config.Nodes = append(p.config.Nodes, node)
+}
 
-	// is absolute file so just return it
-	if strings.HasPrefix(includeFilePath, "/") {
-		return includeFilePath
+func (p *classicParser) endComments() {
+	for _, comment := range p.comments {
+		p.config.Nodes = append(p.config.Nodes, comment)
 	}
 
-	// build absolute path
-	dir := filepath.Dir(baseDir)
+	p.comments = nil
+}
 
-	return filepath.Join(dir, includeFilePath)
+// ParseConfigFile parses a configuration file and everything it includes.
+// Includes can be glob patterns, the matching files are included in lexical order.
+// An include that matches nothing is skipped with a warning, an include cycle is an error.
+// Variables in includes are expanded using the environment and anything @set before them, as Fluent Bit does.
+func ParseConfigFile(path string) (*ConfigFile, error) {
+	return parseConfigFile(path, nil, newVariableResolver())
 }
 
-// BuildConfigFile starts with a root config and follows @includes
-// to build a complete config.
-func BuildConfigFile(filepath string) (*[]string, error) {
-	file, err := os.Open(filepath)
+// parseConfigFile parses the file and its includes, chain is the files that included it in order.
+func parseConfigFile(path string, chain []string, resolver *VariableResolver) (*ConfigFile, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		absolute = filepath.Clean(path)
+	}
+
+	if slices.Contains(chain, absolute) {
+		return nil, fmt.Errorf("%w: %s", ErrIncludeCycle, strings.Join(append(chain, absolute), " -> "))
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %w", err)
 	}
 
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	config, err := ParseConfig(file, path)
+	if err != nil {
+		return nil, err
+	}
 
-	var completeConfig []string
+	chain = append(slices.Clip(chain), absolute)
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	for _, node := range config.Nodes {
+		switch node := node.(type) {
+		case *Set:
+			resolver.Set(node.Key, node.Value)
+		case *Include:
+			if err := resolveInclude(node, path, chain, resolver); err != nil {
+				return nil, fmt.Errorf("unable to include from %s: %w", node.Position, err)
+			}
+		}
+	}
 
-		switch {
-		case strings.HasPrefix(line, "@include "):
-			includeFilePath := strings.TrimPrefix(line, "@include ")
-			includeFilePath = handleIncludeFilePaths(filepath, includeFilePath)
-			newLines, err := BuildConfigFile(includeFilePath)
+	return config, nil
+}
 
-			if err != nil {
-				return nil, err
-			}
+// resolveInclude parses every file the include matches, directories are ignored.
+func resolveInclude(include *Include, path string, chain []string, resolver *VariableResolver) error {
+	pattern := resolver.Expand(include.Path)
+	if !filepath.IsAbs(pattern) {
+		// Relative to the file including it
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("%w: %s: invalid include pattern %q", ErrInvalidConfig, include.Position, include.Path)
+	}
 
-			completeConfig = append(completeConfig, *newLines...)
-		case strings.HasPrefix(line, "#"):
+	include.Files = nil
+
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || info.IsDir() {
 			continue
-		default:
-			completeConfig = append(completeConfig, line)
 		}
+
+		included, err := parseConfigFile(match, chain, resolver)
+		if err != nil {
+			return err
+		}
+
+		include.Files = append(include.Files, included)
+	}
+
+	if len(include.Files) == 0 {
+		log.Warnw("Nothing found to include so skipping it", "include", include.Path, "pattern", pattern, "position", include.Position.String())
 	}
 
-	return &completeConfig, nil
+	return nil
 }
@@ -0,0 +1,224 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	t.Parallel()
+
+	config, err := common.ParseConfigFile("testdata/config/fluent-bit.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	sections := config.Sections()
+	if len(sections) != 6 {
+		t.Fatalf("expected 6 sections but got %d", len(sections))
+	}
+
+	service := sections[0]
+	if service.Type != common.SectionService || service.Get("log_level") != "${LOG_LEVEL}" {
+		t.Errorf("unexpected service section: %+v", service)
+	}
+
+	if service.Entries[1].Key != "Log_Level" {
+		t.Errorf("key case not kept: %q", service.Entries[1].Key)
+	}
+
+	inputs := config.Inputs()
+	if len(inputs) != 2 {
+		t.Fatalf("expected 2 inputs but got %d", len(inputs))
+	}
+
+	// Headers and keys are not case sensitive, tabs separate them as well as spaces
+	if inputs[1].Header != "Input" || inputs[1].Get("Mem_Buf_Limit") != "${MBL_TEST_QUERY}" || inputs[1].Name() != "tail" {
+		t.Errorf("unexpected second input: %+v", inputs[1])
+	}
+
+	path := inputs[0].Entry("Path")
+	if path.Position.String() != "testdata/config/inputs.conf:4" {
+		t.Errorf("unexpected position %q", path.Position)
+	}
+
+	if len(path.Comments) != 1 || path.Comments[0].Text != " Only the indexer log" {
+		t.Errorf("comment not attached to entry: %+v", path.Comments)
+	}
+
+	if len(config.Outputs()) != 3 {
+		t.Errorf("expected 3 outputs but got %d", len(config.Outputs()))
+	}
+
+	variables := config.Variables()
+	if len(variables) != 1 || variables[0].Key != "LOG_LEVEL" || variables[0].Value != "info" {
+		t.Errorf("unexpected variables: %+v", variables)
+	}
+
+	comment, ok := config.Nodes[0].(*common.Comment)
+	if !ok || comment.Text != " Top level comment" || comment.Position.Line != 1 {
+		t.Errorf("unexpected first node: %+v", config.Nodes[0])
+	}
+}
+
+func TestParseConfigFileIncludes(t *testing.T) {
+	t.Parallel()
+
+	// Globs are expanded in order and anything missing is skipped
+	config, err := common.ParseConfigFile("testdata/config/glob/fluent-bit.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	var tags []string
+	for _, input := range config.Inputs() {
+		tags = append(tags, input.Get("Tag"))
+	}
+
+	if !slices.Equal(tags, []string{"a", "b"}) {
+		t.Errorf("unexpected inputs: %v", tags)
+	}
+
+	_, err = common.ParseConfigFile("testdata/config/cycle/a.conf")
+	if !errors.Is(err, common.ErrIncludeCycle) {
+		t.Fatalf("expected an include cycle error but got %v", err)
+	}
+
+	// The chain shows how the cycle happened
+	if !strings.Contains(err.Error(), "a.conf -> ") || !strings.HasSuffix(err.Error(), "b.conf -> "+mustAbs(t, "testdata/config/cycle/a.conf")) {
+		t.Errorf("error does not include the chain: %v", err)
+	}
+}
+
+func mustAbs(t *testing.T, path string) string {
+	t.Helper()
+
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatalf("unable to get absolute path: %v", err)
+	}
+
+	return absolute
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"entry outside section": "Name tail\n",
+		"unknown section":       "[INPUTS]\n    Name tail\n",
+		"unterminated header":   "[INPUT\n",
+		"missing value":         "[INPUT]\n    Name\n",
+		"unknown directive":     "@import other.conf\n",
+		"invalid set":           "@set NOVALUE\n",
+		"missing include":       "@include\n",
+	}
+
+	for name, contents := range tests {
+		_, err := common.ParseConfig(strings.NewReader(contents), "test.conf")
+		if !errors.Is(err, common.ErrInvalidConfig) {
+			t.Errorf("%s: expected invalid config error but got %v", name, err)
+		} else if !strings.Contains(err.Error(), "test.conf:") {
+			t.Errorf("%s: error does not include the position: %v", name, err)
+		}
+	}
+}
+
+func TestParseYAMLConfigFile(t *testing.T) {
+	t.Parallel()
+
+	config, err := common.ParseConfigFile("testdata/config/fluent-bit.yaml")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	if config.Format != common.ConfigFormatYAML {
+		t.Errorf("expected YAML but got %q", config.Format)
+	}
+
+	variables := config.Variables()
+	if len(variables) != 1 || variables[0].Key != "LOG_LEVEL" || variables[0].Value != "info" {
+		t.Errorf("unexpected variables: %+v", variables)
+	}
+
+	service := config.SectionsOf(common.SectionService)
+	if len(service) != 1 || service[0].Get("Log_Level") != "${LOG_LEVEL}" || service[0].Entry("log_level").Position.Line != 8 {
+		t.Fatalf("unexpected service: %+v", service)
+	}
+
+	if comments := service[0].Entry("log_level").Comments; len(comments) != 1 || comments[0].Text != " Set above" {
+		t.Errorf("comment not attached to entry: %+v", comments)
+	}
+
+	// The classic format outputs are included from the YAML
+	if len(config.Outputs()) != 3 {
+		t.Errorf("expected 3 outputs but got %d", len(config.Outputs()))
+	}
+
+	inputs := config.Inputs()
+	if len(inputs) != 2 || inputs[0].Get("Path") != "${COUCHBASE_LOGS}/indexer.log" {
+		t.Fatalf("unexpected inputs: %+v", inputs)
+	}
+
+	if processors := inputs[1].Get("processors"); processors != "{logs: [{name: content_modifier, action: insert}]}" {
+		t.Errorf("unexpected processors: %q", processors)
+	}
+
+	filter := config.SectionsOf(common.SectionFilter)[0]
+	if len(filter.Entries) != 4 || filter.Entries[3].Key != "add" || filter.Entries[3].Value != "logshipper fluentbit-sidecar" {
+		t.Errorf("lists are not repeated keys: %+v", filter.Entries)
+	}
+
+	rule := config.SectionsOf(common.SectionMultilineParser)[0].Get("rule")
+	if rule != `"start_state" "/^\d{4}-\d{2}-\d{2}/" "cont"` {
+		t.Errorf("unexpected multiline rule: %q", rule)
+	}
+}
+
+func TestParseConfigDetectsFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]string{
+		"no-extension-classic": "# comment\n[INPUT]\n    Name dummy\n",
+		"no-extension-yaml":    "# comment\npipeline:\n  inputs:\n    - name: dummy\n",
+		"config.yml":           "pipeline:\n  inputs:\n    - name: dummy\n",
+	}
+
+	for path, contents := range tests {
+		config, err := common.ParseConfig(strings.NewReader(contents), path)
+		if err != nil {
+			t.Errorf("%s: unable to parse: %v", path, err)
+
+			continue
+		}
+
+		if len(config.Inputs()) != 1 || config.Inputs()[0].Name() != "dummy" {
+			t.Errorf("%s: unexpected inputs %+v", path, config.Inputs())
+		}
+	}
+
+	_, err := common.ParseConfig(strings.NewReader("pipeline:\n  unknown: []\n"), "bad.yaml")
+	if !errors.Is(err, common.ErrInvalidConfig) || !strings.Contains(err.Error(), "bad.yaml:2") {
+		t.Errorf("expected invalid config error with position but got %v", err)
+	}
+}
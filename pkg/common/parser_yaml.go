@@ -0,0 +1,385 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlSections maps the YAML keys holding a list of sections to their section type.
+var yamlSections = map[string]string{
+	"parsers":           SectionParser,
+	"multiline_parsers": SectionMultilineParser,
+	"customs":           SectionCustom,
+	"inputs":            SectionInput,
+	"filters":           SectionFilter,
+	"outputs":           SectionOutput,
+}
+
+// yamlParser converts a YAML configuration into the same nodes as the equivalent classic configuration:
+// env variables are @set directives, includes are @include directives and each plugin is a section.
+type yamlParser struct {
+	config *ConfigFile
+}
+
+func parseYAMLConfig(data []byte, path string) (*ConfigFile, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, path, err)
+	}
+
+	parser := &yamlParser{config: &ConfigFile{Path: path, Format: ConfigFormatYAML}}
+
+	// An empty file has no content at all
+	if len(document.Content) == 0 {
+		return parser.config, nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, parser.errorf(root, "the top level must be a mapping")
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if err := parser.parseTopLevel(root.Content[i], root.Content[i+1], nil); err != nil {
+			return nil, err
+		}
+
+		// Comments at the end of the file are kept with the last key
+		parser.addComments(parser.footComments(root.Content[i]))
+	}
+
+	parser.addComments(parser.footComments(root))
+	parser.addComments(parser.footComments(&document))
+
+	return parser.config, nil
+}
+
+func (p *yamlParser) errorf(node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, p.position(node), fmt.Sprintf(format, args...))
+}
+
+func (p *yamlParser) position(node *yaml.Node) Position {
+	return Position{File: p.config.Path, Line: node.Line}
+}
+
+// comments converts the comments above a node, yaml keeps them as a single string including the #.
+func (p *yamlParser) comments(node *yaml.Node) []*Comment {
+	var comments []*Comment
+
+	if node.HeadComment == "" {
+		return nil
+	}
+
+	lines := strings.Split(node.HeadComment, "\n")
+	for i, line := range lines {
+		// Only the line of the node is known so count back from it
+		position := Position{File: p.config.Path, Line: node.Line - len(lines) + i}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		comments = append(comments, &Comment{Text: strings.TrimPrefix(strings.TrimSpace(line), "#"), Position: position})
+	}
+
+	return comments
+}
+
+// footComments converts the comments after a node, only the line of the node is known so they are all on it.
+func (p *yamlParser) footComments(node *yaml.Node) []*Comment {
+	var comments []*Comment
+
+	for _, line := range strings.Split(node.FootComment, "\n") {
+		if strings.TrimSpace(line) != "" {
+			comments = append(comments, &Comment{Text: strings.TrimPrefix(strings.TrimSpace(line), "#"), Position: p.position(node)})
+		}
+	}
+
+	return comments
+}
+
+func (p *yamlParser) addComments(comments []*Comment) {
+	for _, comment := range comments {
+		p.config.Nodes = append(p.config.Nodes, comment)
+	}
+}
+
+func (p *yamlParser) add(node Node, comments []*Comment) {
+	p.addComments(comments)
+	p.config.Nodes = append(p.config.Nodes, node)
+}
+
+// parseTopLevel parses a top level key, the leading comments are those of the key it is in, i.e. the pipeline.
+func (p *yamlParser) parseTopLevel(key, value *yaml.Node, leading []*Comment) error {
+	comments := append(leading, p.comments(key)...)
+
+	switch name := strings.ToLower(key.Value); name {
+	case "env":
+		return p.parseEnv(value, comments)
+	case "includes":
+		return p.parseIncludes(value, comments)
+	case "service":
+		section, err := p.parseSection(SectionService, value)
+		if err != nil {
+			return err
+		}
+
+		p.add(section, comments)
+	case "pipeline":
+		if value.Kind != yaml.MappingNode {
+			return p.errorf(value, "pipeline must be a mapping")
+		}
+
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			if err := p.parseTopLevel(value.Content[i], value.Content[i+1], comments); err != nil {
+				return err
+			}
+
+			comments = nil
+		}
+	case "plugins":
+		return p.parsePlugins(value, comments)
+	case "upstream_servers":
+		return p.parseSections(SectionUpstream, value, comments)
+	default:
+		if sectionType, found := yamlSections[name]; found {
+			return p.parseSections(sectionType, value, comments)
+		}
+
+		return p.errorf(key, "unknown key %q", key.Value)
+	}
+
+	return nil
+}
+
+func (p *yamlParser) parseEnv(value *yaml.Node, comments []*Comment) error {
+	if value.Kind != yaml.MappingNode {
+		return p.errorf(value, "env must be a mapping")
+	}
+
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, variable := value.Content[i], value.Content[i+1]
+		if variable.Kind != yaml.ScalarNode {
+			return p.errorf(variable, "env %q must be a scalar", key.Value)
+		}
+
+		p.add(&Set{Key: key.Value, Value: variable.Value, Position: p.position(key)}, append(comments, p.comments(key)...))
+		comments = nil
+	}
+
+	return nil
+}
+
+func (p *yamlParser) parseIncludes(value *yaml.Node, comments []*Comment) error {
+	if value.Kind != yaml.SequenceNode {
+		return p.errorf(value, "includes must be a list")
+	}
+
+	for _, include := range value.Content {
+		if include.Kind != yaml.ScalarNode || include.Value == "" {
+			return p.errorf(include, "includes must be a list of paths")
+		}
+
+		p.add(&Include{Path: include.Value, Position: p.position(include)}, append(comments, p.comments(include)...))
+		comments = nil
+	}
+
+	return nil
+}
+
+// parsePlugins converts the list of plugin paths into a PLUGINS section.
+func (p *yamlParser) parsePlugins(value *yaml.Node, comments []*Comment) error {
+	if value.Kind != yaml.SequenceNode {
+		return p.errorf(value, "plugins must be a list")
+	}
+
+	section := &Section{Type: SectionPlugins, Header: SectionPlugins, Position: p.position(value)}
+
+	for _, path := range value.Content {
+		if path.Kind != yaml.ScalarNode {
+			return p.errorf(path, "plugins must be a list of paths")
+		}
+
+		section.Entries = append(section.Entries, &Entry{Key: "Path", Value: path.Value, Comments: p.comments(path), Position: p.position(path)})
+	}
+
+	p.add(section, comments)
+
+	return nil
+}
+
+// parseSections converts a list of plugins, each is a section of the type.
+// Upstream servers are followed by a NODE section for each of their nodes, as in the classic format.
+func (p *yamlParser) parseSections(sectionType string, value *yaml.Node, comments []*Comment) error {
+	if value.Kind != yaml.SequenceNode {
+		return p.errorf(value, "%s must be a list", strings.ToLower(sectionType))
+	}
+
+	for _, item := range value.Content {
+		section, err := p.parseSection(sectionType, item)
+		if err != nil {
+			return err
+		}
+
+		p.add(section, append(comments, p.comments(item)...))
+		comments = nil
+
+		if sectionType != SectionUpstream {
+			continue
+		}
+
+		if err := p.parseSections(SectionNode, p.removeEntries(section, item, "nodes"), nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeEntries removes the entries for the key from the section and returns its value, an empty list if there is none.
+func (p *yamlParser) removeEntries(section *Section, item *yaml.Node, key string) *yaml.Node {
+	var kept []*Entry
+
+	for _, entry := range section.Entries {
+		if !strings.EqualFold(entry.Key, key) {
+			kept = append(kept, entry)
+		}
+	}
+
+	section.Entries = kept
+
+	for i := 0; i+1 < len(item.Content); i += 2 {
+		if strings.EqualFold(item.Content[i].Value, key) {
+			return item.Content[i+1]
+		}
+	}
+
+	return &yaml.Node{Kind: yaml.SequenceNode}
+}
+
+// parseSection converts a mapping into a section, lists of scalars are repeated keys as that is how they are written in the classic format.
+func (p *yamlParser) parseSection(sectionType string, value *yaml.Node) (*Section, error) {
+	if value.Kind != yaml.MappingNode {
+		return nil, p.errorf(value, "%s must be a mapping", strings.ToLower(sectionType))
+	}
+
+	section := &Section{Type: sectionType, Header: sectionType, Position: p.position(value)}
+
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key, property := value.Content[i], value.Content[i+1]
+		if key.Kind != yaml.ScalarNode {
+			return nil, p.errorf(key, "keys must be scalars")
+		}
+
+		values, err := p.entryValues(sectionType, key, property)
+		if err != nil {
+			return nil, err
+		}
+
+		// Each rule is its own entry in the classic format
+		name := key.Value
+		if sectionType == SectionMultilineParser && strings.EqualFold(name, "rules") {
+			name = "rule"
+		}
+
+		structured := property.Kind == yaml.MappingNode || (property.Kind == yaml.SequenceNode && !allScalars(property.Content) && name != "rule")
+		comments := p.comments(key)
+
+		for _, entryValue := range values {
+			section.Entries = append(section.Entries, &Entry{
+				Key: name, Value: entryValue, Structured: structured, Comments: comments, Position: p.position(key),
+			})
+			comments = nil
+		}
+	}
+
+	return section, nil
+}
+
+// entryValues returns the values of a property, anything that cannot be expressed in the classic format, e.g. processors, is kept as flow style YAML.
+func (p *yamlParser) entryValues(sectionType string, key, property *yaml.Node) ([]string, error) {
+	if property.Kind == yaml.ScalarNode {
+		return []string{property.Value}, nil
+	}
+
+	if sectionType == SectionMultilineParser && strings.EqualFold(key.Value, "rules") && property.Kind == yaml.SequenceNode {
+		return p.multilineRules(property)
+	}
+
+	if property.Kind == yaml.SequenceNode && allScalars(property.Content) {
+		var values []string
+		for _, item := range property.Content {
+			values = append(values, item.Value)
+		}
+
+		return values, nil
+	}
+
+	setFlowStyle(property)
+
+	encoded, err := yaml.Marshal(property)
+	if err != nil {
+		return nil, p.errorf(property, "unable to encode %q: %v", key.Value, err)
+	}
+
+	return []string{strings.TrimSpace(string(encoded))}, nil
+}
+
+// multilineRules converts each rule into the classic format, i.e. "state" "regex" "next state".
+func (p *yamlParser) multilineRules(rules *yaml.Node) ([]string, error) {
+	var values []string
+
+	for _, rule := range rules.Content {
+		var parsed struct {
+			State     string `yaml:"state"`
+			Regex     string `yaml:"regex"`
+			NextState string `yaml:"next_state"`
+		}
+
+		if err := rule.Decode(&parsed); err != nil || parsed.State == "" || parsed.Regex == "" {
+			return nil, p.errorf(rule, "multiline parser rules must have a state, regex and next_state")
+		}
+
+		// Fluent Bit does not unescape them so neither can we escape them
+		values = append(values, `"`+parsed.State+`" "`+parsed.Regex+`" "`+parsed.NextState+`"`)
+	}
+
+	return values, nil
+}
+
+func allScalars(nodes []*yaml.Node) bool {
+	for _, node := range nodes {
+		if node.Kind != yaml.ScalarNode {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setFlowStyle writes the node on a single line.
+func setFlowStyle(node *yaml.Node) {
+	node.Style |= yaml.FlowStyle
+	node.HeadComment, node.LineComment, node.FootComment = "", "", ""
+
+	for _, child := range node.Content {
+		setFlowStyle(child)
+	}
+}
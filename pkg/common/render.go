@@ -0,0 +1,526 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUnknownConfigFormat indicates a configuration format other than classic or YAML.
+var ErrUnknownConfigFormat = errors.New("unknown config format")
+
+// A multiline parser rule is the state, regex and next state.
+const multilineRuleParts = 3
+
+// The order of the top level YAML keys of the effective configuration, the pipeline is always last.
+var yamlKeyOrder = []string{"env", "includes", "service", "parsers", "multiline_parsers", "plugins", "upstream_servers", "customs", "pipeline"}
+
+// RenderOptions control how a configuration is rendered.
+type RenderOptions struct {
+	// Format is either ConfigFormatClassic or ConfigFormatYAML.
+	Format string
+	// Annotate adds the file and line each line is from as a comment at the end of it.
+	// Fluent Bit does not support comments at the end of a line in the classic format so this is only for reading.
+	Annotate bool
+	// Resolver expands the variables in every value, nil leaves them as is.
+	Resolver *VariableResolver
+	// comments writes the comments of the nodes and entries, only WriteConfig keeps them.
+	comments bool
+}
+
+func (o RenderOptions) value(entry *Entry) string {
+	if o.Resolver == nil {
+		return entry.Value
+	}
+
+	return o.Resolver.Expand(entry.Value)
+}
+
+// RenderConfig writes the effective configuration, i.e. every section of the config and its includes in order.
+// Comments and directives are left out as they have already been applied.
+func RenderConfig(out io.Writer, config *ConfigFile, options RenderOptions) error {
+	var nodes []Node
+	for _, section := range config.Sections() {
+		nodes = append(nodes, section)
+	}
+
+	switch options.Format {
+	case ConfigFormatClassic, "":
+		return renderClassic(out, nodes, options)
+	case ConfigFormatYAML:
+		return renderYAML(out, nodes, yamlKeyOrder, options)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownConfigFormat, options.Format)
+	}
+}
+
+func renderClassic(out io.Writer, nodes []Node, options RenderOptions) error {
+	writer := bufio.NewWriter(out)
+
+	for i, node := range nodes {
+		// Sections are separated from whatever follows them
+		if _, ok := nodes[max(i-1, 0)].(*Section); ok && i > 0 {
+			_, _ = writer.WriteString("\n")
+		}
+
+		switch node := node.(type) {
+		case *Comment:
+			writeAnnotated(writer, "#"+node.Text, node.Position, options.Annotate)
+		case *Set:
+			writeAnnotated(writer, "@set "+node.Key+"="+node.Value, node.Position, options.Annotate)
+		case *Include:
+			writeAnnotated(writer, "@include "+node.Path, node.Position, options.Annotate)
+		case *Section:
+			renderClassicSection(writer, node, options)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("unable to write config: %w", err)
+	}
+
+	return nil
+}
+
+func renderClassicSection(writer *bufio.Writer, section *Section, options RenderOptions) {
+	writeAnnotated(writer, "["+section.Header+"]", section.Position, options.Annotate)
+
+	// Line up the values as they are in our own configuration files
+	width := 0
+	for _, entry := range section.Entries {
+		width = max(width, len(entry.Key))
+	}
+
+	for _, entry := range section.Entries {
+		if options.comments {
+			for _, comment := range entry.Comments {
+				writeAnnotated(writer, "    #"+comment.Text, comment.Position, options.Annotate)
+			}
+		}
+
+		writeAnnotated(writer, fmt.Sprintf("    %-*s %s", width, entry.Key, options.value(entry)), entry.Position, options.Annotate)
+	}
+}
+
+func writeAnnotated(writer *bufio.Writer, line string, position Position, annotate bool) {
+	if annotate {
+		line += "  # " + position.String()
+	}
+
+	_, _ = writer.WriteString(line + "\n")
+}
+
+// yamlWriter builds the YAML document for the nodes, sections are added to the list for their type.
+type yamlWriter struct {
+	options  RenderOptions
+	keys     map[string]*yaml.Node
+	pipeline map[string]*yaml.Node
+	upstream *yaml.Node
+	// order is the order the top level keys were first used in.
+	order []string
+	// keyComments are the comments to write above a top level key.
+	keyComments map[string]string
+	// comments are the ones before the next node.
+	comments []*Comment
+}
+
+// renderYAML writes the nodes as a single YAML document, the top level keys are in the order given followed by any others in the order they are used.
+func renderYAML(out io.Writer, nodes []Node, order []string, options RenderOptions) error {
+	w := &yamlWriter{options: options, keys: map[string]*yaml.Node{}, pipeline: map[string]*yaml.Node{}, keyComments: map[string]string{}}
+
+	for _, node := range nodes {
+		if err := w.add(node); err != nil {
+			return err
+		}
+	}
+
+	w.keys["pipeline"] = orderedMapping(w.pipeline, []string{"inputs", "filters", "outputs"})
+
+	order = slices.Clone(order)
+	for _, key := range w.order {
+		if !slices.Contains(order, key) {
+			order = append(order, key)
+		}
+	}
+
+	root := orderedMapping(w.keys, order)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		root.Content[i].HeadComment = w.keyComments[root.Content[i].Value]
+	}
+
+	// Anything after the last node
+	root.FootComment = yamlComment(w.comments)
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(root); err != nil {
+		return fmt.Errorf("unable to write config: %w", err)
+	}
+
+	return encoder.Close()
+}
+
+func (w *yamlWriter) add(node Node) error {
+	switch node := node.(type) {
+	case *Comment:
+		if w.options.comments {
+			w.comments = append(w.comments, node)
+		}
+	case *Set:
+		env := w.keyChild("env", yaml.MappingNode)
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: node.Key, HeadComment: w.takeComments()}
+		env.Content = append(env.Content, key, annotatedScalar(node.Value, node.Position, w.options.Annotate))
+	case *Include:
+		includes := w.keyChild("includes", yaml.SequenceNode)
+		include := annotatedScalar(node.Path, node.Position, w.options.Annotate)
+		include.HeadComment = w.takeComments()
+		includes.Content = append(includes.Content, include)
+	case *Section:
+		return w.addSection(node)
+	}
+
+	return nil
+}
+
+// child returns the top level node for the key, creating it if required.
+func (w *yamlWriter) child(key string, kind yaml.Kind) *yaml.Node {
+	if !slices.Contains(w.order, key) {
+		w.order = append(w.order, key)
+	}
+
+	return yamlChild(w.keys, key, kind)
+}
+
+// keyChild returns the top level node for the key, if it is created the comments before the node being added are on the key.
+func (w *yamlWriter) keyChild(key string, kind yaml.Kind) *yaml.Node {
+	if w.keys[key] == nil {
+		w.keyComments[key] = w.takeComments()
+	}
+
+	return w.child(key, kind)
+}
+
+// takeComments returns the comments before the node being added as a YAML comment.
+func (w *yamlWriter) takeComments() string {
+	comment := yamlComment(w.comments)
+	w.comments = nil
+
+	return comment
+}
+
+func (w *yamlWriter) addSection(section *Section) error {
+	switch section.Type {
+	case SectionService:
+		service := w.keyChild("service", yaml.MappingNode)
+
+		mapping, err := w.sectionMapping(section)
+		if err != nil {
+			return err
+		}
+
+		// There should only be one but Fluent Bit merges them if not, the comments of any others are on their first key
+		if len(mapping.Content) > 0 {
+			mapping.Content[0].HeadComment = joinComments(w.takeComments(), mapping.Content[0].HeadComment)
+		}
+
+		service.Content = append(service.Content, mapping.Content...)
+	case SectionPlugins:
+		plugins := w.keyChild("plugins", yaml.SequenceNode)
+		for _, entry := range section.Entries {
+			plugin := annotatedScalar(w.options.value(entry), entry.Position, w.options.Annotate)
+			plugin.HeadComment = w.entryComments(entry)
+			plugins.Content = append(plugins.Content, plugin)
+		}
+	case SectionNode:
+		if w.upstream == nil {
+			return fmt.Errorf("%w: %s: node is not in an upstream", ErrInvalidConfig, section.Position)
+		}
+
+		return w.appendSection(upstreamNodes(w.upstream), section)
+	case SectionInput, SectionFilter, SectionOutput:
+		// The pipeline is only a mapping of the lists so is created at the end, its place is kept
+		if !slices.Contains(w.order, "pipeline") {
+			w.order = append(w.order, "pipeline")
+		}
+
+		return w.appendSection(yamlChild(w.pipeline, yamlKey(section.Type), yaml.SequenceNode), section)
+	default:
+		list := w.child(yamlKey(section.Type), yaml.SequenceNode)
+		if err := w.appendSection(list, section); err != nil {
+			return err
+		}
+
+		if section.Type == SectionUpstream {
+			w.upstream = list.Content[len(list.Content)-1]
+		}
+	}
+
+	return nil
+}
+
+// entryComments returns the comments of the entry if they are being kept.
+func (w *yamlWriter) entryComments(entry *Entry) string {
+	if !w.options.comments {
+		return ""
+	}
+
+	return yamlComment(entry.Comments)
+}
+
+// yamlComment joins the comments into one, yaml keeps them as a single string including the #.
+func yamlComment(comments []*Comment) string {
+	lines := make([]string, 0, len(comments))
+	for _, comment := range comments {
+		lines = append(lines, "#"+comment.Text)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// yamlKey returns the YAML key for a list of sections of the type.
+func yamlKey(sectionType string) string {
+	if sectionType == SectionUpstream {
+		return "upstream_servers"
+	}
+
+	for key, keyType := range yamlSections {
+		if keyType == sectionType {
+			return key
+		}
+	}
+
+	return strings.ToLower(sectionType)
+}
+
+// yamlChild returns the node for the key, creating it if required.
+func yamlChild(children map[string]*yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	if children[key] == nil {
+		children[key] = &yaml.Node{Kind: kind}
+	}
+
+	return children[key]
+}
+
+// upstreamNodes returns the list of nodes of an upstream server, adding it if required.
+func upstreamNodes(upstream *yaml.Node) *yaml.Node {
+	for i := 0; i+1 < len(upstream.Content); i += 2 {
+		if upstream.Content[i].Value == "nodes" {
+			return upstream.Content[i+1]
+		}
+	}
+
+	nodes := &yaml.Node{Kind: yaml.SequenceNode}
+	upstream.Content = append(upstream.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "nodes"}, nodes)
+
+	return nodes
+}
+
+// orderedMapping creates a mapping of the keys that are set in order.
+func orderedMapping(children map[string]*yaml.Node, order []string) *yaml.Node {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, key := range order {
+		if child := children[key]; child != nil && len(child.Content) > 0 {
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+		}
+	}
+
+	return mapping
+}
+
+func (w *yamlWriter) appendSection(list *yaml.Node, section *Section) error {
+	mapping, err := w.sectionMapping(section)
+	if err != nil {
+		return err
+	}
+
+	// The first key of a list item is on the same line as the item so its comments are the item's
+	if len(mapping.Content) > 0 {
+		mapping.HeadComment = joinComments(w.takeComments(), mapping.Content[0].HeadComment, mapping.HeadComment)
+		mapping.Content[0].HeadComment = ""
+	}
+
+	list.Content = append(list.Content, mapping)
+
+	return nil
+}
+
+// sectionMapping converts the entries of a section to a mapping, repeated keys become a list.
+func (w *yamlWriter) sectionMapping(section *Section) (*yaml.Node, error) {
+	// In YAML the section is on the same line as its first entry so is only annotated for classic sections
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	if w.options.Annotate && (len(section.Entries) == 0 || section.Entries[0].Position != section.Position) {
+		mapping.HeadComment = section.Position.String()
+	}
+
+	var keys []string
+
+	entries := map[string][]*Entry{}
+
+	for _, entry := range section.Entries {
+		key := strings.ToLower(entry.Key)
+		if entries[key] == nil {
+			keys = append(keys, key)
+		}
+
+		entries[key] = append(entries[key], entry)
+	}
+
+	for _, key := range keys {
+		value, err := w.entriesValue(section, entries[key])
+		if err != nil {
+			return nil, err
+		}
+
+		name := entries[key][0].Key
+		if section.Type == SectionMultilineParser && key == "rule" {
+			name = "rules"
+		}
+
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name, HeadComment: w.entryComments(entries[key][0])}, value)
+	}
+
+	return mapping, nil
+}
+
+func (w *yamlWriter) entriesValue(section *Section, entries []*Entry) (*yaml.Node, error) {
+	first := entries[0]
+
+	if section.Type == SectionMultilineParser && strings.EqualFold(first.Key, "rule") {
+		return multilineRulesValue(entries, w.options)
+	}
+
+	if len(entries) == 1 && !first.Structured {
+		return annotatedScalar(w.options.value(first), first.Position, w.options.Annotate), nil
+	}
+
+	if first.Structured {
+		var document yaml.Node
+		if err := yaml.Unmarshal([]byte(first.Value), &document); err != nil || len(document.Content) == 0 {
+			return nil, fmt.Errorf("%w: %s: invalid value for %q", ErrInvalidConfig, first.Position, first.Key)
+		}
+
+		value := document.Content[0]
+		setBlockStyle(value)
+
+		return value, nil
+	}
+
+	// The comments of the first entry are on the key
+	list := &yaml.Node{Kind: yaml.SequenceNode}
+	for i, entry := range entries {
+		item := annotatedScalar(w.options.value(entry), entry.Position, w.options.Annotate)
+		if i > 0 {
+			item.HeadComment = w.entryComments(entry)
+		}
+
+		list.Content = append(list.Content, item)
+	}
+
+	return list, nil
+}
+
+// joinComments joins the comments that are set, one per line.
+func joinComments(comments ...string) string {
+	var lines []string
+
+	for _, comment := range comments {
+		if comment != "" {
+			lines = append(lines, comment)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// multilineRulesValue converts the classic "state" "regex" "next state" rules to a list of mappings.
+func multilineRulesValue(entries []*Entry, options RenderOptions) (*yaml.Node, error) {
+	list := &yaml.Node{Kind: yaml.SequenceNode}
+
+	for _, entry := range entries {
+		parts := quotedStrings(options.value(entry))
+		if len(parts) != multilineRuleParts {
+			return nil, fmt.Errorf("%w: %s: rule is not \"state\" \"regex\" \"next state\"", ErrInvalidConfig, entry.Position)
+		}
+
+		rule := &yaml.Node{Kind: yaml.MappingNode}
+		for i, key := range []string{"state", "regex", "next_state"} {
+			rule.Content = append(rule.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &yaml.Node{Kind: yaml.ScalarNode, Value: parts[i]})
+		}
+
+		if options.Annotate {
+			rule.HeadComment = entry.Position.String()
+		}
+
+		list.Content = append(list.Content, rule)
+	}
+
+	return list, nil
+}
+
+// quotedStrings returns the contents of every double quoted string in the value, there is no escaping as in Fluent Bit.
+func quotedStrings(value string) []string {
+	var parts []string
+
+	for {
+		start := strings.IndexByte(value, '"')
+		if start == -1 {
+			return parts
+		}
+
+		end := strings.IndexByte(value[start+1:], '"')
+		if end == -1 {
+			return parts
+		}
+
+		parts = append(parts, value[start+1:start+1+end])
+		value = value[start+end+2:]
+	}
+}
+
+// setBlockStyle undoes the flow style used to keep structured values on a single line.
+func setBlockStyle(node *yaml.Node) {
+	node.Style &^= yaml.FlowStyle
+
+	for _, child := range node.Content {
+		setBlockStyle(child)
+	}
+}
+
+func annotatedScalar(value string, position Position, annotate bool) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+
+	// Fluent Bit values are all strings so make sure they are not read as null, e.g. the null output plugin
+	switch strings.ToLower(value) {
+	case "", "~", "null":
+		node.Tag = "!!str"
+	}
+
+	if annotate {
+		node.LineComment = position.String()
+	}
+
+	return node
+}
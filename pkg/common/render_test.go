@@ -0,0 +1,88 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestRenderConfig(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("TEST_RENDER_DIR", "/logs")
+
+	config, err := common.ParseConfig(strings.NewReader(`# Not rendered
+@set MBL_RENDER=10MB
+[INPUT]
+    Name tail
+    Path ${TEST_RENDER_DIR}/indexer.log
+    Mem_Buf_Limit ${MBL_RENDER}
+
+[OUTPUT]
+    Name  null
+    Match *
+`), "render.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	var classic strings.Builder
+
+	options := common.RenderOptions{Format: common.ConfigFormatClassic, Annotate: true, Resolver: common.NewVariableResolver(config)}
+	if err := common.RenderConfig(&classic, config, options); err != nil {
+		t.Fatalf("unable to render config: %v", err)
+	}
+
+	expected := `[INPUT]  # render.conf:3
+    Name          tail  # render.conf:4
+    Path          /logs/indexer.log  # render.conf:5
+    Mem_Buf_Limit 10MB  # render.conf:6
+
+[OUTPUT]  # render.conf:8
+    Name  null  # render.conf:9
+    Match *  # render.conf:10
+`
+	if classic.String() != expected {
+		t.Errorf("unexpected classic config:\n%s", classic.String())
+	}
+
+	// Rendering as YAML then parsing it gives the same sections
+	var rendered strings.Builder
+
+	options.Format, options.Annotate = common.ConfigFormatYAML, false
+	if err := common.RenderConfig(&rendered, config, options); err != nil {
+		t.Fatalf("unable to render config: %v", err)
+	}
+
+	yamlConfig, err := common.ParseConfig(strings.NewReader(rendered.String()), "render.yaml")
+	if err != nil {
+		t.Fatalf("unable to parse rendered YAML: %v\n%s", err, rendered.String())
+	}
+
+	sections := yamlConfig.Sections()
+	if len(sections) != 2 || sections[0].Get("Path") != "/logs/indexer.log" || sections[1].Name() != "null" || sections[1].Get("Match") != "*" {
+		t.Errorf("unexpected YAML config:\n%s", rendered.String())
+	}
+
+	if err := common.RenderConfig(&rendered, config, common.RenderOptions{Format: "toml"}); !errors.Is(err, common.ErrUnknownConfigFormat) {
+		t.Errorf("expected unknown format error but got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"os"
+	"strconv"
+)
+
+// CalculateStorageTotalLimitSize shares the cap on the filesystem buffer between the outputs that match anything.
+// Fluent Bit counts a chunk against every output it is routed to so this is the most each one can use, it returns zero if there are none.
+func CalculateStorageTotalLimitSize(config *ConfigFile, maxBytes int64) int64 {
+	resolver := NewVariableResolver(config)
+
+	var outputs int64
+
+	for _, output := range config.Outputs() {
+		if outputEnabled(output, resolver) {
+			outputs++
+		}
+	}
+
+	if outputs == 0 {
+		return 0
+	}
+
+	return maxBytes / outputs
+}
+
+// DefaultStorageTotalLimitSize leaves the outputs without a limit, Fluent Bit treats "off" as no limit.
+const DefaultStorageTotalLimitSize = "off"
+
+// CheckAndEnableStorageLimits sets the storage.total_limit_size for the outputs of the config if the filesystem buffer is capped.
+// Otherwise it defaults to no limit so outputs using ${STORAGE_TOTAL_LIMIT_SIZE} always have a value.
+func CheckAndEnableStorageLimits(configPath string) {
+	maxBytes := GetStorageBufferMaxBytes()
+	if maxBytes <= 0 {
+		setStorageTotalLimitSizeDefault()
+
+		return
+	}
+
+	fbConfig, err := ParseConfigFile(configPath)
+	if err != nil {
+		// Fluent Bit may well accept a config we cannot parse so leave it to decide, without a limit.
+		log.Warnw("Unable to parse fb config file, not setting storage limits", "error", err, "config", configPath)
+		setStorageTotalLimitSizeDefault()
+
+		return
+	}
+
+	limit := CalculateStorageTotalLimitSize(fbConfig, maxBytes)
+	if limit == 0 {
+		log.Info("No output plugins found, not setting storage limits")
+		setStorageTotalLimitSizeDefault()
+
+		return
+	}
+
+	log.Infow("Setting storage limit for each output", "buffer", GetStorageBufferDir(), "maxBytes", maxBytes, StorageTotalLimitSizeEnvVar, limit)
+	os.Setenv(StorageTotalLimitSizeEnvVar, strconv.FormatInt(limit, 10))
+}
+
+// setStorageTotalLimitSizeDefault leaves any limit that has been set explicitly alone.
+func setStorageTotalLimitSizeDefault() {
+	if _, set := os.LookupEnv(StorageTotalLimitSizeEnvVar); !set {
+		os.Setenv(StorageTotalLimitSizeEnvVar, DefaultStorageTotalLimitSize)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestCalculateStorageTotalLimitSize(t *testing.T) {
+	t.Parallel()
+
+	config, err := common.ParseConfig(strings.NewReader(`
+[OUTPUT]
+    Name  stdout
+    Match *
+
+[OUTPUT]
+    Name  es
+    Match couchbase.*
+
+[OUTPUT]
+    Name  loki
+    Match no-match
+`), "outputs.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	// Shared between the outputs that match anything
+	if limit := common.CalculateStorageTotalLimitSize(config, 1000); limit != 500 {
+		t.Errorf("expected 500 bytes per output but got %d", limit)
+	}
+
+	if limit := common.CalculateStorageTotalLimitSize(&common.ConfigFile{}, 1000); limit != 0 {
+		t.Errorf("expected no limit without outputs but got %d", limit)
+	}
+}
+
+func TestCheckAndEnableStorageLimits(t *testing.T) {
+	t.Setenv(common.StorageTotalLimitSizeEnvVar, "")
+	os.Unsetenv(common.StorageTotalLimitSizeEnvVar)
+
+	// Without a cap outputs using the variable still get a value
+	t.Setenv(common.StorageBufferMaxBytesEnvVar, "0")
+	common.CheckAndEnableStorageLimits(common.GetConfigFile())
+
+	if limit := os.Getenv(common.StorageTotalLimitSizeEnvVar); limit != common.DefaultStorageTotalLimitSize {
+		t.Errorf("expected the default limit but got %q", limit)
+	}
+
+	// An explicit limit is left alone
+	t.Setenv(common.StorageTotalLimitSizeEnvVar, "1G")
+	common.CheckAndEnableStorageLimits(common.GetConfigFile())
+
+	if limit := os.Getenv(common.StorageTotalLimitSizeEnvVar); limit != "1G" {
+		t.Errorf("expected the explicit limit but got %q", limit)
+	}
+	// A config we cannot parse is left to Fluent Bit rather than stopping the sidecar
+	os.Unsetenv(common.StorageTotalLimitSizeEnvVar)
+	t.Setenv(common.StorageBufferMaxBytesEnvVar, "1000")
+
+	config := filepath.Join(t.TempDir(), "fluent-bit.conf")
+	if err := os.WriteFile(config, []byte("[STREAM_TASK]\n    Name test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := common.ParseConfigFile(config); err == nil {
+		t.Fatal("expected the config to fail to parse")
+	}
+
+	common.CheckAndEnableStorageLimits(config)
+
+	if limit := os.Getenv(common.StorageTotalLimitSizeEnvVar); limit != common.DefaultStorageTotalLimitSize {
+		t.Errorf("expected the default limit for an invalid config but got %q", limit)
+	}
+}
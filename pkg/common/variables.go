@@ -0,0 +1,107 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"os"
+	"regexp"
+)
+
+// Any number of ${VAR} references per value, names can be any case and include digits.
+var variableRegex = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// VariableResolver expands ${VAR} references in the same way as Fluent Bit:
+// @set variables take precedence over the environment, which takes precedence over the defaults Fluent Bit provides.
+// Values are only expanded once, a reference in the value of a variable is left as is, and unknown variables expand to nothing.
+type VariableResolver struct {
+	variables map[string]string
+	lookupEnv func(string) (string, bool)
+	defaults  func(string) (string, bool)
+}
+
+// NewVariableResolver resolves the variables set in the config, the last one set wins, falling back to the environment.
+func NewVariableResolver(config *ConfigFile) *VariableResolver {
+	resolver := newVariableResolver()
+
+	if config != nil {
+		for _, variable := range config.Variables() {
+			resolver.Set(variable.Key, variable.Value)
+		}
+	}
+
+	return resolver
+}
+
+func newVariableResolver() *VariableResolver {
+	return &VariableResolver{variables: map[string]string{}, lookupEnv: os.LookupEnv, defaults: fluentBitDefault}
+}
+
+// fluentBitDefault returns the variables Fluent Bit sets itself if they are not in the environment.
+func fluentBitDefault(name string) (string, bool) {
+	if name != "HOSTNAME" {
+		return "", false
+	}
+
+	hostname, err := os.Hostname()
+
+	return hostname, err == nil
+}
+
+// Set defines a variable as @set does.
+func (r *VariableResolver) Set(name, value string) {
+	r.variables[name] = value
+}
+
+// IsSet returns true if the variable is defined by @set, so cannot be changed by the environment.
+func (r *VariableResolver) IsSet(name string) bool {
+	_, set := r.variables[name]
+
+	return set
+}
+
+// Lookup returns the value of the variable and whether it is defined at all.
+func (r *VariableResolver) Lookup(name string) (string, bool) {
+	if value, set := r.variables[name]; set {
+		return value, true
+	}
+
+	if value, set := r.lookupEnv(name); set {
+		return value, true
+	}
+
+	return r.defaults(name)
+}
+
+// Expand replaces every ${VAR} reference in the value.
+func (r *VariableResolver) Expand(value string) string {
+	return variableRegex.ReplaceAllStringFunc(value, func(reference string) string {
+		expanded, _ := r.Lookup(variableRegex.FindStringSubmatch(reference)[1])
+
+		return expanded
+	})
+}
+
+// References returns the name of every variable referenced by the value in order.
+func References(value string) []string {
+	var names []string
+
+	for _, match := range variableRegex.FindAllStringSubmatch(value, -1) {
+		names = append(names, match[1])
+	}
+
+	return names
+}
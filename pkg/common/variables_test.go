@@ -0,0 +1,72 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestVariableResolver(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("TEST_VARIABLES_DIR", "/logs")
+	os.Setenv("TEST_VARIABLES_MATCH", "*")
+
+	config, err := common.ParseConfigFile("testdata/config/variables/fluent-bit.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	// The include used a variable set before it
+	inputs := config.Inputs()
+	if len(inputs) != 2 {
+		t.Fatalf("expected 2 inputs but got %d", len(inputs))
+	}
+
+	resolver := common.NewVariableResolver(config)
+
+	tests := map[string]string{
+		// Multiple references, lower case and digits
+		inputs[0].Get("Path"): "/logs/indexer.log",
+		// @set takes precedence over the environment
+		"${TEST_VARIABLES_MATCH}": "no-match",
+		// Only expanded once
+		"${nested}": "${log_1}",
+		// Unknown variables are empty
+		"[${TEST_VARIABLES_UNKNOWN}]": "[]",
+	}
+
+	for value, expected := range tests {
+		if expanded := resolver.Expand(value); expanded != expected {
+			t.Errorf("%q: %q != %q", value, expanded, expected)
+		}
+	}
+
+	memBufConfig := common.CreateMemBufLimitConfig(config)
+
+	// Variables that are set cannot be changed so are not included
+	if !slices.Equal(memBufConfig.MemBufLimitNames, []string{"MBL_test_1"}) {
+		t.Errorf("unexpected memory buffer limits: %v", memBufConfig.MemBufLimitNames)
+	}
+
+	if memBufConfig.NumOutputs != 0 {
+		t.Errorf("expected no outputs but got %d", memBufConfig.NumOutputs)
+	}
+}
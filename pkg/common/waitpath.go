@@ -0,0 +1,129 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// PathWaiter waits for a directory that may not exist yet, e.g. a volume mounted late, at any depth.
+// Until the directory exists its nearest existing ancestor is watched instead,
+// walking down as each directory in between appears.
+// If the directory is removed (or renamed) once found, Removed goes back to waiting for it from its nearest existing ancestor.
+type PathWaiter struct {
+	watcher  *fsnotify.Watcher
+	path     string
+	watching string
+}
+
+// NewPathWaiter adds the path to the watcher if it exists, otherwise its nearest existing ancestor.
+func NewPathWaiter(watcher *fsnotify.Watcher, path string) (*PathWaiter, error) {
+	pw := &PathWaiter{watcher: watcher, path: filepath.Clean(path)}
+
+	if _, err := pw.Update(); err != nil {
+		return nil, err
+	}
+
+	if !pw.Found() {
+		log.Infow("Directory does not exist so waiting for it", "dir", pw.path, "watching", pw.watching)
+	}
+
+	return pw, nil
+}
+
+// Found returns true once the path itself is being watched.
+func (pw *PathWaiter) Found() bool {
+	return pw.watching == pw.path
+}
+
+// Path returns the directory being waited for.
+func (pw *PathWaiter) Path() string {
+	return pw.path
+}
+
+// Update moves the watch to the nearest existing ancestor of the path, it should be called on every event whilst waiting.
+// It returns true if the path has just been found so any files already in it can be handled.
+func (pw *PathWaiter) Update() (bool, error) {
+	if pw.Found() {
+		return false, nil
+	}
+
+	// Keep going until nothing changes as directories may be created before we manage to watch their parent
+	for {
+		nearest := nearestExistingDir(pw.path)
+		if nearest == pw.watching {
+			return false, nil
+		}
+
+		if pw.watching != "" {
+			// The old one may have been removed so nothing to do
+			_ = pw.watcher.Remove(pw.watching)
+		}
+
+		if err := pw.watcher.Add(nearest); err != nil {
+			pw.watching = ""
+
+			return false, fmt.Errorf("unable to watch %q waiting for %q: %w", nearest, pw.path, err)
+		}
+
+		pw.watching = nearest
+
+		if pw.Found() {
+			log.Infow("Directory now exists so watching", "dir", pw.path)
+
+			return true, nil
+		}
+
+		log.Debugw("Still waiting for directory", "dir", pw.path, "watching", pw.watching)
+	}
+}
+
+// Removed returns true if the event is the directory itself being removed or renamed, it is then waited for again.
+// It should be called on every event once found, Update then moves the watch as whilst first waiting.
+func (pw *PathWaiter) Removed(event fsnotify.Event) bool {
+	if !pw.Found() || filepath.Clean(event.Name) != pw.path || event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		return false
+	}
+
+	// A renamed directory is still watched under its new name so stop that, a removed one has already gone
+	_ = pw.watcher.Remove(pw.path)
+	pw.watching = ""
+
+	log.Infow("Directory removed so waiting for it again", "dir", pw.path)
+
+	return true
+}
+
+// nearestExistingDir returns the path if it is an existing directory or the closest ancestor that is.
+func nearestExistingDir(path string) string {
+	for {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return path
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+
+		path = parent
+	}
+}
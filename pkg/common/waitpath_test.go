@@ -0,0 +1,142 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPathWaiter(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	path := filepath.Join(root, "logs", "nested", "rebalance")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	waiter, err := common.NewPathWaiter(watcher, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if waiter.Found() {
+		t.Fatal("Found a directory that does not exist")
+	}
+
+	// Walk down one level at a time as each directory is created
+	for i, dir := range []string{"logs", "nested", "rebalance"} {
+		root = filepath.Join(root, dir)
+		if err := os.Mkdir(root, 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-watcher.Events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event creating %q", root)
+		}
+
+		found, err := waiter.Update()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if last := i == 2; found != last || waiter.Found() != last {
+			t.Fatalf("Invalid state after creating %q: %v", root, found)
+		}
+	}
+
+	// Once found files in the directory itself are watched
+	if err := os.WriteFile(filepath.Join(path, "file"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-watcher.Events:
+		if event.Name != filepath.Join(path, "file") {
+			t.Errorf("Invalid event: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event creating file")
+	}
+
+	// Removing the directory goes back to waiting for it
+	if err := os.RemoveAll(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for removed := false; !removed; {
+		select {
+		case event := <-watcher.Events:
+			removed = waiter.Removed(event)
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event removing directory")
+		}
+	}
+
+	if found, err := waiter.Update(); err != nil || found || waiter.Found() {
+		t.Fatalf("Found a directory that has been removed: %v", err)
+	}
+
+	if err := os.Mkdir(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := waiter.Update(); err != nil || !found {
+		t.Errorf("Directory not found again: %v", err)
+	}
+}
+
+func TestPathWaiterAllAtOnce(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	path := filepath.Join(root, "a", "b", "c")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	waiter, err := common.NewPathWaiter(watcher, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything created before we could watch it is still picked up
+	if found, err := waiter.Update(); err != nil || !found {
+		t.Errorf("Directory not found: %v", err)
+	}
+
+	if found, _ := waiter.Update(); found {
+		t.Error("Directory should only be found once")
+	}
+}
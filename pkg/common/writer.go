@@ -0,0 +1,207 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// generatedConfigSubdir is the directory under the scratch directory that is replaced every time a config is generated.
+	generatedConfigSubdir  = "generated"
+	generatedDirPermission = 0700
+	generatedPermission    = 0600
+)
+
+// Entries whose values are paths to other files that Fluent Bit reads relative to the main config file.
+var configPathKeys = map[string][]string{
+	SectionService: {"parsers_file", "plugins_file", "streams_file"},
+	SectionFilter:  {"script"},
+}
+
+// Entries in any section whose values are paths that Fluent Bit resolves against the config or where it was started, depending on the plugin.
+// A relative one could mean something else once the config is generated so it cannot be.
+var relativePathKeys = []string{
+	"db", "storage.path", "log_file", "path", "exclude_path", "parsers_file", "plugins_file", "streams_file", "script",
+	"tls.ca_file", "tls.ca_path", "tls.crt_file", "tls.key_file",
+}
+
+// ErrRelativePath indicates a relative path that the config cannot be generated with.
+var ErrRelativePath = errors.New("relative path cannot be generated")
+
+// WriteConfig writes the file itself, rather than the effective configuration, so parsing it again gives the same nodes:
+// comments, directives and the order of everything are kept but blank lines are not. Included files are not written.
+// The format defaults to the one the file was parsed from, structured values cannot be written in the classic format.
+func WriteConfig(out io.Writer, config *ConfigFile, format string) error {
+	if format == "" {
+		format = config.Format
+	}
+
+	options := RenderOptions{Format: format, comments: true}
+
+	switch format {
+	case ConfigFormatClassic, "":
+		for _, node := range config.Nodes {
+			if section, ok := node.(*Section); ok {
+				for _, entry := range section.Entries {
+					if entry.Structured {
+						return fmt.Errorf("%w: %s: %q cannot be written in the classic format", ErrInvalidConfig, entry.Position, entry.Key)
+					}
+				}
+			}
+		}
+
+		return renderClassic(out, config.Nodes, options)
+	case ConfigFormatYAML:
+		return renderYAML(out, config.Nodes, nil, options)
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownConfigFormat, format)
+	}
+}
+
+// GenerateConfigFile parses the configuration and generates it under a fresh directory in dir.
+// It returns the path of the main file to start Fluent Bit with.
+// Variables other than paths, e.g. the ${MBL_*} memory buffer limits, are left for Fluent Bit to expand from the environment.
+func GenerateConfigFile(path, dir string) (string, error) {
+	config, err := ParseConfigFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Anything left from last time, e.g. a file that is no longer included, could match a glob include
+	generatedDir := filepath.Join(dir, generatedConfigSubdir)
+	if err := os.RemoveAll(generatedDir); err != nil {
+		return "", fmt.Errorf("unable to remove generated config: %w", err)
+	}
+
+	return GenerateConfig(config, generatedDir)
+}
+
+// GenerateConfig writes the configuration and every file it includes under dir, each at its absolute path so relative includes still work,
+// and returns the path of the main file. Absolute includes are changed to the generated files and relative paths to files that are not
+// generated, e.g. Parsers_File, are made absolute. Any other relative path, e.g. a tail DB, is an error as it would resolve differently.
+func GenerateConfig(config *ConfigFile, dir string) (string, error) {
+	resolver := NewVariableResolver(config)
+	configDir := filepath.Dir(absolutePath(config.Path))
+
+	var files []*ConfigFile
+
+	files = append(files, config)
+
+	config.Walk(func(node Node) {
+		if include, ok := node.(*Include); ok {
+			files = append(files, include.Files...)
+		}
+	})
+
+	for _, file := range files {
+		generated := &ConfigFile{Path: generatedPath(dir, file.Path), Format: file.Format}
+		for _, node := range file.Nodes {
+			generatedNode, err := generatedNode(node, dir, configDir, resolver)
+			if err != nil {
+				return "", err
+			}
+
+			generated.Nodes = append(generated.Nodes, generatedNode)
+		}
+
+		if err := writeConfigFile(generated); err != nil {
+			return "", err
+		}
+	}
+
+	return generatedPath(dir, config.Path), nil
+}
+
+func absolutePath(path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	return absolute
+}
+
+func generatedPath(dir, path string) string {
+	return filepath.Join(dir, absolutePath(path))
+}
+
+// generatedNode returns the node to generate, a copy if it has to change so the configuration is left as it is.
+// Sections of included files are changed the same way as Fluent Bit resolves their paths against the main config file too.
+func generatedNode(node Node, dir, configDir string, resolver *VariableResolver) (Node, error) {
+	switch node := node.(type) {
+	case *Include:
+		if path := resolver.Expand(node.Path); filepath.IsAbs(path) {
+			return &Include{Path: filepath.Join(dir, path), Files: node.Files, Position: node.Position}, nil
+		}
+	case *Section:
+		section := *node
+		section.Entries = slices.Clone(node.Entries)
+
+		for i, entry := range section.Entries {
+			key := strings.ToLower(entry.Key)
+			if !slices.Contains(relativePathKeys, key) || entry.Structured {
+				continue
+			}
+
+			if path := resolver.Expand(entry.Value); path == "" || filepath.IsAbs(path) {
+				continue
+			}
+
+			if !slices.Contains(configPathKeys[section.Type], key) {
+				return nil, fmt.Errorf("%w: %s: %s %q, make it absolute", ErrRelativePath, entry.Position, entry.Key, entry.Value)
+			}
+
+			absolute := *entry
+			absolute.Value = filepath.Join(configDir, entry.Value)
+			section.Entries[i] = &absolute
+		}
+
+		return &section, nil
+	}
+
+	return node, nil
+}
+
+func writeConfigFile(config *ConfigFile) error {
+	if err := os.MkdirAll(filepath.Dir(config.Path), generatedDirPermission); err != nil {
+		return fmt.Errorf("unable to create directory for %q: %w", config.Path, err)
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, generatedPermission)
+	if err != nil {
+		return fmt.Errorf("unable to create %q: %w", config.Path, err)
+	}
+
+	if err := WriteConfig(file, config, config.Format); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("unable to write %q: %w", config.Path, err)
+	}
+
+	return nil
+}
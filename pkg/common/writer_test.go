@@ -0,0 +1,196 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package common_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+func TestWriteConfig(t *testing.T) {
+	t.Parallel()
+
+	// Writing what was parsed and parsing it again gives the same config, comments and all
+	for _, path := range []string{"testdata/config/fluent-bit.conf", "testdata/config/inputs.conf", "testdata/config/fluent-bit.yaml"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := common.ParseConfig(strings.NewReader(string(data)), path)
+		if err != nil {
+			t.Fatalf("%s: unable to parse config: %v", path, err)
+		}
+
+		var written strings.Builder
+		if err := common.WriteConfig(&written, config, ""); err != nil {
+			t.Fatalf("%s: unable to write config: %v", path, err)
+		}
+
+		reparsed, err := common.ParseConfig(strings.NewReader(written.String()), path)
+		if err != nil {
+			t.Fatalf("%s: unable to parse written config: %v\n%s", path, err, written.String())
+		}
+
+		if len(reparsed.Nodes) != len(config.Nodes) {
+			t.Errorf("%s: %d nodes != %d nodes:\n%s", path, len(reparsed.Nodes), len(config.Nodes), written.String())
+		}
+
+		var rewritten strings.Builder
+		if err := common.WriteConfig(&rewritten, reparsed, ""); err != nil || rewritten.String() != written.String() {
+			t.Errorf("%s: writing again gave a different config: %v\n%s", path, err, rewritten.String())
+		}
+	}
+
+	config, err := common.ParseConfigFile("testdata/config/inputs.conf")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	// Patch the existing inputs and add a filter before the second one
+	inputs := config.Inputs()
+	inputs[0].Set("Mem_Buf_Limit", "10MB")
+	inputs[1].Add("Path", "${COUCHBASE_LOGS}/query2.log")
+
+	filter := common.NewSection(common.SectionFilter)
+	filter.Set("Name", "lua")
+	filter.Set("Match", "*")
+
+	if !config.Insert(inputs[1], &common.Comment{Text: " Added"}, filter) {
+		t.Fatal("unable to find the input to insert before")
+	}
+
+	var written strings.Builder
+	if err := common.WriteConfig(&written, config, common.ConfigFormatClassic); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+
+	expected := `[INPUT]
+    Name          tail
+    # Only the indexer log
+    Path          ${COUCHBASE_LOGS}/indexer.log
+    Tag           couchbase.log.indexer
+    Mem_Buf_Limit 10MB
+
+# Added
+[FILTER]
+    Name  lua
+    Match *
+
+[Input]
+    Name          tail
+    Path          ${COUCHBASE_LOGS}/query.log
+    Tag           couchbase.log.query
+    mem_buf_limit ${MBL_TEST_QUERY}
+    Path          ${COUCHBASE_LOGS}/query2.log
+`
+	if written.String() != expected {
+		t.Errorf("unexpected config:\n%s", written.String())
+	}
+
+	yamlConfig, err := common.ParseConfigFile("testdata/config/fluent-bit.yaml")
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+
+	// Processors have no classic equivalent
+	if err := common.WriteConfig(&written, yamlConfig, common.ConfigFormatClassic); !errors.Is(err, common.ErrInvalidConfig) {
+		t.Errorf("expected invalid config error but got %v", err)
+	}
+}
+
+func TestGenerateConfigFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// Generating twice replaces the first one
+	for range 2 {
+		path, err := common.GenerateConfigFile("testdata/config/fluent-bit.conf", dir)
+		if err != nil {
+			t.Fatalf("unable to generate config: %v", err)
+		}
+
+		if !strings.HasPrefix(path, filepath.Join(dir, "generated")) {
+			t.Errorf("unexpected path %q", path)
+		}
+
+		config, err := common.ParseConfigFile(path)
+		if err != nil {
+			t.Fatalf("unable to parse generated config: %v", err)
+		}
+
+		// The includes are generated as well, with the limits left for Fluent Bit to expand from the environment
+		inputs := config.Inputs()
+		if len(inputs) != 2 || inputs[0].Get("Mem_Buf_Limit") != "${MBL_TEST_INDEXER}" {
+			t.Errorf("includes were not generated: %+v", inputs)
+		}
+
+		if len(config.Outputs()) != 3 {
+			t.Errorf("expected 3 outputs but got %d", len(config.Outputs()))
+		}
+	}
+}
+
+func TestGenerateConfigRelativePaths(t *testing.T) {
+	t.Parallel()
+
+	configDir := t.TempDir()
+	main := filepath.Join(configDir, "fluent-bit.conf")
+
+	// Fluent Bit resolves the files of a [SERVICE] in an included file against the main config file as well
+	files := map[string]string{
+		main:                                     "@INCLUDE service.conf\n",
+		filepath.Join(configDir, "service.conf"): "[SERVICE]\n    Parsers_File parsers.conf\n    storage.path /tmp/buffer\n",
+	}
+
+	for path, contents := range files {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, err := common.GenerateConfigFile(main, t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to generate config: %v", err)
+	}
+
+	config, err := common.ParseConfigFile(path)
+	if err != nil {
+		t.Fatalf("unable to parse generated config: %v", err)
+	}
+
+	if parsers := config.SectionsOf(common.SectionService)[0].Get("Parsers_File"); parsers != filepath.Join(configDir, "parsers.conf") {
+		t.Errorf("unexpected parsers file %q", parsers)
+	}
+
+	// Anything else relative could resolve against the generated directory so it is refused
+	for _, entry := range []string{"DB tail.db", "storage.path buffer", "Path ${TEST_UNSET_VARIABLE}logs/*.log"} {
+		contents := "[INPUT]\n    Name tail\n    " + entry + "\n"
+		if err := os.WriteFile(filepath.Join(configDir, "service.conf"), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := common.GenerateConfigFile(main, t.TempDir()); !errors.Is(err, common.ErrRelativePath) {
+			t.Errorf("expected a relative path error for %q but got %v", entry, err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"github.com/oklog/run"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// rebalanceAlertPattern is distinct from the processed reports so a separate tail input can give alerts their own tag.
+	rebalanceAlertPattern = "rebalance-alert-*.json"
+	rebalanceAlertLevel   = "ERROR"
+	alertWebhookTimeout   = 10 * time.Second
+	// alertQueueSize is how many alerts can wait to be raised, any more are dropped rather than holding up processing.
+	alertQueueSize = 64
+	// maxAlertFiles is how many alert files are kept, Fluent Bit only needs them until it has read them.
+	maxAlertFiles = MaxCBFiles
+)
+
+var (
+	// ErrInvalidWebhook indicates the alert webhook is not an absolute HTTP(S) URL.
+	ErrInvalidWebhook = errors.New("invalid alert webhook")
+	// ErrWebhookFailed indicates the alert webhook did not accept the alert.
+	ErrWebhookFailed = errors.New("alert webhook failed")
+	// ErrAlertDropped indicates an alert could not be queued to be raised.
+	ErrAlertDropped = errors.New("alert dropped")
+)
+
+// rebalanceAlert is the high severity record written for a failed or stuck rebalance.
+type rebalanceAlert struct {
+	Timestamp  string            `json:"timestamp"`
+	Level      string            `json:"level"`
+	ReportName string            `json:"reportName"`
+	Node       string            `json:"node,omitempty"`
+	Message    string            `json:"message"`
+	Reasons    []string          `json:"reasons"`
+	Summary    *rebalanceSummary `json:"summary"`
+}
+
+// RebalanceAlerter raises an alert for every rebalance that failed, has stages that never completed or reports errors.
+// Each alert is written as its own file to the output directory, for a tail input with a dedicated tag,
+// and optionally posted to a webhook.
+// Alerts are raised in the background, in order, so a slow webhook never holds up processing reports.
+type RebalanceAlerter struct {
+	outputDir string
+	webhook   string
+	retention RetentionPolicy
+	client    *http.Client
+	queue     chan []byte
+	done      chan struct{}
+	lock      sync.Mutex
+	closed    bool
+}
+
+// NewRebalanceAlerter writes alerts to the output directory, applying the retention policy, and posts them to the webhook if set.
+func NewRebalanceAlerter(outputDir, webhook string, retention RetentionPolicy) (*RebalanceAlerter, error) {
+	if webhook != "" {
+		parsed, err := url.Parse(webhook)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidWebhook, webhook)
+		}
+	}
+
+	ra := &RebalanceAlerter{
+		outputDir: filepath.Clean(outputDir),
+		webhook:   webhook,
+		retention: retention,
+		client:    &http.Client{Timeout: alertWebhookTimeout},
+		queue:     make(chan []byte, alertQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	go ra.run()
+
+	return ra, nil
+}
+
+// NewRebalanceAlerterFromDefaults creates the alerter from the environment.
+func NewRebalanceAlerterFromDefaults() (*RebalanceAlerter, error) {
+	return NewRebalanceAlerter(common.GetRebalanceAlertDir(), common.GetRebalanceAlertWebhook(), AlertRetentionPolicy())
+}
+
+// AlertRetentionPolicy keeps the most recent alert files only, once they are old enough to have been read.
+// Alerts have their own policy as the rebalance limits are sized for the reports.
+func AlertRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{MaxFiles: maxAlertFiles, MinAge: DefaultMinAge}
+}
+
+// defaultAlerter creates the alerter from the environment if alerts are enabled, an invalid configuration is fatal.
+func defaultAlerter() *RebalanceAlerter {
+	if !common.GetRebalanceAlerts() {
+		return nil
+	}
+
+	alerter, err := NewRebalanceAlerterFromDefaults()
+	if err != nil {
+		log.Fatalw("Invalid rebalance alert configuration", "error", err)
+	}
+
+	return alerter
+}
+
+func (ra *RebalanceAlerter) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("outputDir", ra.outputDir)
+	// The URL may well include a token so never log it
+	enc.AddBool("webhook", ra.webhook != "")
+
+	return enc.AddObject("retention", ra.retention)
+}
+
+func (ra *RebalanceAlerter) GetOutputDir() string {
+	return ra.outputDir
+}
+
+// CreateOutputDir creates the output directory if it does not exist.
+func (ra *RebalanceAlerter) CreateOutputDir() error {
+	if err := os.MkdirAll(ra.outputDir, rebalanceDirPermissions); err != nil {
+		return fmt.Errorf("unable to create alert output directory %q: %w", ra.outputDir, err)
+	}
+
+	return nil
+}
+
+// alertReasons returns why the rebalance needs an alert, nothing if it does not.
+func alertReasons(summary *rebalanceSummary) []string {
+	var reasons []string
+
+	if summary.Status == RebalanceStatusFailed {
+		reasons = append(reasons, "rebalance failed: "+summary.CompletionMessage)
+	}
+
+	if len(summary.IncompleteStages) > 0 {
+		reasons = append(reasons, "stages did not reach 100% progress: "+strings.Join(summary.IncompleteStages, ", "))
+	}
+
+	for _, reported := range summary.Errors {
+		reasons = append(reasons, "error reported: "+reported)
+	}
+
+	return reasons
+}
+
+// Alert queues an alert for the report if its summary shows it failed or got stuck, it should only be called once
+// the report has been published so the alert is never raised for a report that is then processed again.
+// Any user data is redacted if a redactor is given as the alert includes parts of the report.
+func (ra *RebalanceAlerter) Alert(summary *rebalanceSummary, originalTimestamp, filename, node string, redactor *Redactor) error {
+	reasons := alertReasons(summary)
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	encoded, err := encodeAlert(rebalanceAlert{
+		Timestamp:  originalTimestamp,
+		Level:      rebalanceAlertLevel,
+		ReportName: filename,
+		Node:       node,
+		Message:    "Rebalance did not complete successfully",
+		Reasons:    reasons,
+		Summary:    summary,
+	}, redactor)
+	if err != nil {
+		return err
+	}
+
+	log.Warnw("Rebalance did not complete successfully", "file", filename, "node", node, "reasons", len(reasons))
+
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+
+	if ra.closed {
+		return fmt.Errorf("%w: alerter is closed", ErrAlertDropped)
+	}
+
+	select {
+	case ra.queue <- encoded:
+		return nil
+	default:
+		return fmt.Errorf("%w: %d alerts already queued", ErrAlertDropped, alertQueueSize)
+	}
+}
+
+// run raises each queued alert until the alerter is closed.
+func (ra *RebalanceAlerter) run() {
+	defer close(ra.done)
+
+	for encoded := range ra.queue {
+		if err := ra.write(encoded); err != nil {
+			log.Warnw("Unable to write rebalance alert", "alerter", ra, "error", err)
+		}
+
+		if err := ra.post(encoded); err != nil {
+			log.Warnw("Unable to post rebalance alert", "alerter", ra, "error", err)
+		}
+	}
+}
+
+// Close waits for any queued alerts to be raised, no more can be queued once closed.
+func (ra *RebalanceAlerter) Close() error {
+	ra.lock.Lock()
+
+	if !ra.closed {
+		ra.closed = true
+		close(ra.queue)
+	}
+
+	ra.lock.Unlock()
+
+	<-ra.done
+
+	return nil
+}
+
+// AddWatcher raises alerts until the group is interrupted, then waits for any still queued.
+func (ra *RebalanceAlerter) AddWatcher(g *run.Group) error {
+	log.Infow("Raising rebalance alerts", "alerter", ra)
+
+	done := make(chan bool)
+
+	g.Add(
+		func() error {
+			<-done
+
+			return ra.Close()
+		},
+		func(_ error) {
+			close(done)
+		},
+	)
+
+	return nil
+}
+
+// encodeAlert encodes the alert as a single line, redacting it if required.
+func encodeAlert(alert rebalanceAlert, redactor *Redactor) ([]byte, error) {
+	var out bytes.Buffer
+
+	var writer io.WriteCloser = nopWriteCloser{&out}
+	if redactor != nil {
+		writer = redactor.NewWriter(&out, true)
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(alert); err != nil {
+		return nil, fmt.Errorf("unable to encode alert: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// write publishes the alert as a new file, in the same way as a processed report, then applies the retention policy.
+func (ra *RebalanceAlerter) write(encoded []byte) error {
+	if err := ra.CreateOutputDir(); err != nil {
+		return err
+	}
+
+	tmpfile, err := os.CreateTemp(ra.outputDir, pendingPattern(rebalanceAlertPattern))
+	if err != nil {
+		return fmt.Errorf("unable to create temporary alert file in %q: %w", ra.outputDir, err)
+	}
+
+	if _, err := tmpfile.Write(encoded); err != nil {
+		_ = tmpfile.Close()
+		_ = os.Remove(tmpfile.Name())
+
+		return fmt.Errorf("unable to write alert: %w", err)
+	}
+
+	outputFile, err := publish(tmpfile, rebalanceAlertPattern)
+	if err != nil {
+		_ = os.Remove(tmpfile.Name())
+
+		return err
+	}
+
+	log.Infow("Published alert", "new", outputFile)
+
+	return ra.retention.Apply(ra.outputDir)
+}
+
+// post sends the alert to the webhook, if there is one.
+func (ra *RebalanceAlerter) post(encoded []byte) error {
+	if ra.webhook == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), alertWebhookTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, ra.webhook, bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("unable to create alert webhook request: %w", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := ra.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWebhookFailed, err)
+	}
+	defer response.Body.Close()
+
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: status %d", ErrWebhookFailed, response.StatusCode)
+	}
+
+	return nil
+}
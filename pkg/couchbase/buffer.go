@@ -0,0 +1,304 @@
+/*
+ *  Copyright 2022 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"github.com/oklog/run"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// DefaultBufferInterval is how often the size of the filesystem buffer is checked.
+	DefaultBufferInterval = 30 * time.Second
+	// Fluent Bit chunks are <input instance>/<pid>-<seconds>.<nanoseconds>.flb
+	chunkSuffix = ".flb"
+	// procRoot is where the open and mapped files of every process can be found
+	procRoot = "/proc"
+)
+
+// BufferManager keeps the Fluent Bit filesystem buffer within a cap so a long output outage does not fill the disk.
+// Fluent Bit itself is limited by the storage.total_limit_size of each output, see common.CheckAndEnableStorageLimits,
+// but that does not include chunks left behind by a Fluent Bit process that crashed. The oldest of these can be removed.
+// A restarted Fluent Bit loads them as backlog so removing them loses undelivered data, which is why it has to be enabled.
+type BufferManager struct {
+	dir           string
+	maxBytes      int64
+	interval      time.Duration
+	removeOrphans bool
+}
+
+// BufferUsage is the size of the buffer after any orphaned chunks have been removed.
+type BufferUsage struct {
+	Bytes int64
+	// Orphans are the chunks of processes that are no longer running and no running process has loaded, oldest first.
+	Orphans []string
+	Removed []string
+}
+
+// NewBufferManager caps the size of the buffer directory, orphaned chunks are only removed if enabled.
+func NewBufferManager(dir string, maxBytes int64, interval time.Duration, removeOrphans bool) *BufferManager {
+	if interval <= 0 {
+		interval = DefaultBufferInterval
+	}
+
+	return &BufferManager{dir: filepath.Clean(dir), maxBytes: maxBytes, interval: interval, removeOrphans: removeOrphans}
+}
+
+// defaultBufferManager returns nil if the buffer is not capped.
+func defaultBufferManager() *BufferManager {
+	maxBytes := common.GetStorageBufferMaxBytes()
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	return NewBufferManager(common.GetStorageBufferDir(), maxBytes, common.GetDuration(DefaultBufferInterval, common.StorageBufferIntervalEnvVar), common.GetStorageBufferRemoveOrphans())
+}
+
+func (bm *BufferManager) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("dir", bm.dir)
+	enc.AddInt64("maxBytes", bm.maxBytes)
+	enc.AddDuration("interval", bm.interval)
+	enc.AddBool("removeOrphans", bm.removeOrphans)
+
+	return nil
+}
+
+// chunk is a buffered chunk file.
+type chunk struct {
+	path string
+	info fs.FileInfo
+}
+
+// chunkPID returns the process that wrote the chunk, false if it is not named as a chunk is.
+func chunkPID(name string) (int, bool) {
+	if !strings.HasSuffix(name, chunkSuffix) {
+		return 0, false
+	}
+
+	prefix, _, found := strings.Cut(name, "-")
+	if !found {
+		return 0, false
+	}
+
+	pid, err := strconv.Atoi(prefix)
+
+	return pid, err == nil && pid > 0
+}
+
+// processRunning returns true if the process exists, even if we are not allowed to signal it.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// loadedFiles returns the files any process we can see has open or mapped, which includes the chunks Fluent Bit has
+// loaded from a previous process. Processes we are not allowed to look at are skipped.
+func loadedFiles() map[string]bool {
+	loaded := map[string]bool{}
+
+	pids, err := filepath.Glob(filepath.Join(procRoot, "[0-9]*"))
+	if err != nil {
+		return loaded
+	}
+
+	for _, pid := range pids {
+		fds, _ := os.ReadDir(filepath.Join(pid, "fd"))
+		for _, fd := range fds {
+			if target, err := os.Readlink(filepath.Join(pid, "fd", fd.Name())); err == nil {
+				loaded[target] = true
+			}
+		}
+
+		// Chunks are memory mapped while they are up and the descriptor may not be kept
+		maps, _ := os.ReadFile(filepath.Join(pid, "maps"))
+		for _, line := range strings.Split(string(maps), "\n") {
+			// address perms offset dev inode path
+			if fields := strings.Fields(line); len(fields) > 5 {
+				loaded[strings.Join(fields[5:], " ")] = true
+			}
+		}
+	}
+
+	return loaded
+}
+
+// chunkLoaded returns true if the chunk is one of the loaded files.
+func chunkLoaded(path string, loaded map[string]bool) bool {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	} else if absolute, err := filepath.Abs(path); err == nil {
+		path = absolute
+	}
+
+	return loaded[path]
+}
+
+// scan returns the total size of the buffer and its orphaned chunks, oldest first.
+func (bm *BufferManager) scan() (int64, []chunk, error) {
+	var (
+		total   int64
+		orphans []chunk
+	)
+
+	running := map[int]bool{}
+
+	err := filepath.WalkDir(bm.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Removed underneath us, e.g. Fluent Bit deleting a chunk once delivered
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return fmt.Errorf("unable to stat %q: %w", path, err)
+		}
+
+		total += info.Size()
+
+		pid, isChunk := chunkPID(entry.Name())
+		if !isChunk {
+			return nil
+		}
+
+		if _, checked := running[pid]; !checked {
+			running[pid] = processRunning(pid)
+		}
+
+		if !running[pid] {
+			orphans = append(orphans, chunk{path: path, info: info})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to read buffer directory %q: %w", bm.dir, err)
+	}
+
+	// A restarted Fluent Bit has the chunks of the previous process open as backlog, these are about to be delivered
+	if len(orphans) > 0 {
+		loaded := loadedFiles()
+		orphans = slices.DeleteFunc(orphans, func(orphan chunk) bool {
+			return chunkLoaded(orphan.path, loaded)
+		})
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].info.ModTime().Before(orphans[j].info.ModTime())
+	})
+
+	return total, orphans, nil
+}
+
+// Check measures the buffer and, if it is over the cap and enabled, removes the oldest orphaned chunks until it is within it.
+// Chunks of running processes are never removed and neither are those a running process has loaded.
+// Any other orphan would be loaded by the next Fluent Bit process so removing it still loses data.
+func (bm *BufferManager) Check() (*BufferUsage, error) {
+	total, orphans, err := bm.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &BufferUsage{Bytes: total}
+	for _, orphan := range orphans {
+		usage.Orphans = append(usage.Orphans, orphan.path)
+	}
+
+	if total <= bm.maxBytes {
+		log.Debugw("Buffer is within its limit", "buffer", bm, "bytes", total, "orphans", len(orphans))
+
+		return usage, nil
+	}
+
+	for _, orphan := range orphans {
+		if !bm.removeOrphans || usage.Bytes <= bm.maxBytes {
+			break
+		}
+
+		log.Infow("Removing orphaned chunk", "chunk", orphan.path, "bytes", orphan.info.Size(), "modified", orphan.info.ModTime())
+
+		if err := os.Remove(orphan.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return usage, fmt.Errorf("unable to remove orphaned chunk %q: %w", orphan.path, err)
+		}
+
+		usage.Bytes -= orphan.info.Size()
+		usage.Removed = append(usage.Removed, orphan.path)
+	}
+
+	if usage.Bytes > bm.maxBytes {
+		log.Warnw("Buffer is over its limit", "buffer", bm, "bytes", usage.Bytes, "orphans", len(orphans)-len(usage.Removed))
+	}
+
+	return usage, nil
+}
+
+// AddWatcher checks the buffer periodically until the group is interrupted.
+func (bm *BufferManager) AddWatcher(g *run.Group) error {
+	log.Infow("Managing buffer directory", "buffer", bm)
+
+	done := make(chan bool)
+
+	g.Add(
+		func() error {
+			ticker := time.NewTicker(bm.interval)
+			defer ticker.Stop()
+
+			for {
+				// The directory may not exist until Fluent Bit first buffers anything so keep going
+				if _, err := bm.Check(); err != nil {
+					log.Warnw("Unable to check buffer directory", "buffer", bm, "error", err)
+				}
+
+				select {
+				case <-done:
+					return nil
+				case <-ticker.C:
+				}
+			}
+		},
+		func(_ error) {
+			close(done)
+		},
+	)
+
+	return nil
+}
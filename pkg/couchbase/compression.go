@@ -0,0 +1,71 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompress detects a compressed source by its magic bytes, rather than the name, and returns a stream of the decompressed contents.
+// Anything else is returned as is. The compression format is returned for logging.
+func decompress(source io.Reader) (io.ReadCloser, string, error) {
+	buffered := bufio.NewReader(source)
+
+	// A short file cannot be compressed so just pass it through
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", fmt.Errorf("unable to read: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid gzip stream: %w", err)
+		}
+
+		return reader, compressionGzip, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		// Single threaded to keep memory usage down, these are never large enough to need more
+		reader, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid zstd stream: %w", err)
+		}
+
+		return reader.IOReadCloser(), compressionZstd, nil
+	default:
+		return io.NopCloser(buffered), compressionNone, nil
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/couchbase/fluent-bit/pkg/common"
 	"go.uber.org/zap/zapcore"
@@ -34,7 +35,20 @@ type WatcherConfig struct {
 	couchbaseLogDir,
 	rebalanceOutputDir,
 	couchbaseWatchDir,
-	tlsCertsDir string
+	tlsCertsDir,
+	node string
+	logRoots       []LogRoot
+	retention      *RetentionPolicy
+	filter         *FileFilter
+	explode        bool
+	preprocessDirs string
+	redactor       *Redactor
+	redactFiles    string
+	redactedDir    string
+	redactInterval time.Duration
+	alerter        *RebalanceAlerter
+	schema         *OutputSchema
+	buffer         *BufferManager
 }
 
 func (cw *WatcherConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
@@ -45,6 +59,42 @@ func (cw *WatcherConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	enc.AddString("rebalanceOutputDir", cw.rebalanceOutputDir)
 	enc.AddString("couchbaseWatchDir", cw.couchbaseWatchDir)
 	enc.AddString("tlsCertsDir", cw.tlsCertsDir)
+	enc.AddString("node", cw.node)
+
+	_ = enc.AddArray("logRoots", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, root := range cw.logRoots {
+			_ = arr.AppendObject(root)
+		}
+
+		return nil
+	}))
+
+	enc.AddBool("explode", cw.explode)
+	enc.AddString("preprocessDirs", cw.preprocessDirs)
+	enc.AddString("redaction", string(cw.redactor.Mode()))
+	enc.AddString("redactFiles", cw.redactFiles)
+	enc.AddString("redactedDir", cw.redactedDir)
+	enc.AddDuration("redactInterval", cw.redactInterval)
+
+	if cw.retention != nil {
+		_ = enc.AddObject("retention", cw.retention)
+	}
+
+	if cw.filter != nil {
+		_ = enc.AddObject("filter", cw.filter)
+	}
+
+	if cw.alerter != nil {
+		_ = enc.AddObject("alerts", cw.alerter)
+	}
+
+	if cw.schema != nil {
+		_ = enc.AddObject("schema", cw.schema)
+	}
+
+	if cw.buffer != nil {
+		_ = enc.AddObject("buffer", cw.buffer)
+	}
 
 	return nil
 }
@@ -56,12 +106,41 @@ func NewWatcherConfigFromDefaults() *WatcherConfig {
 	fluentBitBinaryPath := common.GetBinaryPath()
 	// The logs directory is required to exist
 	couchbaseLogDir := common.GetLogsDir()
+	// The log directories of multiple nodes, records are only tagged with their node if these are set
+	logRoots, err := ParseLogRoots(common.GetLogRoots())
+	if err != nil {
+		log.Fatalw("Invalid log roots", "error", err)
+	}
 	// The actual rebalance directory may not exist yet
 	couchbaseWatchDir := common.GetRebalanceReportDir()
 	// We need write access to this directory
 	rebalanceOutputDir := common.GetRebalanceOutputDir()
 	// TLS certificates directory for mTLS support (optional)
 	tlsCertsDir := common.GetTLSCertsDir()
+	// How many processed reports to keep
+	retention := NewRetentionPolicyFromDefaults()
+	// Which files in the rebalance directory to process
+	filter := NewRebalanceFilterFromDefaults()
+	// Whether to write each section of a report as a separate record
+	explode := common.GetRebalanceExplode()
+	// Any types of JSON document to wrap like the rebalance reports, they are pre-processed like any other
+	if err := RegisterJSONDocumentTypes(common.GetJSONTypes()); err != nil {
+		log.Fatalw("Invalid JSON document types", "error", err)
+	}
+	// Any other directories to pre-process
+	preprocessDirs := common.GetPreprocessDirs()
+	// Whether to redact user data in the rebalance reports
+	redactor := defaultRedactor()
+	// Any log files to mirror with redaction applied rather than leaving it to Fluent Bit
+	redactFiles := common.GetRedactFiles()
+	redactedDir := common.GetRedactedOutputDir()
+	redactInterval := common.GetDuration(DefaultMirrorInterval, common.RedactIntervalEnvVar)
+	// Where to raise alerts for failed or stuck rebalances
+	alerter := defaultAlerter()
+	// The field names and formats of the records wrapping reports
+	schema := defaultOutputSchema()
+	// Whether to keep the filesystem buffer within a cap
+	buffer := defaultBufferManager()
 
 	config := WatcherConfig{
 		fluentBitConfigDir:      fluentBitConfigDir,
@@ -71,6 +150,18 @@ func NewWatcherConfigFromDefaults() *WatcherConfig {
 		rebalanceOutputDir:      rebalanceOutputDir,
 		couchbaseWatchDir:       couchbaseWatchDir,
 		tlsCertsDir:             tlsCertsDir,
+		logRoots:                logRoots,
+		retention:               &retention,
+		filter:                  &filter,
+		explode:                 explode,
+		preprocessDirs:          preprocessDirs,
+		redactor:                redactor,
+		redactFiles:             redactFiles,
+		redactedDir:             redactedDir,
+		redactInterval:          redactInterval,
+		alerter:                 alerter,
+		schema:                  schema,
+		buffer:                  buffer,
 	}
 
 	log.Infow("Using configuration", "config", config)
@@ -98,6 +189,63 @@ func (cw *WatcherConfig) SetTLSCertsDir(value string) {
 	cw.tlsCertsDir = filepath.Clean(value)
 }
 
+// SetNode sets the node name records from the single log directory are tagged with, by default they are not tagged.
+func (cw *WatcherConfig) SetNode(value string) {
+	cw.node = value
+}
+
+// SetLogRoots sets the log directories of multiple nodes, these replace the single log directory for rebalance reports.
+func (cw *WatcherConfig) SetLogRoots(value []LogRoot) {
+	cw.logRoots = value
+}
+
+func (cw *WatcherConfig) SetRetentionPolicy(value RetentionPolicy) {
+	cw.retention = &value
+}
+
+// SetRebalanceFilter sets which files in the rebalance directory are processed.
+func (cw *WatcherConfig) SetRebalanceFilter(value FileFilter) {
+	cw.filter = &value
+}
+
+func (cw *WatcherConfig) SetExplode(value bool) {
+	cw.explode = value
+}
+
+// SetPreprocessDirs sets the extra directories to pre-process as <processor>:<watch dir>[:<output dir>],...
+func (cw *WatcherConfig) SetPreprocessDirs(value string) {
+	cw.preprocessDirs = value
+}
+
+// SetRedactor sets the redaction of user data in rebalance reports, nil disables it.
+func (cw *WatcherConfig) SetRedactor(value *Redactor) {
+	cw.redactor = value
+}
+
+// SetRedactFiles sets the log files to mirror with redaction applied as a comma-separated list of patterns.
+func (cw *WatcherConfig) SetRedactFiles(value string) {
+	cw.redactFiles = value
+}
+
+func (cw *WatcherConfig) SetRedactedDir(value string) {
+	cw.redactedDir = filepath.Clean(value)
+}
+
+// SetRebalanceAlerter raises alerts for failed or stuck rebalances, nil disables them.
+func (cw *WatcherConfig) SetRebalanceAlerter(value *RebalanceAlerter) {
+	cw.alerter = value
+}
+
+// SetOutputSchema names the fields of the records wrapping reports, nil is the default schema.
+func (cw *WatcherConfig) SetOutputSchema(value *OutputSchema) {
+	cw.schema = value
+}
+
+// SetBufferManager caps the size of the filesystem buffer, nil leaves it uncapped.
+func (cw *WatcherConfig) SetBufferManager(value *BufferManager) {
+	cw.buffer = value
+}
+
 func (cw *WatcherConfig) GetFluentBitBinaryPath() string {
 	return filepath.Clean(cw.fluentBitBinaryPath)
 }
@@ -122,6 +270,103 @@ func (cw *WatcherConfig) GetTLSCertsDir() string {
 	return filepath.Clean(cw.tlsCertsDir)
 }
 
+// GetRetentionPolicy returns the retention policy for processed files.
+// Returns the policy from the environment if one has not been set so files Fluent Bit has not read yet are kept.
+func (cw *WatcherConfig) GetRetentionPolicy() RetentionPolicy {
+	if cw.retention == nil {
+		return NewRetentionPolicyFromDefaults()
+	}
+
+	return *cw.retention
+}
+
+// GetRebalanceFilter returns which files in the rebalance directory are processed.
+// Returns the default filter if one has not been set.
+func (cw *WatcherConfig) GetRebalanceFilter() FileFilter {
+	if cw.filter == nil {
+		return DefaultRebalanceFilter()
+	}
+
+	return *cw.filter
+}
+
+// getCouchbaseWatchDir returns the rebalance report directory, defaulting to the one in the log directory.
+func (cw *WatcherConfig) getCouchbaseWatchDir() string {
+	if cw.couchbaseWatchDir == "" {
+		return filepath.Join(filepath.Clean(cw.couchbaseLogDir), "rebalance")
+	}
+
+	return filepath.Clean(cw.couchbaseWatchDir)
+}
+
+// rebalanceDirectory returns the watched directory for the rebalance reports of a single node.
+func (cw *WatcherConfig) rebalanceDirectory(watchDir, outputDir, node string) WatchedDirectory {
+	processor := &RebalancePreprocessor{Explode: cw.explode, Redactor: cw.redactor, Alerter: cw.alerter, Schema: cw.schema, Node: node}
+
+	return NewWatchedDirectory(watchDir, outputDir, processor, cw.GetRetentionPolicy()).WithFilter(cw.GetRebalanceFilter())
+}
+
+// RebalanceDirectory returns the watched directory for rebalance reports from the single log directory.
+func (cw *WatcherConfig) RebalanceDirectory() WatchedDirectory {
+	return cw.rebalanceDirectory(cw.getCouchbaseWatchDir(), cw.rebalanceOutputDir, cw.node)
+}
+
+// RebalanceDirectories returns the watched directories for rebalance reports from every log root.
+// Each root has its own output sub-directory named after the node, with a single log directory the output directory is used as is.
+func (cw *WatcherConfig) RebalanceDirectories() []WatchedDirectory {
+	if len(cw.logRoots) == 0 {
+		return []WatchedDirectory{cw.RebalanceDirectory()}
+	}
+
+	directories := make([]WatchedDirectory, 0, len(cw.logRoots))
+	for _, root := range cw.logRoots {
+		directories = append(directories, cw.rebalanceDirectory(root.RebalanceDir(), filepath.Join(cw.rebalanceOutputDir, root.Node), root.Node))
+	}
+
+	return directories
+}
+
+// WatchedDirectories returns every directory to pre-process, the rebalance reports are always first.
+func (cw *WatcherConfig) WatchedDirectories() ([]WatchedDirectory, error) {
+	extra, err := ParseWatchedDirectories(cw.preprocessDirs, filepath.Clean(cw.couchbaseLogDir), cw.GetRetentionPolicy())
+	if err != nil {
+		return nil, err
+	}
+
+	directories := append(cw.RebalanceDirectories(), extra...)
+
+	if err := checkOutputDirs(directories, cw.otherOutputDirs()...); err != nil {
+		return nil, err
+	}
+
+	return directories, nil
+}
+
+// otherOutputDirs returns the output directories not used by a watched directory, i.e. for alerts and redacted mirrors.
+func (cw *WatcherConfig) otherOutputDirs() []string {
+	var dirs []string
+
+	if cw.alerter != nil {
+		dirs = append(dirs, cw.alerter.GetOutputDir())
+	}
+
+	if len(ParsePatterns(cw.redactFiles)) > 0 {
+		dirs = append(dirs, cw.redactedDir)
+	}
+
+	return dirs
+}
+
+// RedactedMirror returns the mirror of redacted log files, nil if none are configured.
+func (cw *WatcherConfig) RedactedMirror() (*RedactedMirror, error) {
+	patterns := ParsePatterns(cw.redactFiles)
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	return NewRedactedMirror(filepath.Clean(cw.couchbaseLogDir), cw.redactedDir, patterns, cw.redactor, cw.redactInterval)
+}
+
 const rebalanceDirPermissions fs.FileMode = 0700
 
 func (cw *WatcherConfig) CreateRebalanceDir() error {
@@ -133,3 +378,39 @@ func (cw *WatcherConfig) CreateRebalanceDir() error {
 
 	return nil
 }
+
+// Close waits for anything still in progress in the background, i.e. rebalance alerts being raised.
+func (cw *WatcherConfig) Close() error {
+	if cw.alerter == nil {
+		return nil
+	}
+
+	return cw.alerter.Close()
+}
+
+// CreateOutputDirs creates the output directory for every watched directory.
+func (cw *WatcherConfig) CreateOutputDirs() error {
+	directories, err := cw.WatchedDirectories()
+	if err != nil {
+		return err
+	}
+
+	for _, wd := range directories {
+		if err := wd.CreateOutputDir(); err != nil {
+			return err
+		}
+	}
+
+	if cw.alerter != nil {
+		if err := cw.alerter.CreateOutputDir(); err != nil {
+			return err
+		}
+	}
+
+	mirror, err := cw.RedactedMirror()
+	if err != nil || mirror == nil {
+		return err
+	}
+
+	return mirror.CreateOutputDir()
+}
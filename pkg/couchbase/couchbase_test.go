@@ -17,13 +17,30 @@
 package couchbase_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/couchbase/fluent-bit/pkg/couchbase"
+	"github.com/klauspost/compress/zstd"
+	"github.com/oklog/run"
 )
 
 func createTestFilesByTimestamp(t *testing.T, dir string) {
@@ -105,6 +122,89 @@ func TestRemoveOldestFilesWithNestedDirs(t *testing.T) {
 	}
 }
 
+func createTestFilesWithAge(t *testing.T, dir string, count, size int, age time.Duration) {
+	t.Helper()
+
+	modTime := time.Now().Add(-age)
+
+	for i := range count {
+		filename := filepath.Join(dir, "aged_file_"+strconv.Itoa(i))
+		if err := os.WriteFile(filename, make([]byte, size), 0600); err != nil {
+			t.Fatal(err, i)
+		}
+
+		// Make sure each file is older than the next
+		fileTime := modTime.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(filename, fileTime, fileTime); err != nil {
+			t.Fatal(err, i)
+		}
+	}
+}
+
+func TestRetentionPolicyMaxBytes(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "retention_bytes_test")
+	defer os.RemoveAll(dir)
+
+	createTestFilesWithAge(t, dir, 10, 100, time.Hour)
+
+	policy := couchbase.RetentionPolicy{MaxBytes: 450}
+	if err := policy.Apply(dir); err != nil {
+		t.Fatal(err, dir)
+	}
+
+	if countFilesInDirectory(t, dir) != 4 {
+		t.Errorf("Invalid number of files: %d != %d", countFilesInDirectory(t, dir), 4)
+	}
+
+	// Check the newest were kept
+	if _, err := os.Stat(filepath.Join(dir, "aged_file_9")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRetentionPolicyMaxAge(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "retention_age_test")
+	defer os.RemoveAll(dir)
+
+	createTestFilesWithAge(t, dir, 3, 1, 48*time.Hour)
+
+	if err := os.WriteFile(filepath.Join(dir, "new_file"), []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := couchbase.RetentionPolicy{MaxAge: 24 * time.Hour}
+	if err := policy.Apply(dir); err != nil {
+		t.Fatal(err, dir)
+	}
+
+	if countFilesInDirectory(t, dir) != 1 {
+		t.Errorf("Invalid number of files: %d != %d", countFilesInDirectory(t, dir), 1)
+	}
+}
+
+func TestRetentionPolicyMinAge(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "retention_min_age_test")
+	defer os.RemoveAll(dir)
+
+	// Too many files but none of them old enough to have been read
+	createTestFilesWithAge(t, dir, couchbase.MaxCBFiles*2, 1, 0)
+
+	policy := couchbase.RetentionPolicy{MaxFiles: couchbase.MaxCBFiles, MinAge: time.Hour}
+	if err := policy.Apply(dir); err != nil {
+		t.Fatal(err, dir)
+	}
+
+	if countFilesInDirectory(t, dir) != couchbase.MaxCBFiles*2 {
+		t.Errorf("Invalid number of files: %d != %d", countFilesInDirectory(t, dir), couchbase.MaxCBFiles*2)
+	}
+}
+
 func TestProcessFile(t *testing.T) {
 	t.Parallel()
 
@@ -136,42 +236,1738 @@ func TestProcessFile(t *testing.T) {
 		t.Error("Mismatch in input vs output", len(files), len(outputFiles))
 	}
 }
-func TestProcessExisting(t *testing.T) {
+
+// readRecords checks every line of every file in the directory is a JSON record and returns them.
+func readRecords(t *testing.T, dir string) []map[string]any {
+	t.Helper()
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err, dir)
+	}
+
+	var records []map[string]any
+
+	for _, f := range files {
+		// Hidden files are state or still being written rather than published
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		file, err := os.Open(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err, f.Name())
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+
+		for scanner.Scan() {
+			var record map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatal(err, f.Name())
+			}
+
+			records = append(records, record)
+		}
+
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err, f.Name())
+		}
+	}
+
+	return records
+}
+
+func TestProcessFileEnvelope(t *testing.T) {
 	t.Parallel()
 
-	// This is mostly as above but using the input directories directly
-	dir := createRebalanceTestDir(t, "", "process_existing_test")
+	dir := createRebalanceTestDir(t, "", "process_file_envelope_test")
 	defer os.RemoveAll(dir)
 
-	// Iterate over each test file to check
-	inputDir := filepath.Clean("../../test/logs/rebalance")
+	filename := filepath.Clean("../../test/logs/rebalance/rebalance_report_2021-03-09T20:23:16Z.json")
+	if err := couchbase.ProcessFile(filename, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, dir)
+	if len(records) != 1 {
+		t.Fatalf("Invalid number of records: %d != 1", len(records))
+	}
+
+	if records[0]["timestamp"] != "2021-03-09T20:23:16Z" {
+		t.Errorf("Invalid timestamp: %v", records[0]["timestamp"])
+	}
+
+	contents, _ := records[0]["reportContents"].(map[string]any)
+	if contents["rebalanceId"] != "15a4b703cb334569b6884028a7f61144" {
+		t.Errorf("Invalid report contents: %v", contents)
+	}
+}
+
+func TestProcessFileExploded(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "process_file_exploded_test")
+	defer os.RemoveAll(dir)
 
 	config := couchbase.WatcherConfig{}
 	config.SetRebalanceOutputDir(dir)
-	config.SetCouchbaseWatchDir(inputDir)
+	config.SetCouchbaseWatchDir("../../test/logs/rebalance")
+	config.SetExplode(true)
 
 	if err := couchbase.ProcessExisting(config); err != nil {
 		t.Fatal(err)
 	}
+
+	sections := map[string]map[string]any{}
+
+	for _, record := range readRecords(t, dir) {
+		section, _ := record["section"].(string)
+		contents, _ := record["reportContents"].(map[string]any)
+
+		if record["reportName"] == "../../test/logs/rebalance/rebalance_report_2021-03-09T20:24:32Z.json" {
+			sections[section] = contents
+		}
+	}
+
+	if sections["$"]["rebalanceId"] == nil {
+		t.Errorf("Missing top level fields: %v", sections["$"])
+	}
+
+	if sections["$.stageInfo.data"]["timeTaken"] == nil {
+		t.Errorf("Missing stage fields: %v", sections["$.stageInfo.data"])
+	}
+
+	if nodes, _ := sections["$.nodesInfo"]["active_nodes"].([]any); len(nodes) != 3 {
+		t.Errorf("Invalid active nodes: %v", sections["$.nodesInfo"])
+	}
+
+	// Each vbucket move should be its own record
+	if sections["$.stageInfo.data.details.default.vbucketLevelInfo.vbucketInfo[0]"]["id"] == nil {
+		t.Error("Missing vbucket section")
+	}
 }
 
-func TestCreateWatchers(t *testing.T) {
+func TestReportSummary(t *testing.T) {
 	t.Parallel()
 
-	couchbaseLogDir := "../../test/logs"
+	dir := createRebalanceTestDir(t, "", "report_summary_test")
+	defer os.RemoveAll(dir)
 
-	rebalanceOutputDir := createRebalanceTestDir(t, "", "create_watchers_test")
-	defer os.RemoveAll(rebalanceOutputDir)
+	if err := couchbase.ProcessFile("../../test/logs/rebalance/rebalance_report_2021-03-09T20:24:32Z.json", dir); err != nil {
+		t.Fatal(err)
+	}
 
-	fluentBitConfigDir := createRebalanceTestDir(t, "", "fluent-bit-config")
-	defer os.RemoveAll(fluentBitConfigDir)
+	records := readRecords(t, dir)
+	if len(records) != 1 {
+		t.Fatalf("Invalid number of records: %d != 1", len(records))
+	}
+
+	summary, _ := records[0]["summary"].(map[string]any)
+	expected := map[string]any{
+		"status":                "completed",
+		"durationMs":            float64(49772),
+		"slowestStage":          "data",
+		"slowestStageTimeTaken": float64(39806),
+		"nodeCount":             float64(3),
+		"startTime":             "2021-03-09T20:23:42.716Z",
+		"completedTime":         "2021-03-09T20:24:32.488Z",
+	}
+
+	for key, value := range expected {
+		if summary[key] != value {
+			t.Errorf("Invalid summary %q: %v != %v", key, summary[key], value)
+		}
+	}
+
+	if services, _ := summary["serviceTimeTaken"].(map[string]any); len(services) != 6 || services["analytics"] != float64(8377) {
+		t.Errorf("Invalid service times: %v", summary["serviceTimeTaken"])
+	}
+
+	if records[0]["reportContents"] == nil {
+		t.Error("Missing report contents")
+	}
+
+	testCases := []struct {
+		name   string
+		report string
+		status string
+		nodes  int
+	}{
+		{
+			name:   "Failed",
+			report: `{"completionMessage": "Rebalance exited with reason {badmatch,failed}", "stageInfo": {"data": {"perNodeProgress": {"ns_1@a": 0.5, "ns_1@b": 1}}}}`,
+			status: "failed",
+			nodes:  2,
+		},
+		{
+			name:   "Stopped",
+			report: `{"completionMessage": "Rebalance stopped by user.", "nodesInfo": {"active_nodes": ["ns_1@a"], "eject_nodes": ["ns_1@a"]}}`,
+			status: "stopped",
+			nodes:  1,
+		},
+		{
+			name:   "NoMessage",
+			report: `{}`,
+			status: "unknown",
+		},
+	}
+
+	for _, testCase := range testCases {
+		// Exploded reports have the summary as the last record
+		processor := couchbase.RebalancePreprocessor{Explode: true}
+
+		var out strings.Builder
+		if err := processor.Transform(&out, strings.NewReader(testCase.report), "rebalance_report_now.json"); err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+		var record struct {
+			Section string
+			Summary map[string]any
+		}
+
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+
+		if record.Section != "summary" || record.Summary["status"] != testCase.status || record.Summary["nodeCount"] != float64(testCase.nodes) {
+			t.Errorf("%s: invalid summary record %v", testCase.name, record)
+		}
+	}
+}
+
+func TestRebalanceAlerts(t *testing.T) {
+	t.Parallel()
+
+	if _, err := couchbase.NewRebalanceAlerter("", "ftp://example.com", couchbase.RetentionPolicy{}); !errors.Is(err, couchbase.ErrInvalidWebhook) {
+		t.Errorf("Expected invalid webhook error: %v", err)
+	}
+
+	posted := make(chan map[string]any, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+
+		posted <- alert
+	}))
+	defer server.Close()
+
+	dir := createRebalanceTestDir(t, "", "rebalance_alerts_test")
+	defer os.RemoveAll(dir)
+
+	alerter, err := couchbase.NewRebalanceAlerter(dir, server.URL, couchbase.AlertRetentionPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processor := couchbase.RebalancePreprocessor{Alerter: alerter, Node: "node1"}
+
+	reports := []string{
+		// Successful so no alert
+		string(readFile(t, "../../test/logs/rebalance/rebalance_report_2021-03-09T20:24:32Z.json")),
+		`{"completionMessage": "Rebalance exited with reason stop", "stageInfo": {"data": {"totalProgress": 100}}}`,
+		`{"completionMessage": "Rebalance completed successfully.", "stageInfo": {"data": {"totalProgress": 42.5}, "index": {"totalProgress": 100}}}`,
+		`{"completionMessage": "Rebalance completed successfully.", "stageInfo": {"index": {"details": {"errorMessage": "index build timed out"}}}}`,
+	}
+
+	const filename = "rebalance_report_2021-03-09T20:24:32Z.json"
+
+	// Alerts are only raised once the report is published, a report that is never published raises nothing
+	var unpublished strings.Builder
+	if err := processor.Transform(&unpublished, strings.NewReader(reports[1]), filename); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, report := range reports {
+		var out strings.Builder
+		if err := processor.Transform(&out, strings.NewReader(report), filename); err != nil {
+			t.Fatal(err)
+		}
+
+		processor.Published(filename)
+	}
+
+	// Alerts are raised in the background so wait for them
+	if err := alerter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "rebalance-alert-*.json"))
+	if err != nil || len(files) != 3 {
+		t.Fatalf("Invalid alert files: %v %v", files, err)
+	}
+
+	expectedReasons := []string{
+		"rebalance failed: Rebalance exited with reason stop",
+		"stages did not reach 100% progress: data",
+		"error reported: $.stageInfo.index.details.errorMessage: index build timed out",
+	}
+
+	for _, expected := range expectedReasons {
+		alert := <-posted
+
+		reasons, _ := alert["reasons"].([]any)
+		if alert["level"] != "ERROR" || alert["node"] != "node1" || len(reasons) != 1 || reasons[0] != expected {
+			t.Errorf("Invalid alert, expected %q: %v", expected, alert)
+		}
+	}
+
+	for _, file := range files {
+		var alert map[string]any
+		if err := json.Unmarshal(readFile(t, file), &alert); err != nil || alert["level"] != "ERROR" {
+			t.Errorf("Invalid alert file %q: %v", file, err)
+		}
+	}
+
+	// Processing a file raises the alert once the report has been published
+	watchDir := createRebalanceTestDir(t, "", "rebalance_alerts_watch_test")
+	defer os.RemoveAll(watchDir)
+
+	outputDir := createRebalanceTestDir(t, "", "rebalance_alerts_output_test")
+	defer os.RemoveAll(outputDir)
+
+	if err := os.WriteFile(filepath.Join(watchDir, filename), []byte(reports[1]), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	alertDir := filepath.Join(dir, "processed")
+
+	processed, err := couchbase.NewRebalanceAlerter(alertDir, "", couchbase.RetentionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := couchbase.NewWatchedDirectory(watchDir, outputDir, &couchbase.RebalancePreprocessor{Alerter: processed}, couchbase.RetentionPolicy{})
+	if err := wd.ProcessFile(filepath.Join(watchDir, filename)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countFilesInDirectory(t, alertDir); count != 1 {
+		t.Errorf("Invalid number of alerts for a processed file: %d != 1", count)
+	}
+}
+
+func TestJSONDocuments(t *testing.T) {
+	t.Parallel()
+
+	logDir := createRebalanceTestDir(t, "", "json_documents_logs_test")
+	defer os.RemoveAll(logDir)
+
+	outputDir := createRebalanceTestDir(t, "", "json_documents_output_test")
+	defer os.RemoveAll(outputDir)
+
+	if err := os.Mkdir(filepath.Join(logDir, "events"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Multi-line, concatenated and NDJSON documents with string and epoch timestamps
+	contents := `{
+  "meta": {"time": "2021-03-09T20:24:32Z"},
+  "message": "<ud>first</ud>"
+}
+{"meta": {"time": 1615321472.5}, "items": [1, 2.50, {"a": null}]}{"meta": {"time": 1615321472500}}
+[{"no": "timestamp"}]
+`
+	if err := os.WriteFile(filepath.Join(logDir, "events", "events.json"), []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(logDir, "events", "events.txt"), []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each type is a preprocessor configured like any other
+	if err := couchbase.RegisterJSONDocumentTypes("events=$.meta.time, diag"); err != nil {
+		t.Fatal(err)
+	}
 
 	config := couchbase.WatcherConfig{}
-	config.SetFluentBitConfigDir(fluentBitConfigDir)
-	config.SetCouchbaseLogDir(couchbaseLogDir)
-	config.SetRebalanceOutputDir(rebalanceOutputDir)
+	config.SetCouchbaseLogDir(logDir)
+	config.SetRetentionPolicy(couchbase.RetentionPolicy{})
+	config.SetPreprocessDirs("events:events:" + outputDir)
 
-	if _, err := couchbase.CreateWatchers(config); err != nil {
+	directories, err := config.WatchedDirectories()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rebalance reports are always first
+	if len(directories) != 2 {
+		t.Fatalf("Invalid number of watched directories: %d != 2", len(directories))
+	}
+
+	if err := directories[1].ProcessExisting(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, outputDir)
+	if len(records) != 4 {
+		t.Fatalf("Invalid number of records: %d != 4", len(records))
+	}
+
+	expectedTimestamps := []string{"2021-03-09T20:24:32Z", "2021-03-09T20:24:32.5Z", "2021-03-09T20:24:32.5Z"}
+	for i, expected := range expectedTimestamps {
+		if records[i]["timestamp"] != expected {
+			t.Errorf("Invalid timestamp for record %d: %v != %v", i, records[i]["timestamp"], expected)
+		}
+	}
+
+	for _, record := range records {
+		if record["documentType"] != "events" || record["reportContents"] == nil {
+			t.Errorf("Invalid record: %v", record)
+		}
+	}
+
+	if contents, _ := records[0]["reportContents"].(map[string]any); contents["message"] != "<ud>first</ud>" {
+		t.Errorf("Invalid contents: %v", records[0]["reportContents"])
+	}
+
+	if items, _ := records[1]["reportContents"].(map[string]any)["items"].([]any); len(items) != 3 || items[1] != 2.5 {
+		t.Errorf("Invalid contents: %v", records[1]["reportContents"])
+	}
+
+	invalid := []string{
+		"=$.time",
+		"../other",
+		"events",
+		"rebalance",
+		"other=$.a[x]",
+		"other, other",
+	}
+
+	for _, value := range invalid {
+		if err := couchbase.RegisterJSONDocumentTypes(value); err == nil {
+			t.Errorf("Expected error registering %q", value)
+		}
+	}
+
+	// Sharing an output directory means each retention policy removes the other's files
+	collisions := []string{
+		"diag:diag:" + outputDir + ", events:events:" + outputDir,
+		"events:events:" + filepath.Join(logDir, "events"),
+		"events:events:" + filepath.Join(logDir, "rebalance-logs"),
+	}
+
+	for _, value := range collisions {
+		config := couchbase.WatcherConfig{}
+		config.SetCouchbaseLogDir(logDir)
+		config.SetRebalanceOutputDir(filepath.Join(logDir, "rebalance-logs"))
+		config.SetPreprocessDirs(value)
+
+		if _, err := config.WatchedDirectories(); !errors.Is(err, couchbase.ErrInvalidWatchedDirectory) {
+			t.Errorf("Expected invalid watched directory error for %q: %v", value, err)
+		}
+	}
+}
+
+func TestOutputSchema(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("TEST_POD_NAMESPACE", "default")
+
+	schema, err := couchbase.NewOutputSchema("timestamp=@timestamp, reportName=file.name, reportContents=rebalance", "epoch", "base",
+		"k8s.namespace=TEST_POD_NAMESPACE, missing=TEST_NOT_SET")
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	report := `{"completionMessage": "Rebalance completed successfully."}`
+	filename := "/logs/rebalance/rebalance_report_2021-03-09T20:24:32.5Z.json"
+
+	for _, explode := range []bool{false, true} {
+		processor := couchbase.RebalancePreprocessor{Explode: explode, Schema: schema}
+
+		var out strings.Builder
+		if err := processor.Transform(&out, strings.NewReader(report), filename); err != nil {
+			t.Fatal(err)
+		}
+
+		var record map[string]any
+		if err := json.Unmarshal([]byte(strings.Split(out.String(), "\n")[0]), &record); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]any{
+			"@timestamp":    1615321472.5,
+			"file.name":     "rebalance_report_2021-03-09T20:24:32.5Z.json",
+			"k8s.namespace": "default",
+		}
+
+		for key, value := range expected {
+			if record[key] != value {
+				t.Errorf("Invalid %q: %v != %v in %v", key, record[key], value, record)
+			}
+		}
+
+		for _, key := range []string{"timestamp", "reportName", "reportContents", "missing"} {
+			if _, found := record[key]; found {
+				t.Errorf("Unexpected %q in %v", key, record)
+			}
+		}
+
+		if record["rebalance"] == nil {
+			t.Errorf("Missing contents: %v", record)
+		}
+	}
+
+	millis, err := couchbase.NewOutputSchema("", "epoch_millis", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processor := couchbase.JSONDocumentPreprocessor{Type: "events", TimestampPath: []string{"time"}, Schema: millis}
+
+	var out strings.Builder
+	if err := processor.Transform(&out, strings.NewReader(`{"time": "2021-03-09T20:24:32.5Z"}`), "events.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"timestamp":1615321472500`) {
+		t.Errorf("Invalid epoch milliseconds timestamp: %s", out.String())
+	}
+
+	// A timestamp that is not RFC3339 uses the file time so the field is always a number
+	source := filepath.Join(t.TempDir(), "events.json")
+	if err := os.WriteFile(source, []byte(`{"time": "yesterday"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.UnixMilli(1615321472500)
+	if err := os.Chtimes(source, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+
+	if err := processor.Transform(&out, strings.NewReader(`{"time": "yesterday"}`), source); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out.String(), `"timestamp":1615321472500`) {
+		t.Errorf("Invalid fallback epoch milliseconds timestamp: %s", out.String())
+	}
+
+	invalid := [][]string{
+		{"unknown=name", "", "", ""},
+		{"timestamp", "", "", ""},
+		{"timestamp=node", "", "", ""},
+		{"", "unix", "", ""},
+		{"", "", "short", ""},
+		{"", "", "", "node=TEST_POD_NAMESPACE"},
+		{"", "", "", "TEST_POD_NAMESPACE"},
+	}
+
+	for _, options := range invalid {
+		if _, err := couchbase.NewOutputSchema(options[0], options[1], options[2], options[3]); !errors.Is(err, couchbase.ErrInvalidOutputSchema) {
+			t.Errorf("Expected invalid schema error for %v: %v", options, err)
+		}
+	}
+}
+
+func TestProcessFilePublishedAtomically(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "process_file_atomic_test")
+	defer os.RemoveAll(dir)
+
+	if err := couchbase.ProcessFile("../../test/logs/rebalance/rebalance_report_2021-03-09T20:23:16Z.json", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file we fail to explode part way through, e.g. JSON lines, should leave nothing behind
+	config := couchbase.WatcherConfig{}
+	config.SetRebalanceOutputDir(dir)
+	config.SetCouchbaseWatchDir("../../test/logs")
+	config.SetRebalanceFilter(couchbase.FileFilter{Include: []string{"*"}})
+	config.SetExplode(true)
+
+	if err := couchbase.ProcessExisting(config); err == nil {
+		t.Error("Expected an error exploding a non-JSON file")
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err, dir)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("Invalid number of files: %d != 1", len(files))
+	}
+
+	for _, f := range files {
+		if matched, _ := filepath.Match("rebalance-processed-*.json", f.Name()); !matched {
+			t.Errorf("Unexpected file: %q", f.Name())
+		}
+	}
+}
+
+func TestProcessFileCompressed(t *testing.T) {
+	t.Parallel()
+
+	watchDir := createRebalanceTestDir(t, "", "process_file_compressed_watch_test")
+	defer os.RemoveAll(watchDir)
+
+	dir := createRebalanceTestDir(t, "", "process_file_compressed_test")
+	defer os.RemoveAll(dir)
+
+	report := readFile(t, "../../test/logs/rebalance/rebalance_report_2021-03-09T20:23:16Z.json")
+
+	var gzipped bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzipWriter.Write(report)
+	_ = gzipWriter.Close()
+
+	zstdWriter, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		// Detection is by contents, not the name
+		"rebalance_report_2021-03-09T20:23:16Z.json.gz": gzipped.Bytes(),
+		"rebalance_report_2021-03-09T20:23:17Z.json.1":  zstdWriter.EncodeAll(report, nil),
+		"notes.txt": []byte("not a report"),
+	}
+
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(watchDir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(watchDir, "nested"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	config := couchbase.WatcherConfig{}
+	config.SetRebalanceOutputDir(dir)
+	config.SetCouchbaseWatchDir(watchDir)
+
+	if err := couchbase.ProcessExisting(config); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, dir)
+	if len(records) != 2 {
+		t.Fatalf("Invalid number of records: %d != 2", len(records))
+	}
+
+	for _, record := range records {
+		contents, _ := record["reportContents"].(map[string]any)
+		if contents["rebalanceId"] != "15a4b703cb334569b6884028a7f61144" {
+			t.Errorf("Invalid report contents: %v", contents)
+		}
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	t.Parallel()
+
+	watchDir := createRebalanceTestDir(t, "", "file_filter_watch_test")
+	defer os.RemoveAll(watchDir)
+
+	dir := createRebalanceTestDir(t, "", "file_filter_test")
+	defer os.RemoveAll(dir)
+
+	report := readFile(t, "../../test/logs/rebalance/rebalance_report_2021-03-09T20:23:16Z.json")
+
+	for _, name := range []string{
+		"rebalance_report_2021-03-09T20:23:16Z.json",
+		"rebalance_report_2021-03-09T20:23:17Z.json",
+		".rebalance_report_2021-03-09T20:23:18Z.json.swp",
+		"rebalance_report_2021-03-09T20:23:19Z.json~",
+		"other.json",
+	} {
+		if err := os.WriteFile(filepath.Join(watchDir, name), report, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(watchDir, "rebalance_report_dir.json"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening a FIFO blocks until something writes to it
+	if err := syscall.Mkfifo(filepath.Join(watchDir, "rebalance_report_fifo.json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := couchbase.NewFileFilter(couchbase.DefaultRebalanceInclude, "*17Z.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := couchbase.NewWatchedDirectory(watchDir, dir, &couchbase.RebalancePreprocessor{}, couchbase.DefaultRetentionPolicy()).WithFilter(filter)
+	if err := wd.ProcessExisting(); err != nil {
+		t.Fatal(err)
+	}
+
+	if records := readRecords(t, dir); len(records) != 1 {
+		t.Errorf("Invalid number of records: %d != 1", len(records))
+	}
+
+	expected := map[string]int64{"directory": 1, "notRegular": 1, "hidden": 1, "excluded": 1, "notIncluded": 2}
+	if skipped := wd.SkippedFiles(); !reflect.DeepEqual(skipped, expected) {
+		t.Errorf("Invalid skipped files: %v != %v", skipped, expected)
+	}
+
+	if _, err := couchbase.NewFileFilter("[", ""); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestCreateOutputDirRemovesPendingFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "pending_files_test")
+	defer os.RemoveAll(dir)
+
+	names := []string{
+		".rebalance-processed-123.json.tmp",
+		"rebalance-processed-456.json",
+		".other-123.json.tmp",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd := couchbase.NewWatchedDirectory(dir, dir, &couchbase.RebalancePreprocessor{}, couchbase.DefaultRetentionPolicy())
+	if err := wd.CreateOutputDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, names[0])); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the pending file to be removed: %v", err)
+	}
+
+	for _, name := range names[1:] {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestLogRoots(t *testing.T) {
+	t.Parallel()
+
+	secondRoot := createRebalanceTestDir(t, "", "log_roots_second_test")
+	defer os.RemoveAll(secondRoot)
+
+	if err := os.Mkdir(filepath.Join(secondRoot, "rebalance"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	report := readFile(t, "../../test/logs/rebalance/rebalance_report_2021-03-09T20:23:16Z.json")
+	if err := os.WriteFile(filepath.Join(secondRoot, "rebalance", "rebalance_report_2021-03-09T20:23:16Z.json"), report, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := createRebalanceTestDir(t, "", "log_roots_test")
+	defer os.RemoveAll(dir)
+
+	roots, err := couchbase.ParseLogRoots("ns_1@node1=../../test/logs, " + secondRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := couchbase.WatcherConfig{}
+	config.SetRebalanceOutputDir(dir)
+	config.SetLogRoots(roots)
+	config.SetRetentionPolicy(couchbase.RetentionPolicy{})
+
+	for _, explode := range []bool{false, true} {
+		config.SetExplode(explode)
+
+		if err := config.CreateOutputDirs(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := couchbase.ProcessExisting(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]int{"ns_1@node1": 3, filepath.Base(secondRoot): 1}
+	for node, reports := range expected {
+		outputDir := filepath.Join(dir, node)
+
+		if count := countFilesInDirectory(t, outputDir); count != 2*reports {
+			t.Errorf("Invalid number of files for %q: %d != %d", node, count, 2*reports)
+		}
+
+		for _, record := range readRecords(t, outputDir) {
+			if record["node"] != node {
+				t.Errorf("Invalid node: %v != %q", record["node"], node)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"a=/logs,a=/other", "../bad=/logs", "/one/logs,/two/logs"} {
+		if _, err := couchbase.ParseLogRoots(invalid); !errors.Is(err, couchbase.ErrInvalidLogRoot) {
+			t.Errorf("Expected invalid log root error for %q: %v", invalid, err)
+		}
+	}
+}
+
+func TestProcessExisting(t *testing.T) {
+	t.Parallel()
+
+	// This is mostly as above but using the input directories directly
+	dir := createRebalanceTestDir(t, "", "process_existing_test")
+	defer os.RemoveAll(dir)
+
+	// Iterate over each test file to check
+	inputDir := filepath.Clean("../../test/logs/rebalance")
+
+	config := couchbase.WatcherConfig{}
+	config.SetRebalanceOutputDir(dir)
+	config.SetCouchbaseWatchDir(inputDir)
+
+	if err := couchbase.ProcessExisting(config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upperPreprocessor is a simple preprocessor to check the framework with.
+type upperPreprocessor struct{}
+
+func (up *upperPreprocessor) Name() string {
+	return "upper"
+}
+
+func (up *upperPreprocessor) Match(filename string) bool {
+	return strings.HasSuffix(filename, ".example")
+}
+
+func (up *upperPreprocessor) OutputPattern() string {
+	return "upper-*.log"
+}
+
+func (up *upperPreprocessor) Transform(out io.Writer, source io.Reader, _ string) error {
+	contents, err := io.ReadAll(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write([]byte(strings.ToUpper(string(contents))))
+
+	return err
+}
+
+func TestPreprocessorRegistry(t *testing.T) {
+	t.Parallel()
+
+	couchbase.RegisterPreprocessor("upper", func() couchbase.Preprocessor { return &upperPreprocessor{} })
+
+	if _, err := couchbase.NewPreprocessor("i-do-not-exist"); !errors.Is(err, couchbase.ErrUnknownPreprocessor) {
+		t.Errorf("Expected unknown preprocessor error: %v", err)
+	}
+
+	dir := createRebalanceTestDir(t, "", "preprocessor_registry_test")
+	defer os.RemoveAll(dir)
+
+	directories, err := couchbase.ParseWatchedDirectories("upper:.:"+dir+", rebalance:rebalance", "../../test/logs", couchbase.DefaultRetentionPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(directories) != 2 {
+		t.Fatalf("Invalid number of directories: %d != 2", len(directories))
+	}
+
+	if directories[1].GetWatchDir() != "../../test/logs/rebalance" {
+		t.Errorf("Invalid relative watch directory: %q", directories[1].GetWatchDir())
+	}
+
+	if err := directories[0].ProcessExisting(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the single matching file should be processed
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err, dir)
+	}
+
+	if len(files) != 1 || !strings.HasPrefix(files[0].Name(), "upper-") || !strings.HasSuffix(files[0].Name(), ".log") {
+		t.Fatalf("Invalid output files: %v", files)
+	}
+
+	if _, err := couchbase.ParseWatchedDirectories("upper", "", couchbase.DefaultRetentionPolicy()); !errors.Is(err, couchbase.ErrInvalidWatchedDirectory) {
+		t.Errorf("Expected invalid watched directory error: %v", err)
+	}
+}
+
+func TestParseErlangTerm(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: `[{a,1},{b,"two"},{c,[1,2]}]`, expected: `{"a":1,"b":"two","c":[1,2]}`},
+		{input: `{a,-1.5,true,false}`, expected: `["a",-1.5,true,false]`},
+		{input: `[{'quoted atom',<<"bin">>},{pid,<0.378.0>},{b,<<1,2>>}]`, expected: `{"b":[1,2],"pid":"<0.378.0>","quoted atom":"bin"}`},
+		{input: `[a,{b,1}]`, expected: `{"a":true,"b":1}`},
+		{input: `[kv,index]`, expected: `["kv","index"]`},
+		{input: `[]`, expected: `[]`},
+	}
+
+	for _, test := range tests {
+		term, err := couchbase.ParseErlangTerm(test.input)
+		if err != nil {
+			t.Fatalf("Unable to parse %q: %v", test.input, err)
+		}
+
+		var actual strings.Builder
+
+		encoder := json.NewEncoder(&actual)
+		encoder.SetEscapeHTML(false)
+
+		if err := encoder.Encode(term); err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.TrimSpace(actual.String()) != test.expected {
+			t.Errorf("Invalid conversion of %q: %s != %s", test.input, actual.String(), test.expected)
+		}
+	}
+
+	for _, input := range []string{`[{a,1}`, `{a,}`, `[1] trailing`} {
+		if _, err := couchbase.ParseErlangTerm(input); !errors.Is(err, couchbase.ErrInvalidErlangTerm) {
+			t.Errorf("Expected invalid term error for %q: %v", input, err)
+		}
+	}
+}
+
+func TestStatsPreprocessor(t *testing.T) {
+	t.Parallel()
+
+	processor, err := couchbase.NewPreprocessor(couchbase.StatsPreprocessorName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for filename, expected := range map[string]bool{
+		"/opt/couchbase/var/lib/couchbase/logs/stats.log.1": true,
+		"/opt/couchbase/var/lib/couchbase/logs/stats.log":   true,
+		"stats.log.old":  false,
+		"ns_server.log":  false,
+		"stats.log.1.gz": false,
+	} {
+		if processor.Match(filename) != expected {
+			t.Errorf("Invalid match of %q, expected %v", filename, expected)
+		}
+	}
+
+	source, err := os.Open("../../test/logs/stats.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	// As a rotated log every entry is complete, a record per entry with a status dump being a single record of every node
+	var out strings.Builder
+	if err := processor.Transform(&out, source, "stats.log.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := string(readFile(t, "../../test/logs/stats.log.expected")); out.String() != expected {
+		t.Errorf("Invalid records:\n%s\nExpected:\n%s", out.String(), expected)
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal([]byte(strings.SplitN(out.String(), "\n", 2)[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, ok := record["nodes"].([]any)
+	if !ok || len(nodes) != 1 {
+		t.Fatalf("Invalid status record: %v", record)
+	}
+
+	status, _ := nodes[0].(map[string]any)["status"].(map[string]any)
+	if memInfo, ok := status["meminfo"].(map[string]any); !ok || memInfo["MemTotal"] == nil || status["status_latency"] == nil {
+		t.Errorf("Invalid node status: %v", nodes[0])
+	}
+}
+
+func TestStatsPreprocessorRotation(t *testing.T) {
+	t.Parallel()
+
+	dir := createRebalanceTestDir(t, "", "stats_rotation_test")
+	defer os.RemoveAll(dir)
+
+	watchDir := filepath.Join(dir, "logs")
+	outputDir := filepath.Join(dir, "output")
+
+	if err := os.Mkdir(watchDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every restart starts with a new preprocessor that only has the state saved in the output directory
+	restart := func() couchbase.WatchedDirectory {
+		processor, err := couchbase.NewPreprocessor(couchbase.StatsPreprocessorName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wd := couchbase.NewWatchedDirectory(watchDir, outputDir, processor, couchbase.RetentionPolicy{MaxFiles: 100})
+		if err := wd.CreateOutputDir(); err != nil {
+			t.Fatal(err)
+		}
+
+		return wd
+	}
+
+	process := func(wd couchbase.WatchedDirectory, filename string) {
+		if err := wd.ProcessFile(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rename := func(wd couchbase.WatchedDirectory, from, to string) {
+		if err := os.Rename(filepath.Join(watchDir, from), filepath.Join(watchDir, to)); err != nil {
+			t.Fatal(err)
+		}
+
+		process(wd, filepath.Join(watchDir, to))
+	}
+
+	wd := restart()
+	active := filepath.Join(watchDir, "stats.log")
+
+	const rotations = 3
+	for rotation := range rotations {
+		file, err := os.OpenFile(active, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, entry := range []string{"first", "second"} {
+			fmt.Fprintf(file, "[stats:info,2021-03-09T17:32:0%d.000Z,ns_1@cb.local:stats<0.1.0>:stats:log:1]rotation %d %s\n", rotation, rotation, entry)
+		}
+
+		if err := file.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The active log is processed on startup, the last entry may still be being written so it waits for the rotation
+		process(wd, active)
+		wd = restart()
+		process(wd, active)
+
+		// Rotate the active log into stats.log.1 as Couchbase does, processing every file a create event is seen for
+		for n := rotation; n > 0; n-- {
+			rename(wd, "stats.log."+strconv.Itoa(n), "stats.log."+strconv.Itoa(n+1))
+		}
+
+		rename(wd, "stats.log", "stats.log.1")
+	}
+
+	// Nothing is published again after a restart
+	wd = restart()
+	if err := wd.ProcessExisting(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]int{}
+	for _, record := range readRecords(t, outputDir) {
+		message, _ := record["message"].(string)
+		seen[message]++
+	}
+
+	for rotation := range rotations {
+		for _, entry := range []string{"first", "second"} {
+			message := fmt.Sprintf("rotation %d %s", rotation, entry)
+			if count := seen[message]; count != 1 {
+				t.Errorf("%q shipped %d times", message, count)
+			}
+		}
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := couchbase.NewRedactor(couchbase.RedactionSHA1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same input and output as the Lua redaction test in test/test-redaction.conf
+	input := "Cats are <ud>sma#@&*+-.!!!!!rter</ud> than dogs, and <UD>sheeps</UD>"
+	expected := "Cats are <ud>00b335216f27c1e7d35149b5bbfe19d4eb2d6af1</ud> than dogs, and <ud>888f807d45ff6ce47240c7ed4e884a6f9dc7b4fb</ud>"
+
+	if actual := redactor.RedactString(input); actual != expected {
+		t.Errorf("Invalid redaction: %q != %q", actual, expected)
+	}
+
+	// Streaming must give the same result however the writes are split
+	var out strings.Builder
+
+	writer := redactor.NewWriter(&out, false)
+	for i := range len(input) {
+		if _, err := writer.Write([]byte{input[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != expected {
+		t.Errorf("Invalid streamed redaction: %q != %q", out.String(), expected)
+	}
+
+	// Mixed case tags are not handled by the Lua filter either, the shortest span is hashed whatever tags it includes
+	input = "<ud>open <Ud>mixed</Ud> <ud>a<UD>b</ud>"
+	expected = "<ud>" + redactor.Hash([]byte("open <Ud>mixed</Ud> <ud>a<ud>b")) + "</ud>"
+
+	if actual := redactor.RedactString(input); actual != expected {
+		t.Errorf("Invalid redaction: %q != %q", actual, expected)
+	}
+
+	// The Lua pattern matches across the lines of a multi-line record, giving the same hashes as test/logs/file.example.expected
+	input = "Cats are <ud>sma#@&*+-.!!!!!rter</ud> than dogs,\nand <UD>sheeps</UD>\n<ud>sma#@&*+-.\n!!!!!rter</ud>"
+	expected = "Cats are <ud>00b335216f27c1e7d35149b5bbfe19d4eb2d6af1</ud> than dogs,\nand <ud>888f807d45ff6ce47240c7ed4e884a6f9dc7b4fb</ud>\n" +
+		"<ud>" + redactor.Hash([]byte("sma#@&*+-.\n!!!!!rter")) + "</ud>"
+
+	if actual := redactor.RedactString(input); actual != expected {
+		t.Errorf("Invalid multi-line redaction: %q != %q", actual, expected)
+	}
+
+	// The first open tag is the one closed, as with the Lua pattern
+	input = "<ud>open\n<ud>closed</ud>"
+	expected = "<ud>" + redactor.Hash([]byte("open\n<ud>closed")) + "</ud>"
+
+	if actual := redactor.RedactString(input); actual != expected {
+		t.Errorf("Invalid redaction: %q != %q", actual, expected)
+	}
+
+	// JSON escaped tags are only redacted within a single string so the JSON stays valid
+	var escaped strings.Builder
+
+	writer = redactor.NewWriter(&escaped, true)
+	input = `{"a": "<ud>x", "b": "y</ud>", "c": "<ud>z", "d": "<ud>w\"</ud>"}`
+	expected = `{"a": "<ud>x", "b": "y</ud>", "c": "<ud>z", "d": "<ud>` + redactor.Hash([]byte(`w"`)) + `</ud>"}`
+
+	if _, err := io.WriteString(writer, input); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if escaped.String() != expected {
+		t.Errorf("Invalid JSON escaped redaction: %q != %q", escaped.String(), expected)
+	}
+
+	// An unterminated tag is only buffered up to a limit, then written as is
+	var unterminated countingWriter
+
+	writer = redactor.NewWriter(&unterminated, true)
+	chunk := []byte(strings.Repeat("x", 1024))
+
+	if _, err := writer.Write([]byte("<ud>")); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2048 {
+		if _, err := writer.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if unterminated.written < 1<<20 {
+		t.Errorf("Unterminated tag buffered %d bytes", 2048*len(chunk)-unterminated.written)
+	}
+
+	// A tag after one that is given up on is still redacted
+	var overflowed strings.Builder
+
+	writer = redactor.NewWriter(&overflowed, false)
+	if _, err := io.WriteString(writer, "<ud>"+strings.Repeat("x", 2<<20)+"<ud>secret</ud>"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(overflowed.String(), "<ud>"+redactor.Hash([]byte("secret"))+"</ud>") {
+		t.Errorf("Tag after an unterminated one was not redacted: %q", overflowed.String()[overflowed.Len()-64:])
+	}
+
+	salt := []byte("salt\n")
+
+	hmacRedactor, err := couchbase.NewRedactor(couchbase.RedactionHMAC, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("user"))
+
+	if actual := hmacRedactor.RedactString("<ud>user</ud>"); actual != "<ud>"+hex.EncodeToString(mac.Sum(nil))+"</ud>" {
+		t.Errorf("Invalid HMAC redaction: %q", actual)
+	}
+
+	if _, err := couchbase.NewRedactor("md5", nil); !errors.Is(err, couchbase.ErrUnknownRedactionMode) {
+		t.Errorf("Expected unknown redaction mode error: %v", err)
+	}
+}
+
+// countingWriter counts what is written to it.
+type countingWriter struct {
+	written int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+
+	return len(p), nil
+}
+
+func TestProcessFileRedacted(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := couchbase.NewRedactor(couchbase.RedactionSHA1, []byte("salt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, explode := range []bool{false, true} {
+		processor := couchbase.RebalancePreprocessor{Explode: explode, Redactor: redactor}
+
+		var out strings.Builder
+
+		source := strings.NewReader(`{"bucket": "<ud>a\"b</ud>", "nodes": ["<ud>node</ud>"]}`)
+		if err := processor.Transform(&out, source, "rebalance_report_2021-03-09T17:33:43Z.json"); err != nil {
+			t.Fatal(err)
+		}
+
+		// The hash is of the user data itself, not the JSON encoding of it
+		for _, userData := range []string{`a"b`, "node"} {
+			if !strings.Contains(out.String(), "<ud>"+redactor.Hash([]byte(userData))+"</ud>") {
+				t.Errorf("Missing redacted %q in %q", userData, out.String())
+			}
+		}
+
+		// Exploded reports also have a summary record
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Errorf("Invalid JSON record %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestRedactedMirror(t *testing.T) {
+	t.Parallel()
+
+	if _, err := couchbase.NewRedactedMirror("", "", []string{"*.log"}, nil, 0); !errors.Is(err, couchbase.ErrRedactionNotEnabled) {
+		t.Errorf("Expected redaction not enabled error: %v", err)
+	}
+
+	redactor, err := couchbase.NewRedactor(couchbase.RedactionSHA1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := createRebalanceTestDir(t, "", "mirror_source_test")
+	defer os.RemoveAll(sourceDir)
+
+	outputDir := createRebalanceTestDir(t, "", "mirror_output_test")
+	defer os.RemoveAll(outputDir)
+
+	example, err := os.ReadFile("../../test/redaction.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceFile := filepath.Join(sourceDir, "redaction.log")
+	mirrorFile := filepath.Join(outputDir, "redaction.log")
+
+	if err := os.WriteFile(sourceFile, example, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mirror, err := couchbase.NewRedactedMirror(sourceDir, outputDir, couchbase.ParsePatterns("*.log, *.txt"), redactor, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.Close()
+
+	appendAndSync := func(contents string) {
+		t.Helper()
+
+		f, err := os.OpenFile(sourceFile, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.WriteString(contents); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = f.Close()
+
+		if err := mirror.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendAndSync("")
+
+	// Same expectation as the Lua redaction test in test/test-redaction.conf
+	var record map[string]string
+	if err := json.Unmarshal(readFile(t, mirrorFile), &record); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Cats are <ud>00b335216f27c1e7d35149b5bbfe19d4eb2d6af1</ud> than dogs, and <ud>888f807d45ff6ce47240c7ed4e884a6f9dc7b4fb</ud>"
+	if record["message"] != expected {
+		t.Errorf("Invalid redacted message: %q != %q", record["message"], expected)
+	}
+
+	// A tag split across reads is still redacted
+	appendAndSync("split <UD>sma#@&*+-.")
+	appendAndSync("!!!!!rter</UD>\n")
+
+	if !strings.HasSuffix(string(readFile(t, mirrorFile)), "split <ud>00b335216f27c1e7d35149b5bbfe19d4eb2d6af1</ud>\n") {
+		t.Errorf("Invalid split redaction: %q", readFile(t, mirrorFile))
+	}
+
+	// Rotation, anything written to the old file before we notice still ends up in the rotated mirror
+	if err := os.Rename(sourceFile, sourceFile+".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := os.OpenFile(sourceFile+".1", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = old.WriteString("last <ud>sheeps</ud>\n")
+	_ = old.Close()
+
+	if err := os.WriteFile(sourceFile, []byte("first <ud>sheeps</ud>\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	appendAndSync("")
+
+	if !strings.HasSuffix(string(readFile(t, mirrorFile+".1")), "last <ud>888f807d45ff6ce47240c7ed4e884a6f9dc7b4fb</ud>\n") {
+		t.Errorf("Invalid rotated mirror: %q", readFile(t, mirrorFile+".1"))
+	}
+
+	if string(readFile(t, mirrorFile)) != "first <ud>888f807d45ff6ce47240c7ed4e884a6f9dc7b4fb</ud>\n" {
+		t.Errorf("Invalid mirror after rotation: %q", readFile(t, mirrorFile))
+	}
+
+	// Truncation restarts the mirror
+	if err := os.WriteFile(sourceFile, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	appendAndSync("")
+
+	if string(readFile(t, mirrorFile)) != "new\n" {
+		t.Errorf("Invalid mirror after truncation: %q", readFile(t, mirrorFile))
+	}
+}
+
+func TestRedactedMirrorRestart(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := couchbase.NewRedactor(couchbase.RedactionSHA1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := createRebalanceTestDir(t, "", "mirror_restart_source_test")
+	defer os.RemoveAll(sourceDir)
+
+	outputDir := createRebalanceTestDir(t, "", "mirror_restart_output_test")
+	defer os.RemoveAll(outputDir)
+
+	textFile := filepath.Join(sourceDir, "debug.log")
+	jsonFile := filepath.Join(sourceDir, "audit.log")
+
+	// Each restart carries on from where the last one stopped so nothing is mirrored twice
+	for i, line := range []string{"first <ud>a\\\"b</ud>\n", "second <ud>a\\\"b</ud>\n"} {
+		for _, file := range []string{textFile, jsonFile} {
+			contents := line
+			if file == jsonFile {
+				contents = `{"message": "` + strings.TrimSuffix(line, "\n") + `"}` + "\n"
+			}
+
+			f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _ = f.WriteString(contents)
+			_ = f.Close()
+		}
+
+		mirror, err := couchbase.NewRedactedMirror(sourceDir, outputDir, []string{"*.log"}, redactor, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mirror.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mirror.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if lines := strings.Count(string(readFile(t, filepath.Join(outputDir, "debug.log"))), "\n"); lines != i+1 {
+			t.Errorf("Invalid number of mirrored lines after restart %d: %d", i, lines)
+		}
+	}
+
+	// Plain text is hashed as is, JSON lines are hashed as the parsed record the Lua filter sees
+	textHash := redactor.Hash([]byte(`a\"b`))
+	jsonHash := redactor.Hash([]byte(`a"b`))
+
+	if mirrored := string(readFile(t, filepath.Join(outputDir, "debug.log"))); strings.Count(mirrored, textHash) != 2 {
+		t.Errorf("Invalid plain text mirror: %q", mirrored)
+	}
+
+	if mirrored := string(readFile(t, filepath.Join(outputDir, "audit.log"))); strings.Count(mirrored, jsonHash) != 2 {
+		t.Errorf("Invalid JSON mirror: %q", mirrored)
+	}
+
+	// A source rotated whilst stopped rotates its mirror too
+	if err := os.Rename(textFile, textFile+".1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(textFile, []byte("third\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mirror, err := couchbase.NewRedactedMirror(sourceDir, outputDir, []string{"*.log"}, redactor, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mirror.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = mirror.Close()
+
+	if mirrored := string(readFile(t, filepath.Join(outputDir, "debug.log"))); mirrored != "third\n" {
+		t.Errorf("Invalid mirror after rotation whilst stopped: %q", mirrored)
+	}
+
+	if lines := strings.Count(string(readFile(t, filepath.Join(outputDir, "debug.log.1"))), "\n"); lines != 2 {
+		t.Errorf("Invalid rotated mirror: %d lines", lines)
+	}
+}
+
+func TestRedactedMirrorStoppedInTag(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := couchbase.NewRedactor(couchbase.RedactionSHA1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := createRebalanceTestDir(t, "", "mirror_stopped_source_test")
+	defer os.RemoveAll(sourceDir)
+
+	outputDir := createRebalanceTestDir(t, "", "mirror_stopped_output_test")
+	defer os.RemoveAll(outputDir)
+
+	sourceFile := filepath.Join(sourceDir, "debug.log")
+	mirrorFile := filepath.Join(outputDir, "debug.log")
+
+	// Stopped part way through a tag, the user data must never be written out as is
+	for _, contents := range []string{"before <ud>sec", "ret</ud> after\n"} {
+		f, err := os.OpenFile(sourceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = f.WriteString(contents)
+		_ = f.Close()
+
+		mirror, err := couchbase.NewRedactedMirror(sourceDir, outputDir, []string{"*.log"}, redactor, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mirror.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mirror.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if mirrored := string(readFile(t, mirrorFile)); strings.Contains(mirrored, "sec") || strings.Contains(mirrored, "<ud>") != strings.Contains(mirrored, "</ud>") {
+			t.Errorf("User data written out after stopping: %q", mirrored)
+		}
+	}
+
+	if mirrored, expected := string(readFile(t, mirrorFile)), "before <ud>"+redactor.Hash([]byte("secret"))+"</ud> after\n"; mirrored != expected {
+		t.Errorf("Invalid mirror after restart in a tag: %q != %q", mirrored, expected)
+	}
+}
+
+func TestRedactedMirrorSameName(t *testing.T) {
+	t.Parallel()
+
+	redactor, err := couchbase.NewRedactor(couchbase.RedactionSHA1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := createRebalanceTestDir(t, "", "mirror_same_name_source_test")
+	defer os.RemoveAll(sourceDir)
+
+	outputDir := createRebalanceTestDir(t, "", "mirror_same_name_output_test")
+	defer os.RemoveAll(outputDir)
+
+	for _, dir := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(sourceDir, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(sourceDir, dir, "debug.log"), []byte(dir+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mirror, err := couchbase.NewRedactedMirror(sourceDir, outputDir, []string{"*/*.log"}, redactor, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mirror.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = mirror.Close()
+
+	// Each keeps its own mirror and state
+	for _, dir := range []string{"a", "b"} {
+		if mirrored := string(readFile(t, filepath.Join(outputDir, dir, "debug.log"))); mirrored != dir+"\n" {
+			t.Errorf("Invalid mirror of %s/debug.log: %q", dir, mirrored)
+		}
+
+		if _, err := os.Stat(filepath.Join(outputDir, dir, ".debug.log.offset")); err != nil {
+			t.Errorf("Missing mirror state for %s/debug.log: %v", dir, err)
+		}
+	}
+}
+
+func TestAddWatcherMissingLogDir(t *testing.T) {
+	t.Parallel()
+
+	root := createRebalanceTestDir(t, "", "missing_log_dir_test")
+	defer os.RemoveAll(root)
+
+	dir := createRebalanceTestDir(t, "", "missing_log_dir_output_test")
+	defer os.RemoveAll(dir)
+
+	// Neither the log directory nor the rebalance one exist yet
+	logDir := filepath.Join(root, "var", "logs")
+
+	config := couchbase.WatcherConfig{}
+	config.SetCouchbaseLogDir(logDir)
+	config.SetRebalanceOutputDir(dir)
+
+	var g run.Group
+	if err := couchbase.AddCouchbaseWatcher(&g, config); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	g.Add(func() error {
+		<-done
+
+		return nil
+	}, func(_ error) {})
+
+	result := make(chan error)
+	go func() {
+		result <- g.Run()
+	}()
+
+	defer func() {
+		close(done)
+		<-result
+	}()
+
+	if err := os.MkdirAll(filepath.Join(logDir, "rebalance"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	report := readFile(t, "../../test/logs/rebalance/rebalance_report_2021-03-09T20:23:16Z.json")
+	if err := os.WriteFile(filepath.Join(logDir, "rebalance", "rebalance_report_2021-03-09T20:23:16Z.json"), report, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Either picked up as an existing file when the directory is found or from its own event
+	for range 50 {
+		if published, _ := filepath.Glob(filepath.Join(dir, "rebalance-processed-*.json")); len(published) == 1 {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Errorf("Report not processed once the log directory appeared")
+}
+
+func TestCreateWatchers(t *testing.T) {
+	t.Parallel()
+
+	couchbaseLogDir := "../../test/logs"
+
+	rebalanceOutputDir := createRebalanceTestDir(t, "", "create_watchers_test")
+	defer os.RemoveAll(rebalanceOutputDir)
+
+	fluentBitConfigDir := createRebalanceTestDir(t, "", "fluent-bit-config")
+	defer os.RemoveAll(fluentBitConfigDir)
+
+	config := couchbase.WatcherConfig{}
+	config.SetFluentBitConfigDir(fluentBitConfigDir)
+	config.SetCouchbaseLogDir(couchbaseLogDir)
+	config.SetRebalanceOutputDir(rebalanceOutputDir)
+
+	if _, err := couchbase.CreateWatchers(config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, filename string) []byte {
+	t.Helper()
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+func createTestChunk(t *testing.T, dir, name string, size int, age time.Duration) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, make([]byte, size), 0600); err != nil {
+		t.Fatal(err, filename)
+	}
+
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err, filename)
+	}
+
+	return filename
+}
+
+func TestBufferManager(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	inputDir := filepath.Join(dir, "tail.0")
+
+	if err := os.Mkdir(inputDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks of a process that is not running, the maximum PID on Linux is much lower
+	oldest := createTestChunk(t, inputDir, "99999999-1648192193.174567910.flb", 100, 3*time.Hour)
+	older := createTestChunk(t, inputDir, "99999999-1648192194.174567910.flb", 100, 2*time.Hour)
+	newest := createTestChunk(t, inputDir, "99999999-1648192195.174567910.flb", 100, time.Hour)
+	// Our own chunk is in use however old it is, anything else is not a chunk
+	running := createTestChunk(t, inputDir, strconv.Itoa(os.Getpid())+"-1648192190.174567910.flb", 100, 4*time.Hour)
+	other := createTestChunk(t, dir, "other", 50, 5*time.Hour)
+
+	usage, err := couchbase.NewBufferManager(dir, 300, 0, false).Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Bytes != 450 || len(usage.Removed) != 0 || !reflect.DeepEqual(usage.Orphans, []string{oldest, older, newest}) {
+		t.Errorf("unexpected usage without removing orphans: %+v", usage)
+	}
+
+	// Only as many orphans as needed are removed, oldest first
+	usage, err = couchbase.NewBufferManager(dir, 300, 0, true).Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Bytes != 250 || !reflect.DeepEqual(usage.Removed, []string{oldest, older}) {
+		t.Errorf("unexpected usage removing orphans: %+v", usage)
+	}
+
+	for _, kept := range []string{newest, running, other} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("expected %q to be kept: %v", kept, err)
+		}
+	}
+
+	// Fluent Bit only creates the directory when it first buffers anything
+	usage, err = couchbase.NewBufferManager(filepath.Join(dir, "missing"), 300, 0, true).Check()
+	if err != nil || usage.Bytes != 0 {
+		t.Errorf("expected an empty buffer but got %+v: %v", usage, err)
+	}
+}
+
+func TestBufferManagerLoadedChunks(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// A restarted Fluent Bit has the chunks of the previous process open as backlog
+	loaded := createTestChunk(t, dir, "99999998-1648192193.174567910.flb", 100, 3*time.Hour)
+	orphan := createTestChunk(t, dir, "99999998-1648192194.174567910.flb", 100, 2*time.Hour)
+
+	file, err := os.Open(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	usage, err := couchbase.NewBufferManager(dir, 50, 0, true).Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Bytes != 100 || !reflect.DeepEqual(usage.Orphans, []string{orphan}) || !reflect.DeepEqual(usage.Removed, []string{orphan}) {
+		t.Errorf("unexpected usage with a loaded chunk: %+v", usage)
+	}
+
+	if _, err := os.Stat(loaded); err != nil {
+		t.Errorf("expected the loaded chunk to be kept: %v", err)
+	}
 }
@@ -0,0 +1,621 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+// Couchbase Server (ns_server) logs various status information as pretty-printed Erlang terms.
+// This is a parser for the subset of the term syntax that appears in the logs, converting it to JSON-friendly values:
+// - atoms, strings and binaries become strings (true and false become booleans)
+// - integers and floats become json.Number so nothing is lost
+// - property lists, i.e. lists of {Key, Value} tuples, become objects
+// - other lists and tuples become arrays
+// - pids, references, ports and funs become their printed string
+// - maps become objects
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrInvalidErlangTerm indicates the input could not be parsed as an Erlang term.
+	ErrInvalidErlangTerm = errors.New("invalid erlang term")
+
+	jsonNumberRegex = regexp.MustCompile(`^-?\d+(\.\d+)?([eE][-+]?\d+)?$`)
+)
+
+type erlangAtom string
+
+type erlangTuple []any
+
+type erlangParser struct {
+	input string
+	pos   int
+}
+
+// ParseErlangTerm parses a single Erlang term, optionally terminated with a full stop, into JSON-friendly values.
+func ParseErlangTerm(input string) (any, error) {
+	p := erlangParser{input: input}
+
+	term, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipWhitespace()
+
+	if p.peek() == '.' {
+		p.pos++
+		p.skipWhitespace()
+	}
+
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected trailing content")
+	}
+
+	return erlangToJSON(term), nil
+}
+
+func (p *erlangParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrInvalidErlangTerm, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *erlangParser) peek() byte {
+	if p.pos >= len(p.input) {
+		return 0
+	}
+
+	return p.input[p.pos]
+}
+
+func (p *erlangParser) skipWhitespace() {
+	for p.pos < len(p.input) {
+		switch p.input[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		case '%':
+			// Comments run to the end of the line
+			for p.pos < len(p.input) && p.input[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *erlangParser) term() (any, error) {
+	p.skipWhitespace()
+
+	c := p.peek()
+
+	switch {
+	case c == 0:
+		return nil, p.errorf("unexpected end of input")
+	case c == '[':
+		p.pos++
+
+		return p.sequence(']')
+	case c == '{':
+		p.pos++
+
+		elements, err := p.sequence('}')
+
+		return erlangTuple(elements), err
+	case c == '"':
+		return p.quoted('"')
+	case c == '\'':
+		atom, err := p.quoted('\'')
+
+		return erlangAtom(atom), err
+	case c == '$':
+		return p.char()
+	case c == '<' && strings.HasPrefix(p.input[p.pos:], "<<"):
+		return p.binary()
+	case c == '<':
+		// A pid: <0.378.0>
+		return p.until('>')
+	case c == '#' && strings.HasPrefix(p.input[p.pos:], "#{"):
+		return p.erlangMap()
+	case c == '#':
+		// References, ports and funs: #Ref<0.1.2.3>
+		return p.until('>')
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.number()
+	case strings.HasPrefix(p.input[p.pos:], "..."):
+		// Printing was truncated
+		p.pos += 3
+
+		return erlangAtom("..."), nil
+	case c >= 'a' && c <= 'z':
+		return p.atom(), nil
+	default:
+		return nil, p.errorf("unexpected character %q", c)
+	}
+}
+
+// sequence parses comma separated terms up to the closing delimiter, the opening one must already have been read.
+func (p *erlangParser) sequence(closing byte) ([]any, error) {
+	elements := []any{}
+
+	p.skipWhitespace()
+
+	if p.peek() == closing {
+		p.pos++
+
+		return elements, nil
+	}
+
+	for {
+		element, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, element)
+
+		p.skipWhitespace()
+
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '|':
+			// Improper list tail, just keep it as another element
+			p.pos++
+		case closing:
+			p.pos++
+
+			return elements, nil
+		default:
+			return nil, p.errorf("expected ',' or %q", closing)
+		}
+	}
+}
+
+// until returns everything up to and including the terminator.
+func (p *erlangParser) until(terminator byte) (string, error) {
+	end := strings.IndexByte(p.input[p.pos:], terminator)
+	if end < 0 {
+		return "", p.errorf("expected %q", terminator)
+	}
+
+	value := p.input[p.pos : p.pos+end+1]
+	p.pos += end + 1
+
+	return value, nil
+}
+
+func (p *erlangParser) atom() erlangAtom {
+	start := p.pos
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '@' {
+			p.pos++
+
+			continue
+		}
+
+		break
+	}
+
+	return erlangAtom(p.input[start:p.pos])
+}
+
+func (p *erlangParser) number() (any, error) {
+	start := p.pos
+
+	if p.peek() == '-' {
+		p.pos++
+	}
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if (c >= '0' && c <= '9') || c == '.' || c == 'e' || c == 'E' || c == '#' || c == '_' ||
+			((c == '-' || c == '+') && (p.input[p.pos-1] == 'e' || p.input[p.pos-1] == 'E')) ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			// A trailing full stop terminates the term rather than starting a fraction
+			if c == '.' && (p.pos+1 >= len(p.input) || p.input[p.pos+1] < '0' || p.input[p.pos+1] > '9') {
+				break
+			}
+
+			p.pos++
+
+			continue
+		}
+
+		break
+	}
+
+	literal := strings.ReplaceAll(p.input[start:p.pos], "_", "")
+
+	// Integers with a radix: 16#ff
+	if base, digits, found := strings.Cut(literal, "#"); found {
+		negative := strings.HasPrefix(base, "-")
+
+		radix, err := strconv.Atoi(strings.TrimPrefix(base, "-"))
+		if err != nil {
+			return nil, p.errorf("invalid radix %q", literal)
+		}
+
+		value, err := strconv.ParseInt(digits, radix, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", literal)
+		}
+
+		if negative {
+			value = -value
+		}
+
+		return json.Number(strconv.FormatInt(value, 10)), nil
+	}
+
+	if !jsonNumberRegex.MatchString(literal) {
+		return nil, p.errorf("invalid number %q", literal)
+	}
+
+	return json.Number(literal), nil
+}
+
+func (p *erlangParser) char() (any, error) {
+	// Skip the $
+	p.pos++
+
+	if p.pos >= len(p.input) {
+		return nil, p.errorf("unexpected end of input")
+	}
+
+	var value rune
+
+	if p.input[p.pos] == '\\' {
+		var err error
+
+		value, err = p.escape()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var size int
+
+		value, size = utf8.DecodeRuneInString(p.input[p.pos:])
+		p.pos += size
+	}
+
+	return json.Number(strconv.Itoa(int(value))), nil
+}
+
+// quoted parses a quoted string or atom, handling escapes.
+func (p *erlangParser) quoted(quote byte) (string, error) {
+	// Skip the opening quote
+	p.pos++
+
+	var value strings.Builder
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+
+		switch c {
+		case quote:
+			p.pos++
+
+			return value.String(), nil
+		case '\\':
+			escaped, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+
+			value.WriteRune(escaped)
+		default:
+			value.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return "", p.errorf("unterminated %q", quote)
+}
+
+var erlangEscapes = map[byte]rune{
+	'b': '\b', 'd': 0x7f, 'e': 0x1b, 'f': '\f', 'n': '\n', 'r': '\r', 's': ' ', 't': '\t', 'v': '\v',
+}
+
+// escape parses an escape sequence starting at the backslash.
+func (p *erlangParser) escape() (rune, error) {
+	// Skip the backslash
+	p.pos++
+
+	if p.pos >= len(p.input) {
+		return 0, p.errorf("unterminated escape")
+	}
+
+	c := p.input[p.pos]
+	p.pos++
+
+	if value, ok := erlangEscapes[c]; ok {
+		return value, nil
+	}
+
+	switch {
+	case c >= '0' && c <= '7':
+		// Up to three octal digits
+		const maxOctalDigits = 3
+
+		end := p.pos - 1
+		for end < len(p.input) && end < p.pos-1+maxOctalDigits && p.input[end] >= '0' && p.input[end] <= '7' {
+			end++
+		}
+
+		value, _ := strconv.ParseInt(p.input[p.pos-1:end], 8, 32)
+		p.pos = end
+
+		return rune(value), nil
+	case c == 'x' && p.peek() == '{':
+		hex, err := p.until('}')
+		if err != nil {
+			return 0, err
+		}
+
+		value, err := strconv.ParseInt(strings.Trim(hex, "{}"), 16, 32)
+		if err != nil {
+			return 0, p.errorf("invalid hex escape %q", hex)
+		}
+
+		return rune(value), nil
+	case c == 'x':
+		const hexDigits = 2
+
+		if p.pos+hexDigits > len(p.input) {
+			return 0, p.errorf("unterminated hex escape")
+		}
+
+		value, err := strconv.ParseInt(p.input[p.pos:p.pos+hexDigits], 16, 32)
+		if err != nil {
+			return 0, p.errorf("invalid hex escape")
+		}
+
+		p.pos += hexDigits
+
+		return rune(value), nil
+	case c == '^':
+		// Control characters: \^a
+		control := p.peek()
+		p.pos++
+
+		return rune(control % 32), nil
+	default:
+		// Anything else is just itself, e.g. \\ \" \'
+		return rune(c), nil
+	}
+}
+
+func (p *erlangParser) binary() (any, error) {
+	// Skip the <<
+	p.pos += 2
+
+	p.skipWhitespace()
+
+	if strings.HasPrefix(p.input[p.pos:], ">>") {
+		p.pos += 2
+
+		return "", nil
+	}
+
+	if p.peek() == '"' {
+		// Adjacent strings are concatenated
+		var value strings.Builder
+
+		for p.peek() == '"' {
+			part, err := p.quoted('"')
+			if err != nil {
+				return nil, err
+			}
+
+			value.WriteString(part)
+			p.skipWhitespace()
+		}
+
+		return value.String(), p.expectString(">>")
+	}
+
+	// A binary of bytes: <<1,2,3>>
+	var values []any
+
+	for {
+		value, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+
+		p.skipWhitespace()
+
+		if p.peek() != ',' {
+			break
+		}
+
+		p.pos++
+		p.skipWhitespace()
+	}
+
+	return values, p.expectString(">>")
+}
+
+func (p *erlangParser) expectString(expected string) error {
+	p.skipWhitespace()
+
+	if !strings.HasPrefix(p.input[p.pos:], expected) {
+		return p.errorf("expected %q", expected)
+	}
+
+	p.pos += len(expected)
+
+	return nil
+}
+
+func (p *erlangParser) erlangMap() (any, error) {
+	// Skip the #{
+	p.pos += 2
+
+	result := map[string]any{}
+
+	p.skipWhitespace()
+
+	if p.peek() == '}' {
+		p.pos++
+
+		return result, nil
+	}
+
+	for {
+		key, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expectString("=>"); err != nil {
+			return nil, err
+		}
+
+		value, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+
+		result[erlangKey(erlangToJSON(key))] = value
+
+		p.skipWhitespace()
+
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+
+			return result, nil
+		default:
+			return nil, p.errorf("expected ',' or '}'")
+		}
+	}
+}
+
+// erlangKey converts any key into a string for an object.
+func erlangKey(key any) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+
+	encoded, _ := json.Marshal(key)
+
+	return string(encoded)
+}
+
+// isPropList returns true if every element is a {Key, Value} tuple with a string-like key or a bare atom.
+// There must be at least one tuple, a list of only atoms is a plain list rather than a property list of shorthands.
+func isPropList(elements []any) bool {
+	pairs := 0
+
+	for _, element := range elements {
+		switch e := element.(type) {
+		case erlangAtom:
+			continue
+		case erlangTuple:
+			const pairSize = 2
+			if len(e) != pairSize {
+				return false
+			}
+
+			switch e[0].(type) {
+			case erlangAtom, string:
+				pairs++
+
+				continue
+			}
+
+			return false
+		default:
+			return false
+		}
+	}
+
+	return pairs > 0
+}
+
+// erlangToJSON converts the parsed term into values that can be marshalled as JSON.
+func erlangToJSON(term any) any {
+	switch t := term.(type) {
+	case erlangAtom:
+		switch t {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+
+		return string(t)
+	case erlangTuple:
+		result := make([]any, 0, len(t))
+		for _, element := range t {
+			result = append(result, erlangToJSON(element))
+		}
+
+		return result
+	case []any:
+		if !isPropList(t) {
+			result := make([]any, 0, len(t))
+			for _, element := range t {
+				result = append(result, erlangToJSON(element))
+			}
+
+			return result
+		}
+
+		result := make(map[string]any, len(t))
+
+		for _, element := range t {
+			key, value := "", any(true)
+
+			// A bare atom in a property list is shorthand for {Atom, true}
+			if atom, ok := element.(erlangAtom); ok {
+				key = string(atom)
+			} else {
+				pair, _ := element.(erlangTuple)
+				key = erlangKey(erlangToJSON(pair[0]))
+				value = erlangToJSON(pair[1])
+			}
+
+			// The first value for a key wins
+			if _, exists := result[key]; !exists {
+				result[key] = value
+			}
+		}
+
+		return result
+	case map[string]any:
+		for key, value := range t {
+			t[key] = erlangToJSON(value)
+		}
+
+		return t
+	default:
+		return t
+	}
+}
@@ -0,0 +1,234 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+// ErrNotJSONObject indicates the report is not a JSON object so cannot be exploded.
+var ErrNotJSONObject = errors.New("report is not a JSON object")
+
+// singleLineWriter drops any new lines so the output stays on one line for the tail input.
+// This is safe for JSON as raw new lines can only ever be whitespace between tokens.
+type singleLineWriter struct {
+	out io.Writer
+}
+
+func (w singleLineWriter) Write(p []byte) (int, error) {
+	cleaned := bytes.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return -1
+		}
+
+		return r
+	}, p)
+
+	if _, err := w.out.Write(cleaned); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// exploder streams a report through a JSON decoder writing a record per section.
+// Only one section is ever held in memory so peak usage does not grow with the size of the report:
+// - the scalar (and scalar array) members of each object become one record for that object
+// - each element of an array of objects or arrays becomes its own record
+// Sections are named with a simple JSONPath, e.g. $.stageInfo.data or $.nodesInfo.active_nodes[0].
+// A final record with the section "summary" holds the summary of the whole report.
+type exploder struct {
+	decoder  *json.Decoder
+	encoder  *json.Encoder
+	schema   *OutputSchema
+	metadata []recordField
+	filename string
+}
+
+// writeExploded writes one record per section of the report, each starting with the metadata,
+// returning the summary of the report if it could be computed.
+func writeExploded(out io.Writer, source io.Reader, schema *OutputSchema, metadata []recordField, filename string) (*rebalanceSummary, error) {
+	summary := newBackgroundSummary()
+
+	e := exploder{
+		decoder:  json.NewDecoder(io.TeeReader(source, summary)),
+		encoder:  json.NewEncoder(out),
+		schema:   schema,
+		metadata: metadata,
+		filename: filename,
+	}
+	e.decoder.UseNumber()
+	e.encoder.SetEscapeHTML(false)
+
+	if err := e.report(); err != nil {
+		summary.Abort()
+
+		return nil, err
+	}
+
+	computed, err := summary.Summary()
+	if err != nil {
+		log.Warnw("Unable to summarise report", "file", filename, "error", err)
+
+		return nil, nil
+	}
+
+	return computed, e.writeSummary(computed)
+}
+
+// report processes the whole report, which must be a single object.
+func (e *exploder) report() error {
+	token, err := e.decoder.Token()
+	if err != nil {
+		return fmt.Errorf("unable to read report %q: %w", e.filename, err)
+	}
+
+	if token != json.Delim('{') {
+		return fmt.Errorf("%w: %q", ErrNotJSONObject, e.filename)
+	}
+
+	if err := e.object("$"); err != nil {
+		return err
+	}
+
+	// Anything after the report means this is not a single report, e.g. a log of JSON lines
+	if _, err := e.decoder.Token(); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %q has data after the report", ErrNotJSONObject, e.filename)
+	}
+
+	return nil
+}
+
+// record returns a record of the metadata followed by the section and the field.
+func (e *exploder) record(section string, field recordField) record {
+	fields := append(slices.Clone(e.metadata), recordField{Name: e.schema.Field(fieldSection), Value: section}, field)
+
+	return record(fields)
+}
+
+func (e *exploder) writeSummary(summary *rebalanceSummary) error {
+	err := e.encoder.Encode(e.record(fieldSummary, recordField{Name: e.schema.Field(fieldSummary), Value: summary}))
+	if err != nil {
+		return fmt.Errorf("unable to write summary to output file: %w", err)
+	}
+
+	return nil
+}
+
+func (e *exploder) write(section string, contents any) error {
+	// The encoder always terminates each record with a new line
+	err := e.encoder.Encode(e.record(section, recordField{Name: e.schema.Field(fieldContents), Value: contents}))
+	if err != nil {
+		return fmt.Errorf("unable to write section %q to output file: %w", section, err)
+	}
+
+	return nil
+}
+
+// object processes the members of an object, the opening delimiter must already have been read.
+func (e *exploder) object(path string) error {
+	fields := map[string]any{}
+
+	for e.decoder.More() {
+		token, err := e.decoder.Token()
+		if err != nil {
+			return fmt.Errorf("unable to read key in %q: %w", path, err)
+		}
+
+		key, _ := token.(string)
+		memberPath := path + "." + key
+
+		token, err = e.decoder.Token()
+		if err != nil {
+			return fmt.Errorf("unable to read value of %q: %w", memberPath, err)
+		}
+
+		switch token {
+		case json.Delim('{'):
+			err = e.object(memberPath)
+		case json.Delim('['):
+			var scalars []any
+
+			scalars, err = e.array(memberPath)
+			if scalars != nil {
+				fields[key] = scalars
+			}
+		default:
+			fields[key] = token
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Consume the closing delimiter
+	if _, err := e.decoder.Token(); err != nil {
+		return fmt.Errorf("unable to read end of %q: %w", path, err)
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return e.write(path, fields)
+}
+
+// array writes out any nested elements individually and returns any scalar ones to be kept with the parent.
+// The opening delimiter must already have been read.
+func (e *exploder) array(path string) ([]any, error) {
+	scalars := []any{}
+	nested := false
+
+	for i := 0; e.decoder.More(); i++ {
+		var element json.RawMessage
+		if err := e.decoder.Decode(&element); err != nil {
+			return nil, fmt.Errorf("unable to read element %d of %q: %w", i, path, err)
+		}
+
+		trimmed := bytes.TrimSpace(element)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			nested = true
+
+			if err := e.write(path+"["+strconv.Itoa(i)+"]", element); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		scalars = append(scalars, element)
+	}
+
+	// Consume the closing delimiter
+	if _, err := e.decoder.Token(); err != nil {
+		return nil, fmt.Errorf("unable to read end of %q: %w", path, err)
+	}
+
+	// Keep empty arrays with the parent unless they only contained nested values
+	if nested && len(scalars) == 0 {
+		return nil, nil
+	}
+
+	return scalars, nil
+}
@@ -0,0 +1,172 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"go.uber.org/zap/zapcore"
+)
+
+// DefaultRebalanceInclude only processes rebalance reports, including rotated or compressed ones (e.g. .json.gz).
+const DefaultRebalanceInclude = "rebalance_report_*.json,rebalance_report_*.json.*"
+
+// Reasons a file is skipped.
+const (
+	skipDirectory   = "directory"
+	skipNotRegular  = "notRegular"
+	skipHidden      = "hidden"
+	skipExcluded    = "excluded"
+	skipNotIncluded = "notIncluded"
+)
+
+// ParsePatterns splits a comma-separated list of file patterns.
+func ParsePatterns(value string) []string {
+	var patterns []string
+
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// FileFilter selects the files in a watched directory to process by their base name.
+// Directories, anything else that is not a regular file (e.g. a FIFO that would block opening it)
+// and hidden files (e.g. editor temporary files) are always skipped.
+// An empty include list includes everything, exclusions take precedence over inclusions.
+type FileFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// NewFileFilter creates a filter from comma-separated lists of glob patterns, as per filepath.Match.
+func NewFileFilter(include, exclude string) (FileFilter, error) {
+	filter := FileFilter{Include: ParsePatterns(include), Exclude: ParsePatterns(exclude)}
+
+	for _, pattern := range append(append([]string{}, filter.Include...), filter.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return FileFilter{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	return filter, nil
+}
+
+// DefaultRebalanceFilter only includes rebalance reports.
+func DefaultRebalanceFilter() FileFilter {
+	return FileFilter{Include: ParsePatterns(DefaultRebalanceInclude)}
+}
+
+// NewRebalanceFilterFromDefaults creates the rebalance filter from the environment, invalid patterns fall back to the default.
+func NewRebalanceFilterFromDefaults() FileFilter {
+	include := common.GetRebalanceInclude()
+	if include == "" {
+		include = DefaultRebalanceInclude
+	}
+
+	filter, err := NewFileFilter(include, common.GetRebalanceExclude())
+	if err != nil {
+		log.Warnw("Invalid rebalance file patterns so defaulting", "error", err, "default", DefaultRebalanceInclude)
+
+		return DefaultRebalanceFilter()
+	}
+
+	return filter
+}
+
+func (ff FileFilter) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("include", strings.Join(ff.Include, ","))
+	enc.AddString("exclude", strings.Join(ff.Exclude, ","))
+
+	return nil
+}
+
+// skipReason returns why the file should be skipped, empty if it should be processed.
+func (ff FileFilter) skipReason(filename string, info os.FileInfo) string {
+	name := filepath.Base(filename)
+
+	switch {
+	case info != nil && info.IsDir():
+		return skipDirectory
+	case info != nil && !info.Mode().IsRegular():
+		return skipNotRegular
+	case strings.HasPrefix(name, "."):
+		return skipHidden
+	case matchesAny(ff.Exclude, name):
+		return skipExcluded
+	case len(ff.Include) > 0 && !matchesAny(ff.Include, name):
+		return skipNotIncluded
+	default:
+		return ""
+	}
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipCounter counts the files skipped by reason, it is shared by all copies of a watched directory.
+type skipCounter struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+// add records a skipped file and returns the total skipped so far.
+func (sc *skipCounter) add(reason string) int64 {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if sc.counts == nil {
+		sc.counts = map[string]int64{}
+	}
+
+	sc.counts[reason]++
+
+	var total int64
+	for _, count := range sc.counts {
+		total += count
+	}
+
+	return total
+}
+
+// snapshot returns a copy of the counts by reason.
+func (sc *skipCounter) snapshot() map[string]int64 {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	counts := make(map[string]int64, len(sc.counts))
+	for reason, count := range sc.counts {
+		counts[reason] = count
+	}
+
+	return counts
+}
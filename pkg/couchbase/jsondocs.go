@@ -0,0 +1,240 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Epoch timestamps larger than this are taken to be in milliseconds rather than seconds, it is in the year 5138 in seconds.
+const epochMillisecondsThreshold = 1e11
+
+var (
+	// ErrInvalidJSONDocumentType indicates a JSON document type could not be registered.
+	ErrInvalidJSONDocumentType = errors.New("invalid JSON document type")
+
+	// Document types are used in output file names so must be a single path element.
+	documentTypeRegex = regexp.MustCompile(`^[\w.-]+$`)
+)
+
+// JSONDocumentPreprocessor wraps every JSON document in a file as a record, the same as a rebalance report.
+// A file can be a single document over multiple lines or any number of documents, e.g. concatenated or NDJSON.
+// Each document is streamed through a token at a time so large documents are never held in memory.
+type JSONDocumentPreprocessor struct {
+	// Type is the kind of document, it is added to every record and names the output files.
+	Type string
+	// TimestampPath locates the timestamp in each document, if not set or not found the current time is used.
+	TimestampPath []string
+	// Node tags every record with the node the document is from, if set.
+	Node string
+	// Redactor hashes any <ud> tagged user data in the documents, nil disables redaction.
+	Redactor *Redactor
+	// Schema names the fields of each record, nil is the default schema.
+	Schema *OutputSchema
+}
+
+func (jp *JSONDocumentPreprocessor) Name() string {
+	return jp.Type
+}
+
+func (jp *JSONDocumentPreprocessor) Match(_ string) bool {
+	return true
+}
+
+func (jp *JSONDocumentPreprocessor) OutputPattern() string {
+	return jp.Type + "-processed-*.json"
+}
+
+func (jp *JSONDocumentPreprocessor) Transform(out io.Writer, source io.Reader, filename string) error {
+	if jp.Redactor == nil {
+		return jp.transform(out, source, filename)
+	}
+
+	// The output is always JSON so hash the user data as it was in the document
+	redacted := jp.Redactor.NewWriter(out, true)
+	if err := jp.transform(redacted, source, filename); err != nil {
+		return err
+	}
+
+	return redacted.Close()
+}
+
+func (jp *JSONDocumentPreprocessor) transform(out io.Writer, source io.Reader, filename string) error {
+	// Make sure it is actually JSON before we start writing anything out
+	buffered := bufio.NewReader(source)
+	if !isJSONDocument(buffered) {
+		return fmt.Errorf("%w: %q is not JSON", ErrSkipFile, filename)
+	}
+
+	// Everything but the timestamp is the same for every document
+	metadata := append(jp.Schema.metadata("", filename, jp.Node), recordField{Name: jp.Schema.Field(fieldDocumentType), Value: jp.Type})
+
+	members, err := encodeMembers(metadata)
+	if err != nil {
+		return err
+	}
+
+	contentsName, _ := encodeJSON(jp.Schema.Field(fieldContents))
+	header := "{" + members + contentsName + ":"
+
+	writer := bufio.NewWriter(out)
+
+	var timestamp json.Token
+
+	walker := newJSONWalker(buffered, writer, func(path []string, token json.Token) {
+		if timestamp == nil && len(jp.TimestampPath) > 0 && slices.Equal(path, jp.TimestampPath) {
+			timestamp = token
+		}
+	})
+
+	for walker.decoder.More() {
+		timestamp = nil
+
+		if err := jp.writeDocument(writer, walker, header, filename, &timestamp); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("unable to write to output file: %w", err)
+	}
+
+	return nil
+}
+
+// writeDocument wraps the next document as a single record on one line.
+// The timestamp is set by the walker as the document is read so it can only be the last member.
+func (jp *JSONDocumentPreprocessor) writeDocument(out io.Writer, walker *jsonWalker, header, filename string, timestamp *json.Token) error {
+	if _, err := io.WriteString(out, header); err != nil {
+		return fmt.Errorf("unable to write header to output file: %w", err)
+	}
+
+	if err := walker.value(); err != nil {
+		return fmt.Errorf("unable to read document in %q: %w", filename, err)
+	}
+
+	member, err := encodeMembers([]recordField{jp.Schema.timestamp(documentTimestamp(*timestamp), filename)})
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(out, ", "+strings.TrimSuffix(member, ", ")+"}\n"); err != nil {
+		return fmt.Errorf("unable to write ending to output file: %w", err)
+	}
+
+	return nil
+}
+
+// isJSONDocument returns true if the first non-whitespace character is the start of an object or array.
+func isJSONDocument(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{', '[':
+			return reader.UnreadByte() == nil
+		default:
+			return false
+		}
+	}
+}
+
+// documentTimestamp formats the timestamp found in a document, strings are used as is and numbers are epoch times.
+// If there is no usable timestamp the current time is used.
+func documentTimestamp(token json.Token) string {
+	switch value := token.(type) {
+	case string:
+		if value != "" {
+			return value
+		}
+	case json.Number:
+		if epoch, err := value.Float64(); err == nil {
+			if epoch > epochMillisecondsThreshold {
+				return time.UnixMilli(int64(epoch)).UTC().Format(time.RFC3339Nano)
+			}
+
+			seconds, fraction := math.Modf(epoch)
+
+			return time.Unix(int64(seconds), int64(fraction*float64(time.Second))).UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	return time.Now().Format(time.RFC3339)
+}
+
+// RegisterJSONDocumentTypes registers a JSON document preprocessor for each type in a comma separated list of
+// <type>[=<timestamp path>], e.g. events=$.meta.time, so a directory of them can be configured like any other preprocessor.
+// The type names the preprocessor and the output files, the timestamp path locates the timestamp in each document.
+func RegisterJSONDocumentTypes(value string) error {
+	types := map[string]bool{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		documentType, expression, _ := strings.Cut(entry, "=")
+		documentType = strings.TrimSpace(documentType)
+
+		if !documentTypeRegex.MatchString(documentType) || documentType == "." || documentType == ".." {
+			return fmt.Errorf("%w: invalid type %q", ErrInvalidJSONDocumentType, documentType)
+		}
+
+		if types[documentType] || slices.Contains(RegisteredPreprocessors(), documentType) {
+			return fmt.Errorf("%w: %q is already registered", ErrInvalidJSONDocumentType, documentType)
+		}
+
+		types[documentType] = true
+
+		var timestampPath []string
+
+		if expression = strings.TrimSpace(expression); expression != "" {
+			path, err := parseJSONPath(expression)
+			if err != nil {
+				return fmt.Errorf("unable to parse %q: %w", entry, err)
+			}
+
+			timestampPath = path
+		}
+
+		RegisterPreprocessor(documentType, func() Preprocessor {
+			return &JSONDocumentPreprocessor{
+				Type:          documentType,
+				TimestampPath: timestampPath,
+				Redactor:      defaultRedactor(),
+				Schema:        defaultOutputSchema(),
+			}
+		})
+	}
+
+	return nil
+}
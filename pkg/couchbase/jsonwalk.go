@@ -0,0 +1,240 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidJSONPath indicates a JSON path could not be parsed.
+var ErrInvalidJSONPath = errors.New("invalid JSON path")
+
+// jsonWalker streams a JSON value a token at a time so it is never held in memory, calling visit with the path of every scalar.
+// Paths are a list of member names and array indices, e.g. ["nodesInfo", "active_nodes", "[0]"].
+// If out is set the value is also written to it on a single line.
+type jsonWalker struct {
+	decoder *json.Decoder
+	out     io.Writer
+	path    []string
+	visit   func(path []string, token json.Token)
+}
+
+func newJSONWalker(source io.Reader, out io.Writer, visit func(path []string, token json.Token)) *jsonWalker {
+	decoder := json.NewDecoder(source)
+	decoder.UseNumber()
+
+	return &jsonWalker{decoder: decoder, out: out, visit: visit}
+}
+
+// value walks the next value, recursing into objects and arrays.
+func (w *jsonWalker) value() error {
+	token, err := w.decoder.Token()
+	if err != nil {
+		return fmt.Errorf("unable to read %q: %w", formatJSONPath(w.path), err)
+	}
+
+	switch token {
+	case json.Delim('{'):
+		return w.object()
+	case json.Delim('['):
+		return w.array()
+	default:
+		if w.visit != nil {
+			w.visit(w.path, token)
+		}
+
+		return w.write(encodeJSONScalar(token))
+	}
+}
+
+// object walks the members of an object, the opening delimiter must already have been read.
+func (w *jsonWalker) object() error {
+	if err := w.write("{"); err != nil {
+		return err
+	}
+
+	for i := 0; w.decoder.More(); i++ {
+		token, err := w.decoder.Token()
+		if err != nil {
+			return fmt.Errorf("unable to read key in %q: %w", formatJSONPath(w.path), err)
+		}
+
+		key, _ := token.(string)
+
+		separator := ""
+		if i > 0 {
+			separator = ","
+		}
+
+		if err := w.write(separator + encodeJSONScalar(key) + ":"); err != nil {
+			return err
+		}
+
+		if err := w.member(key); err != nil {
+			return err
+		}
+	}
+
+	return w.end("}")
+}
+
+// array walks the elements of an array, the opening delimiter must already have been read.
+func (w *jsonWalker) array() error {
+	if err := w.write("["); err != nil {
+		return err
+	}
+
+	for i := 0; w.decoder.More(); i++ {
+		if i > 0 {
+			if err := w.write(","); err != nil {
+				return err
+			}
+		}
+
+		if err := w.member("[" + strconv.Itoa(i) + "]"); err != nil {
+			return err
+		}
+	}
+
+	return w.end("]")
+}
+
+func (w *jsonWalker) member(name string) error {
+	w.path = append(w.path, name)
+
+	if err := w.value(); err != nil {
+		return err
+	}
+
+	w.path = w.path[:len(w.path)-1]
+
+	return nil
+}
+
+// end consumes the closing delimiter.
+func (w *jsonWalker) end(delim string) error {
+	if _, err := w.decoder.Token(); err != nil {
+		return fmt.Errorf("unable to read end of %q: %w", formatJSONPath(w.path), err)
+	}
+
+	return w.write(delim)
+}
+
+func (w *jsonWalker) write(s string) error {
+	if w.out == nil {
+		return nil
+	}
+
+	if _, err := io.WriteString(w.out, s); err != nil {
+		return fmt.Errorf("unable to write to output file: %w", err)
+	}
+
+	return nil
+}
+
+// encodeJSONScalar encodes a scalar token.
+func encodeJSONScalar(token json.Token) string {
+	switch value := token.(type) {
+	case json.Number:
+		return value.String()
+	case nil:
+		return "null"
+	}
+
+	// Only strings and booleans are left which always encode
+	encoded, _ := encodeJSON(token)
+
+	return encoded
+}
+
+// encodeJSON encodes the value without escaping HTML characters so any user data tags are left for redaction.
+func encodeJSON(value any) (string, error) {
+	var out bytes.Buffer
+
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return "", fmt.Errorf("unable to encode JSON: %w", err)
+	}
+
+	return string(bytes.TrimSuffix(out.Bytes(), []byte("\n"))), nil
+}
+
+// isJSONIndex returns true if the path element is an array index.
+func isJSONIndex(element string) bool {
+	return strings.HasPrefix(element, "[")
+}
+
+// formatJSONPath formats a path in the same way as the exploded sections, e.g. $.nodesInfo.active_nodes[0].
+func formatJSONPath(path []string) string {
+	var formatted strings.Builder
+
+	formatted.WriteString("$")
+
+	for _, element := range path {
+		if !isJSONIndex(element) {
+			formatted.WriteString(".")
+		}
+
+		formatted.WriteString(element)
+	}
+
+	return formatted.String()
+}
+
+// parseJSONPath parses a simple JSON path of member names and array indices, e.g. $.meta.time or events[0].timestamp.
+// The leading $ is optional.
+func parseJSONPath(expression string) ([]string, error) {
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(expression), "$"), ".")
+	if trimmed == "" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidJSONPath, expression)
+	}
+
+	var path []string
+
+	for _, part := range strings.Split(trimmed, ".") {
+		name, indices, indexed := strings.Cut(part, "[")
+
+		switch {
+		case name != "":
+			path = append(path, name)
+		case !indexed:
+			return nil, fmt.Errorf("%w: empty member in %q", ErrInvalidJSONPath, expression)
+		}
+
+		if !indexed {
+			continue
+		}
+
+		for _, index := range strings.Split(strings.TrimSuffix(indices, "]"), "][") {
+			if _, err := strconv.ParseUint(index, 10, 32); err != nil {
+				return nil, fmt.Errorf("%w: invalid index %q in %q", ErrInvalidJSONPath, index, expression)
+			}
+
+			path = append(path, "["+index+"]")
+		}
+	}
+
+	return path, nil
+}
@@ -0,0 +1,548 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/oklog/run"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// DefaultMirrorInterval is how often the mirrored log files are checked for new data.
+	DefaultMirrorInterval = time.Second
+	// mirrorRotatedSuffix is appended to a mirror when its source is rotated, only the last one is kept.
+	mirrorRotatedSuffix = ".1"
+	mirrorPermissions   = 0600
+	// mirrorStateSuffix is the hidden file next to a mirror recording how much of its source has been mirrored.
+	mirrorStateSuffix = ".offset"
+)
+
+// ErrRedactionNotEnabled indicates a redacted mirror has been requested without a redaction mode.
+var ErrRedactionNotEnabled = errors.New("redaction mode must be set to mirror redacted logs")
+
+// RedactedMirror tails log files itself, redacts them and writes a mirror of each to the output directory.
+// Fluent Bit then tails the mirrors rather than the original logs so no Lua redaction is required.
+// Sources are polled so rotation (the file is replaced) and truncation (the file shrinks) are both detected:
+// - on rotation the rest of the old file is mirrored then the mirror is rotated to <name>.1 and a new one started
+// - on truncation the mirror is truncated as well and the source read again from the start.
+// The offset mirrored up to is saved so a restart carries on appending to the mirror rather than Fluent Bit shipping it all again.
+// An open tag still waiting for its closing tag when stopped is not written out, it is read again from the source on restart.
+// Mirrors keep the path of their source relative to the source directory so files with the same name never share a mirror.
+// Sources that are JSON lines, i.e. start with {, have the contents of tags JSON decoded before hashing as the Lua filter
+// sees the parsed record.
+type RedactedMirror struct {
+	sourceDir string
+	outputDir string
+	patterns  []string
+	redactor  *Redactor
+	interval  time.Duration
+	files     map[string]*mirroredFile
+}
+
+// mirroredFile is the state of a single source file being mirrored.
+type mirroredFile struct {
+	path       string
+	outputPath string
+	source     *os.File
+	info       os.FileInfo
+	offset     int64
+	// saved is the offset last written to the state file.
+	saved  int64
+	output *os.File
+	writer *redactingWriter
+}
+
+// NewRedactedMirror mirrors the files matching any of the patterns in the source directory into the output directory.
+func NewRedactedMirror(sourceDir, outputDir string, patterns []string, redactor *Redactor, interval time.Duration) (*RedactedMirror, error) {
+	if redactor == nil {
+		return nil, ErrRedactionNotEnabled
+	}
+
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	if interval <= 0 {
+		interval = DefaultMirrorInterval
+	}
+
+	return &RedactedMirror{
+		sourceDir: filepath.Clean(sourceDir),
+		outputDir: filepath.Clean(outputDir),
+		patterns:  patterns,
+		redactor:  redactor,
+		interval:  interval,
+		files:     map[string]*mirroredFile{},
+	}, nil
+}
+
+func (rm *RedactedMirror) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("sourceDir", rm.sourceDir)
+	enc.AddString("outputDir", rm.outputDir)
+	enc.AddString("patterns", strings.Join(rm.patterns, ","))
+	enc.AddString("redaction", string(rm.redactor.Mode()))
+	enc.AddDuration("interval", rm.interval)
+
+	return nil
+}
+
+func (rm *RedactedMirror) GetOutputDir() string {
+	return rm.outputDir
+}
+
+// CreateOutputDir creates the output directory if it does not exist.
+func (rm *RedactedMirror) CreateOutputDir() error {
+	err := os.Mkdir(rm.outputDir, rebalanceDirPermissions)
+
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("unable to create output directory %q: %w", rm.outputDir, err)
+	}
+
+	return nil
+}
+
+// sources returns every file in the source directory matching a pattern.
+func (rm *RedactedMirror) sources() ([]string, error) {
+	found := map[string]bool{}
+
+	for _, pattern := range rm.patterns {
+		matches, err := filepath.Glob(filepath.Join(rm.sourceDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+
+		for _, match := range matches {
+			if strings.HasPrefix(filepath.Base(match), ".") {
+				continue
+			}
+
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				found[match] = true
+			}
+		}
+	}
+
+	sources := make([]string, 0, len(found))
+	for source := range found {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+
+	return sources, nil
+}
+
+// Sync mirrors any new data in all the source files.
+// An error with one file does not stop the others being mirrored, the first one is returned.
+func (rm *RedactedMirror) Sync() error {
+	sources, err := rm.sources()
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if _, exists := rm.files[source]; !exists {
+			relative, err := filepath.Rel(rm.sourceDir, source)
+			if err != nil {
+				return fmt.Errorf("unable to find mirror for %q: %w", source, err)
+			}
+
+			rm.files[source] = &mirroredFile{
+				path:       source,
+				outputPath: filepath.Join(rm.outputDir, relative),
+				saved:      -1,
+			}
+		}
+	}
+
+	var firstErr error
+
+	for _, source := range sortedKeys(rm.files) {
+		if err := rm.files[source].sync(rm.redactor); err != nil {
+			log.Warnw("Unable to mirror file", "file", source, "error", err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Close saves how far each source has been mirrored and closes all the mirrors.
+func (rm *RedactedMirror) Close() error {
+	var firstErr error
+
+	for _, mf := range rm.files {
+		if err := mf.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	rm.files = map[string]*mirroredFile{}
+
+	return firstErr
+}
+
+// AddWatcher periodically mirrors the source files until interrupted.
+func (rm *RedactedMirror) AddWatcher(g *run.Group) error {
+	log.Infow("Mirroring redacted logs", "mirror", rm)
+
+	done := make(chan bool)
+
+	g.Add(
+		func() error {
+			ticker := time.NewTicker(rm.interval)
+			defer ticker.Stop()
+
+			for {
+				// Errors are logged per file, we keep going as they may be transient, e.g. a file removed whilst reading
+				_ = rm.Sync()
+
+				select {
+				case <-done:
+					return rm.Close()
+				case <-ticker.C:
+				}
+			}
+		},
+		func(_ error) {
+			close(done)
+		},
+	)
+
+	return nil
+}
+
+func sortedKeys(files map[string]*mirroredFile) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// sync copies any new data from the source to the mirror, dealing with rotation and truncation first.
+func (mf *mirroredFile) sync(redactor *Redactor) error {
+	current, err := os.Stat(mf.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to stat %q: %w", mf.path, err)
+	}
+
+	if mf.source != nil {
+		switch {
+		case current == nil || !os.SameFile(mf.info, current):
+			// Rotated (or removed) so finish off the old file, we keep going with the new one if there is one
+			if err := mf.rotate(); err != nil {
+				return err
+			}
+		case current.Size() < mf.offset:
+			if err := mf.truncate(redactor); err != nil {
+				return err
+			}
+		}
+	}
+
+	if mf.source == nil {
+		if current == nil {
+			return nil
+		}
+
+		if err := mf.open(redactor); err != nil {
+			return err
+		}
+	}
+
+	return mf.copy()
+}
+
+// statePath is hidden so a tail input of the mirrors never matches it.
+func (mf *mirroredFile) statePath() string {
+	dir, base := filepath.Split(mf.outputPath)
+
+	return filepath.Join(dir, "."+base+mirrorStateSuffix)
+}
+
+// inode identifies the source across restarts, unlike os.SameFile which needs both files to be stat'ed now.
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+
+	return 0
+}
+
+// readState returns the inode of the source and the offset mirrored up to when the state was last saved.
+func (mf *mirroredFile) readState() (uint64, int64, bool) {
+	data, err := os.ReadFile(mf.statePath())
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var (
+		ino    uint64
+		offset int64
+	)
+
+	if _, err := fmt.Sscanf(string(data), "%d %d", &ino, &offset); err != nil || offset < 0 {
+		log.Warnw("Ignoring invalid mirror state", "file", mf.statePath(), "error", err)
+
+		return 0, 0, false
+	}
+
+	return ino, offset, true
+}
+
+// mirrored returns the offset in the source up to which everything has been written to the mirror.
+// Anything still buffered, e.g. an open tag without its closing tag yet, is after it.
+func (mf *mirroredFile) mirrored() int64 {
+	return mf.offset - int64(mf.writer.buffered())
+}
+
+// saveState records the offset up to which everything read has been written to the mirror.
+// It is replaced atomically so a crash leaves either the old or the new offset, the worst case is some lines mirrored again.
+func (mf *mirroredFile) saveState() error {
+	if mf.source == nil || mf.mirrored() == mf.saved {
+		return nil
+	}
+
+	state := mf.statePath()
+	pending := state + ".tmp"
+	offset := mf.mirrored()
+
+	if err := os.WriteFile(pending, []byte(fmt.Sprintf("%d %d\n", inode(mf.info), offset)), mirrorPermissions); err != nil {
+		return fmt.Errorf("unable to save mirror state %q: %w", state, err)
+	}
+
+	if err := os.Rename(pending, state); err != nil {
+		return fmt.Errorf("unable to save mirror state %q: %w", state, err)
+	}
+
+	mf.saved = offset
+
+	return nil
+}
+
+func (mf *mirroredFile) removeState() error {
+	if err := os.Remove(mf.statePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to remove mirror state %q: %w", mf.statePath(), err)
+	}
+
+	mf.saved = -1
+
+	return nil
+}
+
+// resumeOffset returns where to carry on mirroring the source from after a restart.
+// A source rotated whilst we were not running has its old mirror rotated as well and one that shrank is mirrored again,
+// as if we had seen it happen.
+func (mf *mirroredFile) resumeOffset(info os.FileInfo) (int64, error) {
+	ino, offset, found := mf.readState()
+	if !found {
+		return 0, nil
+	}
+
+	if _, err := os.Stat(mf.outputPath); err != nil {
+		return 0, mf.removeState()
+	}
+
+	switch {
+	case ino != inode(info):
+		log.Infow("Mirrored file rotated whilst stopped", "file", mf.path, "mirror", mf.outputPath)
+
+		if err := os.Rename(mf.outputPath, mf.outputPath+mirrorRotatedSuffix); err != nil {
+			return 0, fmt.Errorf("unable to rotate mirror %q: %w", mf.outputPath, err)
+		}
+
+		return 0, mf.removeState()
+	case info.Size() < offset:
+		log.Infow("Mirrored file truncated whilst stopped", "file", mf.path, "mirror", mf.outputPath, "offset", offset)
+
+		return 0, mf.removeState()
+	}
+
+	mf.saved = offset
+
+	return offset, nil
+}
+
+// open starts mirroring the source, appending to the mirror from the saved offset or replacing it from the beginning.
+func (mf *mirroredFile) open(redactor *Redactor) error {
+	source, err := os.Open(mf.path)
+	if err != nil {
+		return fmt.Errorf("unable to open %q: %w", mf.path, err)
+	}
+
+	info, err := source.Stat()
+	if err != nil {
+		_ = source.Close()
+
+		return fmt.Errorf("unable to stat %q: %w", mf.path, err)
+	}
+
+	offset, err := mf.resumeOffset(info)
+	if err != nil {
+		_ = source.Close()
+
+		return err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+
+		if _, err := source.Seek(offset, io.SeekStart); err != nil {
+			_ = source.Close()
+
+			return fmt.Errorf("unable to seek %q: %w", mf.path, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(mf.outputPath), rebalanceDirPermissions); err != nil {
+		_ = source.Close()
+
+		return fmt.Errorf("unable to create mirror directory for %q: %w", mf.outputPath, err)
+	}
+
+	output, err := os.OpenFile(mf.outputPath, flags, mirrorPermissions)
+	if err != nil {
+		_ = source.Close()
+
+		return fmt.Errorf("unable to create mirror %q: %w", mf.outputPath, err)
+	}
+
+	log.Infow("Mirroring file", "file", mf.path, "mirror", mf.outputPath, "offset", offset)
+
+	mf.source, mf.info, mf.offset = source, info, offset
+	mf.output, mf.writer = output, redactor.newWriter(output, jsonLines(source))
+
+	return nil
+}
+
+// jsonLines returns true if the source is a JSON log, i.e. a record per line, rather than plain text.
+func jsonLines(source *os.File) bool {
+	first := make([]byte, 1)
+	if _, err := source.ReadAt(first, 0); err != nil {
+		return false
+	}
+
+	return first[0] == '{'
+}
+
+// copy mirrors everything from the current offset to the end of the source.
+func (mf *mirroredFile) copy() error {
+	// An empty source may turn out to be JSON once something is written to it
+	if mf.offset == 0 && !mf.writer.jsonEscaped {
+		mf.writer.jsonEscaped = jsonLines(mf.source)
+	}
+
+	copied, err := io.Copy(mf.writer, mf.source)
+	mf.offset += copied
+
+	if err != nil {
+		return fmt.Errorf("unable to mirror %q: %w", mf.path, err)
+	}
+
+	return mf.saveState()
+}
+
+// rotate mirrors the rest of the old source then moves the mirror aside in the same way as the source.
+func (mf *mirroredFile) rotate() error {
+	log.Infow("Mirrored file rotated", "file", mf.path, "mirror", mf.outputPath)
+
+	if err := mf.copy(); err != nil {
+		return err
+	}
+
+	// Nothing more will be written to the old source so an unterminated tag is left as is, as the Lua filter does
+	if err := mf.writer.Close(); err != nil {
+		return err
+	}
+
+	if err := mf.close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(mf.outputPath, mf.outputPath+mirrorRotatedSuffix); err != nil {
+		return fmt.Errorf("unable to rotate mirror %q: %w", mf.outputPath, err)
+	}
+
+	return mf.removeState()
+}
+
+// truncate restarts both the source and the mirror from the beginning.
+func (mf *mirroredFile) truncate(redactor *Redactor) error {
+	log.Infow("Mirrored file truncated", "file", mf.path, "mirror", mf.outputPath, "offset", mf.offset)
+
+	// Anything pending was from before the truncation
+	if err := mf.writer.Close(); err != nil {
+		return err
+	}
+
+	if err := mf.output.Truncate(0); err != nil {
+		return fmt.Errorf("unable to truncate mirror %q: %w", mf.outputPath, err)
+	}
+
+	if _, err := mf.output.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek mirror %q: %w", mf.outputPath, err)
+	}
+
+	if _, err := mf.source.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to seek %q: %w", mf.path, err)
+	}
+
+	mf.offset = 0
+	mf.writer = redactor.newWriter(mf.output, jsonLines(mf.source))
+
+	return mf.removeState()
+}
+
+// close saves the offset and closes both files.
+// Anything still buffered is not written out, an open tag would be shipped unredacted, so it is read again on restart.
+func (mf *mirroredFile) close() error {
+	if mf.source == nil {
+		return nil
+	}
+
+	err := mf.saveState()
+
+	_ = mf.source.Close()
+
+	if closeErr := mf.output.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("unable to close mirror %q: %w", mf.outputPath, closeErr)
+	}
+
+	mf.source, mf.info, mf.output, mf.writer = nil, nil, nil, nil
+
+	return err
+}
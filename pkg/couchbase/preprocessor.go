@@ -0,0 +1,496 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"github.com/fsnotify/fsnotify"
+	"github.com/oklog/run"
+	"go.uber.org/zap/zapcore"
+)
+
+// Preprocessor transforms a file that Fluent Bit cannot tail directly into tail-friendly NDJSON.
+type Preprocessor interface {
+	// Name is the name the preprocessor is registered under.
+	Name() string
+	// Match returns true if the file should be processed.
+	Match(filename string) bool
+	// Transform writes the processed contents of the file, every record must be a single line.
+	// The source is always decompressed first. Return ErrSkipFile to ignore a file that is not in the expected format.
+	Transform(out io.Writer, source io.Reader, filename string) error
+	// OutputPattern is the pattern for output file names, as per os.CreateTemp, e.g. "rebalance-processed-*.json".
+	OutputPattern() string
+}
+
+// PublishHook is implemented by a preprocessor that acts on a file once its output has been published,
+// e.g. anything with a side effect that must not be repeated if the file is processed again after failing to publish.
+type PublishHook interface {
+	Published(filename string)
+}
+
+// StatefulPreprocessor is implemented by a preprocessor that remembers what it has processed across restarts.
+// The state is loaded from the output directory when it is created, it must be hidden so retention leaves it alone.
+type StatefulPreprocessor interface {
+	LoadState(outputDir string) error
+}
+
+// PreprocessorFactory creates a new preprocessor configured from the environment.
+type PreprocessorFactory func() Preprocessor
+
+var (
+	// ErrUnknownPreprocessor indicates no preprocessor is registered with the name.
+	ErrUnknownPreprocessor = errors.New("unknown preprocessor")
+	// ErrInvalidWatchedDirectory indicates a watched directory could not be parsed.
+	ErrInvalidWatchedDirectory = errors.New("invalid watched directory")
+	// ErrSkipFile indicates a file is not one the preprocessor handles so nothing is published for it.
+	ErrSkipFile = errors.New("skipping file")
+
+	registryMutex sync.RWMutex
+	registry      = map[string]PreprocessorFactory{}
+)
+
+// RegisterPreprocessor makes a preprocessor available by name to configure watched directories with.
+func RegisterPreprocessor(name string, factory PreprocessorFactory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	registry[name] = factory
+}
+
+// NewPreprocessor creates the preprocessor registered with the name.
+func NewPreprocessor(name string) (Preprocessor, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownPreprocessor, name)
+	}
+
+	return factory(), nil
+}
+
+// RegisteredPreprocessors lists the names of all registered preprocessors.
+func RegisteredPreprocessors() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// WatchedDirectory is a directory of files to pre-process into an output directory for Fluent Bit to tail.
+type WatchedDirectory struct {
+	watchDir,
+	outputDir string
+	processor Preprocessor
+	retention RetentionPolicy
+	filter    FileFilter
+	skipped   *skipCounter
+}
+
+func NewWatchedDirectory(watchDir, outputDir string, processor Preprocessor, retention RetentionPolicy) WatchedDirectory {
+	return WatchedDirectory{
+		watchDir:  filepath.Clean(watchDir),
+		outputDir: filepath.Clean(outputDir),
+		processor: processor,
+		retention: retention,
+		skipped:   &skipCounter{},
+	}
+}
+
+// WithFilter returns a copy of the watched directory only processing the files selected by the filter.
+func (wd WatchedDirectory) WithFilter(filter FileFilter) WatchedDirectory {
+	wd.filter = filter
+
+	return wd
+}
+
+func (wd WatchedDirectory) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("watchDir", wd.watchDir)
+	enc.AddString("outputDir", wd.outputDir)
+	enc.AddString("processor", wd.processor.Name())
+
+	if err := enc.AddObject("filter", wd.filter); err != nil {
+		return err
+	}
+
+	return enc.AddObject("retention", wd.retention)
+}
+
+// SkippedFiles returns how many files have been skipped by the filter for each reason.
+func (wd WatchedDirectory) SkippedFiles() map[string]int64 {
+	return wd.skipped.snapshot()
+}
+
+func (wd WatchedDirectory) GetWatchDir() string {
+	return wd.watchDir
+}
+
+func (wd WatchedDirectory) GetOutputDir() string {
+	return wd.outputDir
+}
+
+// ParseWatchedDirectories parses a comma separated list of <processor>:<watch directory>[:<output directory>].
+// Relative watch directories are relative to the log directory, the output directory defaults to /tmp/<processor>-logs.
+func ParseWatchedDirectories(value, logDir string, retention RetentionPolicy) ([]WatchedDirectory, error) {
+	var directories []WatchedDirectory
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		const minParts, maxParts = 2, 3
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < minParts || len(parts) > maxParts {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidWatchedDirectory, entry)
+		}
+
+		processor, err := NewPreprocessor(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		watchDir := parts[1]
+		if !filepath.IsAbs(watchDir) {
+			watchDir = filepath.Join(logDir, watchDir)
+		}
+
+		outputDir := filepath.Join(os.TempDir(), parts[0]+"-logs")
+		if len(parts) == maxParts {
+			outputDir = parts[2]
+		}
+
+		directories = append(directories, NewWatchedDirectory(watchDir, outputDir, processor, retention))
+	}
+
+	return directories, nil
+}
+
+// checkOutputDirs makes sure no two watched directories share an output directory, nor with any of the others given,
+// and that no output directory is watched. Otherwise retention policies remove each other's files or output is processed again.
+func checkOutputDirs(directories []WatchedDirectory, others ...string) error {
+	watched := map[string]bool{}
+	for _, wd := range directories {
+		watched[wd.watchDir] = true
+	}
+
+	outputs := map[string]bool{}
+	for _, dir := range others {
+		outputs[filepath.Clean(dir)] = true
+	}
+
+	for _, wd := range directories {
+		if watched[wd.outputDir] {
+			return fmt.Errorf("%w: output directory %q is also watched", ErrInvalidWatchedDirectory, wd.outputDir)
+		}
+
+		if outputs[wd.outputDir] {
+			return fmt.Errorf("%w: output directory %q is already in use, set a different one", ErrInvalidWatchedDirectory, wd.outputDir)
+		}
+
+		outputs[wd.outputDir] = true
+	}
+
+	return nil
+}
+
+// CreateOutputDir creates the output directory if it does not exist, removes any temporary files left by a previous run
+// and loads the state of the preprocessor.
+func (wd WatchedDirectory) CreateOutputDir() error {
+	// Sub-directories per node are within a shared output directory
+	err := os.MkdirAll(wd.outputDir, rebalanceDirPermissions)
+
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("unable to create output directory %q: %w", wd.outputDir, err)
+	}
+
+	if err := wd.removePendingFiles(); err != nil {
+		return err
+	}
+
+	if stateful, ok := wd.processor.(StatefulPreprocessor); ok {
+		return stateful.LoadState(wd.outputDir)
+	}
+
+	return nil
+}
+
+// removePendingFiles removes temporary files that were never published because we stopped part way through.
+// They are hidden so retention never sees them, this is only safe at startup before anything is being processed.
+func (wd WatchedDirectory) removePendingFiles() error {
+	pending, err := filepath.Glob(filepath.Join(wd.outputDir, pendingPattern(wd.processor.OutputPattern())))
+	if err != nil {
+		return fmt.Errorf("unable to find temporary files in %q: %w", wd.outputDir, err)
+	}
+
+	for _, path := range pending {
+		log.Infow("Removing unpublished temporary file", "file", path, "processor", wd.processor.Name())
+
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unable to remove temporary file %q: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// pendingPattern is the output pattern hidden and with a different suffix so a tail input never matches a file still being written.
+func pendingPattern(outputPattern string) string {
+	return "." + outputPattern + ".tmp"
+}
+
+// ProcessFile pre-processes a single file into the output directory then applies the retention policy.
+func (wd WatchedDirectory) ProcessFile(filename string) error {
+	// The filename must include the directory as well
+	filename = filepath.Clean(filename)
+
+	// A file removed before we get to it is reported when we try to open it
+	info, _ := os.Stat(filename)
+
+	if reason := wd.filter.skipReason(filename, info); reason != "" {
+		total := wd.skipped.add(reason)
+		log.Debugw("Skipping file", "file", filename, "reason", reason, "totalSkipped", total, "processor", wd.processor.Name())
+
+		return nil
+	}
+
+	if !wd.processor.Match(filename) {
+		log.Debugw("Skipping file not matched by preprocessor", "file", filename, "processor", wd.processor.Name())
+
+		return nil
+	}
+
+	log.Infow("Processing file", "file", filename, "processor", wd.processor.Name())
+
+	// We stream the contents through rather than reading them in one go as files can be very large
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open file %q: %w", filename, err)
+	}
+	defer file.Close()
+
+	source, compression, err := decompress(file)
+	if err != nil {
+		return fmt.Errorf("unable to read file %q: %w", filename, err)
+	}
+	defer source.Close()
+
+	// Copy file to a temporary one hidden from Fluent Bit until it is complete
+	tmpfile, err := os.CreateTemp(wd.outputDir, pendingPattern(wd.processor.OutputPattern()))
+	if err != nil {
+		return fmt.Errorf("unable to create temporary output file in %q: %w", wd.outputDir, err)
+	}
+
+	published := false
+
+	defer func() {
+		if !published {
+			_ = tmpfile.Close()
+			_ = os.Remove(tmpfile.Name())
+		}
+	}()
+
+	log.Infow("Creating file", "new", tmpfile.Name(), "original", filename, "compression", compression)
+
+	if err := wd.processor.Transform(tmpfile, source, filename); err != nil {
+		if errors.Is(err, ErrSkipFile) {
+			log.Warnw("Skipping file", "file", filename, "processor", wd.processor.Name(), "reason", err)
+
+			return nil
+		}
+
+		return err
+	}
+
+	if info, err := tmpfile.Stat(); err == nil && info.Size() == 0 {
+		log.Infow("Nothing to publish", "original", filename)
+
+		return nil
+	}
+
+	outputFile, err := publish(tmpfile, wd.processor.OutputPattern())
+	if err != nil {
+		return err
+	}
+
+	published = true
+
+	log.Infow("Published file", "new", outputFile, "original", filename)
+
+	if hook, ok := wd.processor.(PublishHook); ok {
+		hook.Published(filename)
+	}
+
+	// Once we have created a file, remove any older ones outside of the retention policy
+	return wd.retention.Apply(wd.outputDir)
+}
+
+// publish makes the completed temporary file visible to Fluent Bit.
+// Everything is flushed to disk first then it is atomically renamed so it can never be read partially written.
+func publish(tmpfile *os.File, outputPattern string) (string, error) {
+	if err := tmpfile.Sync(); err != nil {
+		return "", fmt.Errorf("unable to sync output file: %w", err)
+	}
+
+	if err := tmpfile.Close(); err != nil {
+		return "", fmt.Errorf("unable to close output file: %w", err)
+	}
+
+	// Swap the random part of the temporary name into the output pattern
+	dir, base := filepath.Split(tmpfile.Name())
+	prefix, suffix, _ := strings.Cut(pendingPattern(outputPattern), "*")
+	unique := strings.TrimSuffix(strings.TrimPrefix(base, prefix), suffix)
+	outputPrefix, outputSuffix, _ := strings.Cut(outputPattern, "*")
+	outputFile := filepath.Join(dir, outputPrefix+unique+outputSuffix)
+
+	if err := os.Rename(tmpfile.Name(), outputFile); err != nil {
+		return "", fmt.Errorf("unable to rename %q to %q: %w", tmpfile.Name(), outputFile, err)
+	}
+
+	// Make sure the rename itself is durable
+	if d, err := os.Open(filepath.Clean(dir)); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return outputFile, nil
+}
+
+// ProcessExisting pre-processes all the files already in the watched directory.
+func (wd WatchedDirectory) ProcessExisting() error {
+	files, err := os.ReadDir(wd.watchDir)
+	if err != nil {
+		return fmt.Errorf("unable to read input directory %q: %w", wd.watchDir, err)
+	}
+
+	for _, f := range files {
+		filename := filepath.Join(wd.watchDir, f.Name())
+
+		err = wd.ProcessFile(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infow("Processed all existing files in watch directory", "dir", wd.watchDir, "skipped", wd.SkippedFiles())
+
+	return nil
+}
+
+func (wd WatchedDirectory) fileHandler(filename string) {
+	// Now we need to get the filename and copy it to the actual tailed location
+	// The mount should be read-only and we do not want to edit-in-place anyway so take a temporary copy to work with
+	err := wd.ProcessFile(filename)
+	if err != nil {
+		log.Errorw("Error reading file", "file", filename, "error", err)
+	}
+}
+
+// directoryHandler moves the watch towards the watched directory, processing any files already in it once it appears.
+func (wd WatchedDirectory) directoryHandler(waiter *common.PathWaiter) {
+	found, err := waiter.Update()
+	if err != nil {
+		log.Errorw("Unable to wait for watched directory", "dir", wd.watchDir, "error", err)
+
+		return
+	}
+
+	if !found {
+		return
+	}
+
+	err = wd.ProcessExisting()
+	if err != nil {
+		log.Errorw("Unable to read files in watched directory", "error", err, "directory", wd)
+	}
+}
+
+// AddWatcher watches the directory for new files to pre-process.
+// The directory, or any of its parents, may not exist when the container starts so we wait for it to appear.
+func (wd WatchedDirectory) AddWatcher(g *run.Group) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("unable to create %s watcher: %w", wd.processor.Name(), err)
+	}
+
+	waiter, err := common.NewPathWaiter(watcher, wd.watchDir)
+	if err != nil {
+		_ = watcher.Close()
+
+		return fmt.Errorf("unable to add %s watcher: %w", wd.processor.Name(), err)
+	}
+
+	done := make(chan bool)
+
+	g.Add(
+		func() error {
+			for {
+				select {
+				case <-done:
+					return nil
+				case event := <-watcher.Events:
+					// Any change to a parent may mean we are closer to the watched directory, or it may have been removed
+					waiter.Removed(event)
+
+					if !waiter.Found() {
+						wd.directoryHandler(waiter)
+
+						continue
+					}
+
+					if !common.IsValidEvent(event) {
+						continue
+					}
+
+					log.Debugw("Couchbase watcher event triggered", "event", event, "processor", wd.processor.Name())
+
+					wd.fileHandler(event.Name)
+				case err := <-watcher.Errors:
+					log.Errorw("Couchbase watcher error", "error", err, "processor", wd.processor.Name())
+
+					return nil
+				}
+			}
+		},
+		func(_ error) {
+			_ = watcher.Close()
+
+			close(done)
+		},
+	)
+
+	return nil
+}
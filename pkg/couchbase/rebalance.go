@@ -0,0 +1,239 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+// RebalancePreprocessorName is the name the rebalance report preprocessor is registered under.
+const RebalancePreprocessorName = "rebalance"
+
+func init() {
+	RegisterPreprocessor(RebalancePreprocessorName, func() Preprocessor {
+		return &RebalancePreprocessor{
+			Explode:  common.GetRebalanceExplode(),
+			Redactor: defaultRedactor(),
+			Alerter:  defaultAlerter(),
+			Schema:   defaultOutputSchema(),
+		}
+	})
+}
+
+// RebalancePreprocessor wraps each rebalance report, a single JSON document with no trailing new line, as a record.
+type RebalancePreprocessor struct {
+	// Explode writes a record per section of the report rather than one for the whole report.
+	Explode bool
+	// Node tags every record with the node the report is from, if set.
+	Node string
+	// Redactor hashes any <ud> tagged user data in the report, nil disables redaction.
+	Redactor *Redactor
+	// Alerter raises an alert for a failed or stuck rebalance once its report is published, nil disables alerts.
+	Alerter *RebalanceAlerter
+	// Schema names the fields of each record, nil is the default schema.
+	Schema *OutputSchema
+
+	lock sync.Mutex
+	// pending is the alert for the report last transformed, raised once it is published.
+	pending *pendingAlert
+}
+
+// pendingAlert is the summary of a report to alert on once the report is published.
+type pendingAlert struct {
+	summary           *rebalanceSummary
+	originalTimestamp string
+	filename          string
+}
+
+func (rp *RebalancePreprocessor) Name() string {
+	return RebalancePreprocessorName
+}
+
+func (rp *RebalancePreprocessor) Match(_ string) bool {
+	return true
+}
+
+func (rp *RebalancePreprocessor) OutputPattern() string {
+	return "rebalance-processed-*.json"
+}
+
+func (rp *RebalancePreprocessor) Transform(out io.Writer, source io.Reader, filename string) error {
+	rp.setPending(nil)
+
+	if rp.Redactor == nil {
+		return rp.transform(out, source, filename)
+	}
+
+	// The output is always JSON so hash the user data as it was in the report
+	redacted := rp.Redactor.NewWriter(out, true)
+	if err := rp.transform(redacted, source, filename); err != nil {
+		return err
+	}
+
+	return redacted.Close()
+}
+
+func (rp *RebalancePreprocessor) transform(out io.Writer, source io.Reader, filename string) error {
+	// Make sure it is actually a report before we start writing anything out
+	buffered := bufio.NewReader(source)
+	if !isJSONObject(buffered) {
+		return fmt.Errorf("%w: %q is not a JSON object", ErrSkipFile, filename)
+	}
+
+	source = buffered
+	originalTimestamp := reportTimestamp(filename)
+
+	var (
+		summary *rebalanceSummary
+		err     error
+	)
+
+	metadata := rp.Schema.metadata(originalTimestamp, filename, rp.Node)
+
+	if rp.Explode {
+		summary, err = writeExploded(out, source, rp.Schema, metadata, filename)
+	} else {
+		summary, err = writeEnvelope(out, source, rp.Schema, metadata, filename)
+	}
+
+	if err != nil || summary == nil || rp.Alerter == nil {
+		return err
+	}
+
+	rp.setPending(&pendingAlert{summary: summary, originalTimestamp: originalTimestamp, filename: filename})
+
+	return nil
+}
+
+func (rp *RebalancePreprocessor) setPending(pending *pendingAlert) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	rp.pending = pending
+}
+
+// Published raises any alert for the report now that it has been published, so a report that fails to publish
+// and is processed again only ever raises one.
+func (rp *RebalancePreprocessor) Published(filename string) {
+	rp.lock.Lock()
+	pending := rp.pending
+	rp.pending = nil
+	rp.lock.Unlock()
+
+	if pending == nil || pending.filename != filename {
+		return
+	}
+
+	// The report itself is still shipped even if we cannot raise the alert
+	if err := rp.Alerter.Alert(pending.summary, pending.originalTimestamp, filename, rp.Node, rp.Redactor); err != nil {
+		log.Warnw("Unable to raise rebalance alert", "file", filename, "error", err)
+	}
+}
+
+// isJSONObject returns true if the first non-whitespace character is the start of an object.
+func isJSONObject(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return false
+		}
+
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return reader.UnreadByte() == nil
+		default:
+			return false
+		}
+	}
+}
+
+// reportTimestamp extracts the time we ran the original from the name, defaulting to the current time.
+func reportTimestamp(filename string) string {
+	re := regexp.MustCompile(`.*rebalance_report_(?P<time>.*)\.json`)
+
+	match := re.FindStringSubmatch(filename)
+	if len(match) > 1 {
+		return match[1]
+	}
+
+	return time.Now().Format(time.RFC3339)
+}
+
+// writeEnvelope wraps the whole report as a single record on one line after the metadata,
+// returning the summary of the report if it could be computed.
+func writeEnvelope(out io.Writer, source io.Reader, schema *OutputSchema, metadata []recordField, filename string) (*rebalanceSummary, error) {
+	members, err := encodeMembers(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	contentsName, _ := encodeJSON(schema.Field(fieldContents))
+	// It would be nicer just to use a JSON logger here
+	_, err = io.WriteString(out, "{"+members+contentsName+":")
+	if err != nil {
+		return nil, fmt.Errorf("unable to write header to output file: %w", err)
+	}
+
+	// Summarise the report as it is copied so it is only read once
+	summary := newBackgroundSummary()
+
+	_, err = io.Copy(singleLineWriter{out: out}, io.TeeReader(source, summary))
+	if err != nil {
+		summary.Abort()
+
+		return nil, fmt.Errorf("unable to write content to output file: %w", err)
+	}
+
+	// The summary sits next to the contents so it can be filtered on directly
+	computed, member := envelopeSummary(summary, schema, filename)
+
+	_, err = io.WriteString(out, member+"}\n")
+	if err != nil {
+		return nil, fmt.Errorf("unable to write ending to output file: %w", err)
+	}
+
+	return computed, nil
+}
+
+// envelopeSummary returns the summary along with the member to append to the envelope, or nothing if the report could not be summarised.
+func envelopeSummary(summary *backgroundSummary, schema *OutputSchema, filename string) (*rebalanceSummary, string) {
+	computed, err := summary.Summary()
+	if err != nil {
+		log.Warnw("Unable to summarise report", "file", filename, "error", err)
+
+		return nil, ""
+	}
+
+	member, err := encodeMembers([]recordField{{Name: schema.Field(fieldSummary), Value: computed}})
+	if err != nil {
+		log.Warnw("Unable to encode report summary", "file", filename, "error", err)
+
+		return computed, ""
+	}
+
+	return computed, ", " + strings.TrimSuffix(member, ", ")
+}
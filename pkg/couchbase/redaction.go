@@ -0,0 +1,368 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" //nolint:gosec // Required to match the existing Lua redaction, this is not used for security.
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+)
+
+// RedactionMode selects how user data is hashed.
+type RedactionMode string
+
+const (
+	// RedactionNone leaves user data as is.
+	RedactionNone RedactionMode = ""
+	// RedactionSHA1 hashes the salt followed by the user data, identical to cb_hash_string in lua/redaction.lua.
+	RedactionSHA1 RedactionMode = "sha1"
+	// RedactionHMAC uses an HMAC-SHA1 of the user data keyed by the salt.
+	RedactionHMAC RedactionMode = "hmac"
+)
+
+// maxTagLength is the most of an open tag that is buffered looking for the closing tag.
+// A JSON envelope is written on a single line so without a limit one unterminated tag would buffer the whole file.
+const maxTagLength = 1 << 20
+
+var (
+	// ErrUnknownRedactionMode indicates the redaction mode is not supported.
+	ErrUnknownRedactionMode = errors.New("unknown redaction mode")
+
+	// The Lua filter only lower cases upper case tags, any others (e.g. <Ud>) are left alone.
+	upperTagRegex = regexp.MustCompile(`</*UD>`)
+	// A trailing partial tag that may be completed by the next write.
+	partialTagRegex = regexp.MustCompile(`</*(?:[uU][dD]?)?$`)
+
+	openTag  = []byte("<ud>")
+	closeTag = []byte("</ud>")
+)
+
+// Redactor replaces the contents of <ud>...</ud> tags with a hash.
+// The output matches the Lua redaction filter: tags are lower cased and the shortest span between tags is hashed,
+// including across new lines as the Lua pattern does for a multi-line record.
+type Redactor struct {
+	mode RedactionMode
+	salt []byte
+}
+
+// NewRedactor creates a redactor for the mode, it returns nil if redaction is disabled.
+func NewRedactor(mode RedactionMode, salt []byte) (*Redactor, error) {
+	switch mode {
+	case RedactionNone, "none":
+		return nil, nil
+	case RedactionSHA1, RedactionHMAC:
+		return &Redactor{mode: mode, salt: salt}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRedactionMode, mode)
+	}
+}
+
+// NewRedactorFromDefaults creates the redactor from the environment, it returns nil if redaction is disabled.
+// The salt file is used as is, including any trailing new line, exactly as the Lua filter does.
+func NewRedactorFromDefaults() (*Redactor, error) {
+	mode := RedactionMode(common.GetRedaction())
+
+	redactor, err := NewRedactor(mode, nil)
+	if err != nil || redactor == nil {
+		return nil, err
+	}
+
+	saltFile := common.GetRedactionSaltFile()
+
+	salt, err := os.ReadFile(saltFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("unable to read redaction salt %q: %w", saltFile, err)
+		}
+
+		// Same as the Lua filter, no salt is not an error
+		log.Infow("No redaction salt so hashing without one", "file", saltFile)
+	}
+
+	redactor.salt = salt
+
+	if mode == RedactionHMAC && len(salt) == 0 {
+		log.Warnw("HMAC redaction without a salt is equivalent to an unkeyed hash", "file", saltFile)
+	}
+
+	return redactor, nil
+}
+
+// defaultRedactor creates the redactor from the environment, an invalid configuration is fatal
+// as we must never ship user data that was meant to be redacted.
+func defaultRedactor() *Redactor {
+	redactor, err := NewRedactorFromDefaults()
+	if err != nil {
+		log.Fatalw("Invalid redaction configuration", "error", err)
+	}
+
+	return redactor
+}
+
+// Mode returns the redaction mode, safe to call on a nil redactor.
+func (r *Redactor) Mode() RedactionMode {
+	if r == nil {
+		return RedactionNone
+	}
+
+	return r.mode
+}
+
+// Hash returns the lower case hex hash of the user data.
+func (r *Redactor) Hash(input []byte) string {
+	var h hash.Hash
+
+	if r.mode == RedactionHMAC {
+		h = hmac.New(sha1.New, r.salt)
+	} else {
+		h = sha1.New() //nolint:gosec // See import.
+		h.Write(r.salt)
+	}
+
+	h.Write(input)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RedactString redacts a single record.
+func (r *Redactor) RedactString(input string) string {
+	var out bytes.Buffer
+
+	w := r.NewWriter(&out, false)
+	_, _ = io.WriteString(w, input)
+	_ = w.Close()
+
+	return out.String()
+}
+
+// NewWriter returns a writer that redacts everything written to it before passing it on.
+// Only the contents of an open tag are ever buffered so it can be used to stream large files.
+// If jsonEscaped is set the contents of a tag are JSON decoded before hashing so the hash is of the actual user data,
+// contents that are not part of a single JSON string (e.g. tags in different values) are left alone to keep the JSON valid.
+// An open tag with no closing tag within maxTagLength is also left alone.
+// Close must be called to flush any remaining output, it does not close the underlying writer.
+func (r *Redactor) NewWriter(out io.Writer, jsonEscaped bool) io.WriteCloser {
+	return r.newWriter(out, jsonEscaped)
+}
+
+func (r *Redactor) newWriter(out io.Writer, jsonEscaped bool) *redactingWriter {
+	return &redactingWriter{out: out, redactor: r, jsonEscaped: jsonEscaped}
+}
+
+type redactingWriter struct {
+	out         io.Writer
+	redactor    *Redactor
+	jsonEscaped bool
+	// pending is the data not yet written, either an open tag and its contents or a possible partial tag.
+	pending []byte
+	inside  bool
+	// scanned is how much of an open tag has already been searched for the closing tag.
+	scanned int
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+
+	if err := w.process(false); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *redactingWriter) Close() error {
+	return w.process(true)
+}
+
+// buffered returns how much of the data written so far has not been written out yet.
+// An open tag is never written out until it is closed so this includes all of it.
+func (w *redactingWriter) buffered() int {
+	return len(w.pending)
+}
+
+func (w *redactingWriter) write(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	if _, err := w.out.Write(upperTagRegex.ReplaceAllFunc(p, bytes.ToLower)); err != nil {
+		return fmt.Errorf("unable to write redacted output: %w", err)
+	}
+
+	return nil
+}
+
+// process writes out as much of the pending data as possible.
+func (w *redactingWriter) process(final bool) error {
+	for {
+		var (
+			more bool
+			err  error
+		)
+
+		if w.inside {
+			more, err = w.processTag(final)
+		} else {
+			more, err = w.processText(final)
+		}
+
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// processText writes out everything up to the next opening tag, returns true if one was found.
+// The opening tag itself is kept with its contents until the closing tag is found.
+func (w *redactingWriter) processText(final bool) (bool, error) {
+	end := len(w.pending)
+
+	start := indexTag(w.pending, openTag)
+	if start >= 0 {
+		end = start
+	} else if !final {
+		end -= partialTagLength(w.pending)
+	}
+
+	if err := w.write(w.pending[:end]); err != nil {
+		return false, err
+	}
+
+	w.pending = append(w.pending[:0], w.pending[end:]...)
+	w.inside = start >= 0
+	w.scanned = len(openTag)
+
+	return w.inside, nil
+}
+
+// processTag hashes the contents of the open tag once the closing tag is found, returns true if the tag is complete.
+// The closing tag is searched for across new lines, as the Lua filter does, but only up to maxTagLength.
+func (w *redactingWriter) processTag(final bool) (bool, error) {
+	// Only search what has not already been, allowing for a closing tag split across writes, and never beyond the limit
+	from := max(len(openTag), w.scanned-len(closeTag))
+	limit := max(from, min(len(w.pending), len(openTag)+maxTagLength+len(closeTag)))
+
+	end := indexTag(w.pending[from:limit], closeTag)
+	if end >= 0 {
+		end += from
+
+		userData, valid := w.userData(w.pending[len(openTag):end])
+		if !valid {
+			return true, w.skipTag(end)
+		}
+
+		if err := w.write(w.pending[:len(openTag)]); err != nil {
+			return false, err
+		}
+
+		if _, err := io.WriteString(w.out, w.redactor.Hash(userData)); err != nil {
+			return false, fmt.Errorf("unable to write redacted output: %w", err)
+		}
+
+		// Write the closing tag along with the rest of the record
+		w.pending = append(w.pending[:0], w.pending[end:]...)
+		w.inside = false
+
+		return true, nil
+	}
+
+	if !final {
+		if len(w.pending)-len(openTag) <= maxTagLength {
+			w.scanned = len(w.pending)
+
+			return false, nil
+		}
+
+		log.Warnw("No closing tag so leaving user data as is", "length", len(w.pending)-len(openTag), "limit", maxTagLength)
+	}
+
+	// No closing tag for this one but a later open tag may still be closed
+	return true, w.skipTag(len(w.pending))
+}
+
+// skipTag writes the open tag and its contents up to end as is.
+// The contents may include a later open tag that is closed, e.g. within the same JSON string, so the search continues from there.
+func (w *redactingWriter) skipTag(end int) error {
+	inner := lastIndexTag(w.pending[len(openTag):end], openTag)
+	if inner >= 0 {
+		end = len(openTag) + inner
+	}
+
+	if err := w.write(w.pending[:end]); err != nil {
+		return err
+	}
+
+	w.pending = append(w.pending[:0], w.pending[end:]...)
+	w.inside = inner >= 0
+	w.scanned = len(openTag)
+
+	return nil
+}
+
+// userData returns the data to hash, as the Lua filter sees it.
+// It returns false if the data is JSON escaped but not a valid JSON string, e.g. the tags are in different values.
+func (w *redactingWriter) userData(contents []byte) ([]byte, bool) {
+	contents = upperTagRegex.ReplaceAllFunc(contents, bytes.ToLower)
+
+	if !w.jsonEscaped {
+		return contents, true
+	}
+
+	var decoded string
+	if err := json.Unmarshal(append(append([]byte{'"'}, contents...), '"'), &decoded); err != nil {
+		return nil, false
+	}
+
+	return []byte(decoded), true
+}
+
+// indexTag finds the tag in either lower or upper case, the only ones the Lua filter handles.
+func indexTag(p, tag []byte) int {
+	lower := bytes.Index(p, tag)
+	upper := bytes.Index(p, bytes.ToUpper(tag))
+
+	if lower < 0 || (upper >= 0 && upper < lower) {
+		return upper
+	}
+
+	return lower
+}
+
+// lastIndexTag finds the last tag in either lower or upper case.
+func lastIndexTag(p, tag []byte) int {
+	return max(bytes.LastIndex(p, tag), bytes.LastIndex(p, bytes.ToUpper(tag)))
+}
+
+// partialTagLength returns the length of any partial tag at the end of the data.
+func partialTagLength(p []byte) int {
+	last := bytes.LastIndexByte(p, '<')
+	if last < 0 || !partialTagRegex.Match(p[last:]) {
+		return 0
+	}
+
+	return len(p) - last
+}
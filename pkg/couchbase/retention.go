@@ -0,0 +1,174 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// MaxCBFiles is the default number of processed files to keep.
+	MaxCBFiles = 5
+	// DefaultMinAge is how long a processed file is kept regardless of the other limits to give Fluent Bit time to read it.
+	DefaultMinAge = time.Minute
+)
+
+// RetentionPolicy controls which processed files are removed from an output directory.
+// A zero value for any limit disables it.
+type RetentionPolicy struct {
+	// MaxFiles is the maximum number of files to keep.
+	MaxFiles int
+	// MaxBytes is the maximum total size of all files to keep.
+	MaxBytes int64
+	// MaxAge is the maximum age of a file, based on modification time, before it is removed.
+	MaxAge time.Duration
+	// MinAge is the minimum age of a file before it can be removed by any of the limits above.
+	MinAge time.Duration
+}
+
+func (rp RetentionPolicy) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddInt("maxFiles", rp.MaxFiles)
+	enc.AddInt64("maxBytes", rp.MaxBytes)
+	enc.AddDuration("maxAge", rp.MaxAge)
+	enc.AddDuration("minAge", rp.MinAge)
+
+	return nil
+}
+
+// DefaultRetentionPolicy keeps the most recent MaxCBFiles files only.
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{MaxFiles: MaxCBFiles}
+}
+
+// NewRetentionPolicyFromDefaults creates the policy from the environment.
+func NewRetentionPolicyFromDefaults() RetentionPolicy {
+	return RetentionPolicy{
+		MaxFiles: int(common.GetInt64(MaxCBFiles, common.RebalanceMaxFilesEnvVar)),
+		MaxBytes: common.GetInt64(0, common.RebalanceMaxBytesEnvVar),
+		MaxAge:   common.GetDuration(0, common.RebalanceMaxAgeEnvVar),
+		MinAge:   common.GetDuration(DefaultMinAge, common.RebalanceMinAgeEnvVar),
+	}
+}
+
+// listFiles returns all regular files in the directory sorted from oldest to newest.
+func listFiles(dir string) ([]os.FileInfo, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read directory %q for old files: %w", dir, err)
+	}
+
+	entries := make([]os.FileInfo, 0, len(files))
+
+	for _, f := range files {
+		if f.IsDir() {
+			log.Warnw("Nested directory so skipping removal", "dir", f.Name())
+
+			continue
+		}
+
+		// Hidden files are still being written
+		if strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			// Removed underneath us so nothing to do
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, fmt.Errorf("unable to stat %q: %w", f.Name(), err)
+		}
+
+		entries = append(entries, info)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	return entries, nil
+}
+
+// isShipped returns true if the file is old enough that Fluent Bit should have finished with it.
+func (rp RetentionPolicy) isShipped(info os.FileInfo, now time.Time) bool {
+	return now.Sub(info.ModTime()) >= rp.MinAge
+}
+
+// Apply removes the oldest files in the directory until it is within the limits of the policy.
+// Files younger than the minimum age are never removed as Fluent Bit may not have read them yet.
+func (rp RetentionPolicy) Apply(dir string) error {
+	log.Debugw("Checking for older files to remove", "dir", dir, "policy", rp)
+
+	entries, err := listFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	remainingFiles := len(entries)
+
+	var remainingBytes int64
+	for _, info := range entries {
+		remainingBytes += info.Size()
+	}
+
+	now := time.Now()
+
+	for _, info := range entries {
+		tooMany := rp.MaxFiles > 0 && remainingFiles > rp.MaxFiles
+		tooLarge := rp.MaxBytes > 0 && remainingBytes > rp.MaxBytes
+		tooOld := rp.MaxAge > 0 && now.Sub(info.ModTime()) > rp.MaxAge
+
+		if !tooMany && !tooLarge && !tooOld {
+			continue
+		}
+
+		filenameToRemove := filepath.Join(dir, info.Name())
+
+		if !rp.isShipped(info, now) {
+			log.Debugw("Not removing file as it may not have been read yet", "file", filenameToRemove)
+
+			continue
+		}
+
+		log.Debugw("Removing old file", "file", filenameToRemove, "tooMany", tooMany, "tooLarge", tooLarge, "tooOld", tooOld)
+
+		err = os.Remove(filenameToRemove)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("unable to remove old file %q: %w", filenameToRemove, err)
+		}
+
+		remainingFiles--
+		remainingBytes -= info.Size()
+	}
+
+	return nil
+}
+
+// RemoveOldestFiles applies the default retention policy to the directory.
+func RemoveOldestFiles(rebalanceOutputDir string) error {
+	return DefaultRetentionPolicy().Apply(rebalanceOutputDir)
+}
@@ -0,0 +1,93 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ErrInvalidLogRoot indicates a log root could not be parsed.
+var ErrInvalidLogRoot = errors.New("invalid log root")
+
+// Node names are used as output sub-directories so must be a single path element.
+var nodeNameRegex = regexp.MustCompile(`^[\w@.-]+$`)
+
+// LogRoot is the log directory of a single Couchbase node.
+type LogRoot struct {
+	// Node tags every record from this root, it is also the name of its output sub-directory.
+	Node string
+	Dir  string
+}
+
+func (lr LogRoot) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("node", lr.Node)
+	enc.AddString("dir", lr.Dir)
+
+	return nil
+}
+
+// RebalanceDir is the directory the node writes its rebalance reports to.
+func (lr LogRoot) RebalanceDir() string {
+	return filepath.Join(lr.Dir, "rebalance")
+}
+
+// ParseLogRoots parses a comma separated list of [<node>=]<log directory>.
+// If no node name is given the name of the log directory is used.
+func ParseLogRoots(value string) ([]LogRoot, error) {
+	var roots []LogRoot
+
+	nodes := map[string]bool{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		node, dir, named := strings.Cut(entry, "=")
+		if !named {
+			node, dir = "", entry
+		}
+
+		dir = filepath.Clean(strings.TrimSpace(dir))
+		node = strings.TrimSpace(node)
+
+		if node == "" {
+			node = filepath.Base(dir)
+		}
+
+		if !nodeNameRegex.MatchString(node) || node == "." || node == ".." {
+			return nil, fmt.Errorf("%w: invalid node name %q in %q", ErrInvalidLogRoot, node, entry)
+		}
+
+		if nodes[node] {
+			return nil, fmt.Errorf("%w: duplicate node name %q, name each root explicitly as <node>=<dir>", ErrInvalidLogRoot, node)
+		}
+
+		nodes[node] = true
+
+		roots = append(roots, LogRoot{Node: node, Dir: dir})
+	}
+
+	return roots, nil
+}
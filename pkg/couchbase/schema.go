@@ -0,0 +1,325 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/fluent-bit/pkg/common"
+	"go.uber.org/zap/zapcore"
+)
+
+// How the timestamp of a record is written.
+const (
+	// TimestampRFC3339 writes the timestamp as is, e.g. 2021-03-09T20:24:32Z.
+	TimestampRFC3339 = "rfc3339"
+	// TimestampEpoch writes the timestamp as (fractional) seconds since the epoch.
+	TimestampEpoch = "epoch"
+	// TimestampEpochMillis writes the timestamp as whole milliseconds since the epoch.
+	TimestampEpochMillis = "epoch_millis"
+)
+
+// Whether the name of the file a record is from is the full path or just the base name.
+const (
+	ReportNamePath = "path"
+	ReportNameBase = "base"
+)
+
+// ErrInvalidOutputSchema indicates the output schema could not be parsed.
+var ErrInvalidOutputSchema = errors.New("invalid output schema")
+
+// OutputSchema names the fields of the records wrapping rebalance reports and other JSON documents.
+// The defaults are the original field names, e.g. they can be renamed to ECS-style names for Elasticsearch.
+type OutputSchema struct {
+	// Fields maps each default field name to the name to use instead.
+	Fields map[string]string
+	// TimestampFormat is one of TimestampRFC3339, TimestampEpoch or TimestampEpochMillis.
+	TimestampFormat string
+	// BaseName only includes the base name of the file rather than the full path.
+	BaseName bool
+	// StaticFields are added to every record in order.
+	StaticFields []recordField
+}
+
+// Default field names, these are also the keys to rename them.
+const (
+	fieldTimestamp    = "timestamp"
+	fieldReportName   = "reportName"
+	fieldNode         = "node"
+	fieldSection      = "section"
+	fieldDocumentType = "documentType"
+	fieldContents     = "reportContents"
+	fieldSummary      = "summary"
+)
+
+var defaultFieldNames = []string{fieldTimestamp, fieldReportName, fieldNode, fieldSection, fieldDocumentType, fieldContents, fieldSummary}
+
+// recordField is a single member of a record, records are written with their fields in order.
+type recordField struct {
+	Name  string
+	Value any
+}
+
+// record is an object with the fields in order.
+type record []recordField
+
+func (r record) MarshalJSON() ([]byte, error) {
+	members, err := encodeMembers(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte("{" + strings.TrimSuffix(members, ", ") + "}"), nil
+}
+
+// encodeMembers encodes the fields as the members of an object, each followed by a separator, without any braces.
+func encodeMembers(fields []recordField) (string, error) {
+	var members strings.Builder
+
+	for _, field := range fields {
+		value, err := encodeJSON(field.Value)
+		if err != nil {
+			return "", fmt.Errorf("unable to encode field %q: %w", field.Name, err)
+		}
+
+		name, _ := encodeJSON(field.Name)
+		members.WriteString(name + ":" + value + ", ")
+	}
+
+	return members.String(), nil
+}
+
+// DefaultOutputSchema is the original record format.
+func DefaultOutputSchema() *OutputSchema {
+	return &OutputSchema{TimestampFormat: TimestampRFC3339}
+}
+
+// NewOutputSchema parses the schema options:
+// - fields: a comma-separated list of <default name>=<new name>, e.g. timestamp=@timestamp,reportContents=rebalance
+// - timestampFormat: rfc3339 (the default), epoch or epoch_millis
+// - reportName: path (the default) or base
+// - staticFields: a comma-separated list of <field>=<environment variable> to add to every record.
+func NewOutputSchema(fields, timestampFormat, reportName, staticFields string) (*OutputSchema, error) {
+	schema := DefaultOutputSchema()
+
+	if err := schema.parseFields(fields); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(timestampFormat)) {
+	case "", TimestampRFC3339:
+	case TimestampEpoch:
+		schema.TimestampFormat = TimestampEpoch
+	case TimestampEpochMillis:
+		schema.TimestampFormat = TimestampEpochMillis
+	default:
+		return nil, fmt.Errorf("%w: unknown timestamp format %q", ErrInvalidOutputSchema, timestampFormat)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(reportName)) {
+	case "", ReportNamePath:
+	case ReportNameBase:
+		schema.BaseName = true
+	default:
+		return nil, fmt.Errorf("%w: unknown report name %q", ErrInvalidOutputSchema, reportName)
+	}
+
+	if err := schema.parseStaticFields(staticFields); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// NewOutputSchemaFromDefaults creates the schema from the environment.
+func NewOutputSchemaFromDefaults() (*OutputSchema, error) {
+	return NewOutputSchema(common.GetOutputFields(), common.GetOutputTimestampFormat(), common.GetOutputReportName(), common.GetOutputStaticFields())
+}
+
+// defaultOutputSchema creates the schema from the environment, an invalid configuration is fatal.
+func defaultOutputSchema() *OutputSchema {
+	schema, err := NewOutputSchemaFromDefaults()
+	if err != nil {
+		log.Fatalw("Invalid output schema", "error", err)
+	}
+
+	return schema
+}
+
+func (s *OutputSchema) parseFields(value string) error {
+	used := map[string]bool{}
+
+	for _, entry := range ParsePatterns(value) {
+		field, name, found := strings.Cut(entry, "=")
+		field, name = strings.TrimSpace(field), strings.TrimSpace(name)
+
+		if !found || name == "" {
+			return fmt.Errorf("%w: field %q is not <field>=<name>", ErrInvalidOutputSchema, entry)
+		}
+
+		if !slices.Contains(defaultFieldNames, field) {
+			return fmt.Errorf("%w: unknown field %q, must be one of %s", ErrInvalidOutputSchema, field, strings.Join(defaultFieldNames, ","))
+		}
+
+		if s.Fields == nil {
+			s.Fields = map[string]string{}
+		}
+
+		s.Fields[field] = name
+	}
+
+	for _, field := range defaultFieldNames {
+		name := s.Field(field)
+		if used[name] {
+			return fmt.Errorf("%w: field name %q is used more than once", ErrInvalidOutputSchema, name)
+		}
+
+		used[name] = true
+	}
+
+	return nil
+}
+
+func (s *OutputSchema) parseStaticFields(value string) error {
+	for _, entry := range ParsePatterns(value) {
+		name, variable, found := strings.Cut(entry, "=")
+		name, variable = strings.TrimSpace(name), strings.TrimSpace(variable)
+
+		if !found || name == "" || variable == "" {
+			return fmt.Errorf("%w: static field %q is not <field>=<environment variable>", ErrInvalidOutputSchema, entry)
+		}
+
+		for _, field := range defaultFieldNames {
+			if name == s.Field(field) {
+				return fmt.Errorf("%w: static field %q is already used", ErrInvalidOutputSchema, name)
+			}
+		}
+
+		fieldValue, set := os.LookupEnv(variable)
+		if !set {
+			log.Warnw("Static field environment variable is not set so skipping it", "field", name, "environmentVariable", variable)
+
+			continue
+		}
+
+		s.StaticFields = append(s.StaticFields, recordField{Name: name, Value: fieldValue})
+	}
+
+	return nil
+}
+
+func (s *OutputSchema) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	for _, field := range defaultFieldNames {
+		enc.AddString(field, s.Field(field))
+	}
+
+	enc.AddString("timestampFormat", s.TimestampFormat)
+	enc.AddBool("baseName", s.BaseName)
+
+	for _, field := range s.StaticFields {
+		enc.AddString("static."+field.Name, fmt.Sprint(field.Value))
+	}
+
+	return nil
+}
+
+// Field returns the name to use for a default field, safe to call on a nil schema.
+func (s *OutputSchema) Field(field string) string {
+	if s != nil {
+		if name, renamed := s.Fields[field]; renamed {
+			return name
+		}
+	}
+
+	return field
+}
+
+// metadata returns the fields describing where a record is from, in order, the timestamp is only included if set.
+func (s *OutputSchema) metadata(timestamp, filename, node string) []recordField {
+	var fields []recordField
+
+	if timestamp != "" {
+		fields = append(fields, s.timestamp(timestamp, filename))
+	}
+
+	if s != nil && s.BaseName {
+		filename = filepath.Base(filename)
+	}
+
+	fields = append(fields, recordField{Name: s.Field(fieldReportName), Value: filename})
+
+	if node != "" {
+		fields = append(fields, recordField{Name: s.Field(fieldNode), Value: node})
+	}
+
+	if s != nil {
+		fields = append(fields, s.StaticFields...)
+	}
+
+	return fields
+}
+
+// timestamp returns the timestamp field in the configured format.
+// Timestamps that cannot be parsed as RFC3339 are left as is in the default format, for an epoch format the modification
+// time of the file is used instead (or the current time if it has gone) so the field is always a number.
+func (s *OutputSchema) timestamp(timestamp, filename string) recordField {
+	field := recordField{Name: s.Field(fieldTimestamp), Value: timestamp}
+
+	if s == nil || s.TimestampFormat == TimestampRFC3339 || s.TimestampFormat == "" {
+		return field
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		parsed = fileTime(filename)
+
+		log.Debugw("Invalid timestamp so using the file time", "file", filename, "timestamp", timestamp, "fileTime", parsed)
+	}
+
+	if s.TimestampFormat == TimestampEpochMillis {
+		field.Value = json.Number(strconv.FormatInt(parsed.UnixMilli(), 10))
+
+		return field
+	}
+
+	// Exact rather than via a float so no precision is lost
+	seconds := strconv.FormatInt(parsed.Unix(), 10)
+	if nanoseconds := parsed.Nanosecond(); nanoseconds != 0 {
+		seconds += "." + strings.TrimRight(fmt.Sprintf("%09d", nanoseconds), "0")
+	}
+
+	field.Value = json.Number(seconds)
+
+	return field
+}
+
+// fileTime returns the modification time of the file, the current time if it cannot be read.
+func fileTime(filename string) time.Time {
+	if info, err := os.Stat(filename); err == nil {
+		return info.ModTime()
+	}
+
+	return time.Now()
+}
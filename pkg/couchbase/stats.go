@@ -0,0 +1,462 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// StatsPreprocessorName is the name the stats.log preprocessor is registered under.
+	StatsPreprocessorName = "stats"
+	// Couchbase keeps a handful of rotated stats logs so this comfortably covers all of them.
+	maxProcessedStatsFiles = 64
+	// statsStateFile is hidden in the output directory so neither retention nor Fluent Bit see it.
+	statsStateFile        = ".stats.state"
+	statsStatePermissions = 0600
+	// activeStatsFile is the log Couchbase is still writing to, the rest are rotations of it.
+	activeStatsFile = "stats.log"
+)
+
+func init() {
+	RegisterPreprocessor(StatsPreprocessorName, func() Preprocessor {
+		return &StatsPreprocessor{}
+	})
+}
+
+var (
+	// [ns_doctor:debug,2021-03-09T17:32:01.676Z,ns_1@cb.local:ns_doctor<0.378.0>:ns_doctor:handle_info:182]Got initial status:
+	statsHeaderRegex = regexp.MustCompile(`^\[([^:,\]]+):([^,\]]+),([^,\]]+),([^:\]]+):([^\]]*)\](.*)$`)
+	// The active log and its rotations, each rotation renames stats.log.N to stats.log.N+1 so the same file is seen under every name in turn.
+	statsFileRegex = regexp.MustCompile(`^stats\.log(\.\d+)?$`)
+	// ep_dcp_2i_backoff             0
+	statsTableRegex = regexp.MustCompile(`^(\S+)(?:\s+(.*))?$`)
+	// MemTotal:       12272184 kB
+	memInfoRegex = regexp.MustCompile(`^([^:]+):\s+(\d+)`)
+)
+
+// StatsPreprocessor converts the multi-line entries of stats.log into a structured record per entry.
+// Status dumps (Erlang terms keyed by node) become a record with the status of each node inside it,
+// tables of statistics become an object of name to value and anything else is kept as the raw body.
+//
+// How much of each file has been published is remembered by inode so a rotation, which only renames the file, carries on
+// from where it got to rather than publishing it again. The last entry of the active log may still be being written so it
+// is only published once the log is rotated. This is saved in the output directory so it survives a restart.
+type StatsPreprocessor struct {
+	lock      sync.Mutex
+	stateFile string
+	// progress is oldest first and bounded, only the most recent rotations can be seen again.
+	progress []statsProgress
+	// pending is the progress of each file transformed but not yet published.
+	pending map[string]statsProgress
+}
+
+// statsProgress is how far through a file entries have been published.
+type statsProgress struct {
+	inode uint64
+	// fingerprint is a hash of the first line so a new file reusing the inode is processed from the start.
+	fingerprint uint64
+	offset      int64
+}
+
+// statsRecord is a single structured entry from stats.log.
+type statsRecord struct {
+	Timestamp string         `json:"timestamp"`
+	Level     string         `json:"level"`
+	Component string         `json:"component"`
+	Node      string         `json:"node"`
+	Source    string         `json:"source"`
+	Message   string         `json:"message"`
+	Nodes     []statsNode    `json:"nodes,omitempty"`
+	Term      any            `json:"term,omitempty"`
+	Stats     map[string]any `json:"stats,omitempty"`
+	Body      string         `json:"body,omitempty"`
+}
+
+// statsNode is the status of one node in a status dump.
+type statsNode struct {
+	Name   string         `json:"name"`
+	Status map[string]any `json:"status"`
+}
+
+func (sp *StatsPreprocessor) Name() string {
+	return StatsPreprocessorName
+}
+
+// LoadState reads what has already been published to the output directory and saves to it from now on.
+func (sp *StatsPreprocessor) LoadState(outputDir string) error {
+	stateFile := filepath.Join(outputDir, statsStateFile)
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read stats state %q: %w", stateFile, err)
+	}
+
+	var progress []statsProgress
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var p statsProgress
+		if _, err := fmt.Sscanf(line, "%d %d %d", &p.inode, &p.fingerprint, &p.offset); err != nil || p.offset < 0 {
+			log.Warnw("Ignoring invalid stats state", "file", stateFile, "line", line, "error", err)
+
+			continue
+		}
+
+		progress = append(progress, p)
+	}
+
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	sp.stateFile = stateFile
+	sp.progress = progress
+
+	return nil
+}
+
+// saveState is replaced atomically so a crash leaves either the old or the new state, the worst case is entries published again.
+func (sp *StatsPreprocessor) saveState() error {
+	if sp.stateFile == "" {
+		return nil
+	}
+
+	var data strings.Builder
+	for _, p := range sp.progress {
+		fmt.Fprintf(&data, "%d %d %d\n", p.inode, p.fingerprint, p.offset)
+	}
+
+	pending := sp.stateFile + ".tmp"
+
+	if err := os.WriteFile(pending, []byte(data.String()), statsStatePermissions); err != nil {
+		return fmt.Errorf("unable to save stats state %q: %w", sp.stateFile, err)
+	}
+
+	if err := os.Rename(pending, sp.stateFile); err != nil {
+		return fmt.Errorf("unable to save stats state %q: %w", sp.stateFile, err)
+	}
+
+	return nil
+}
+
+// published returns how far through the file with this inode and first line entries have been published.
+func (sp *StatsPreprocessor) published(ino, fingerprint uint64) int64 {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	for _, p := range sp.progress {
+		if p.inode == ino && p.fingerprint == fingerprint {
+			return p.offset
+		}
+	}
+
+	return 0
+}
+
+func (sp *StatsPreprocessor) Match(filename string) bool {
+	if !statsFileRegex.MatchString(filepath.Base(filename)) {
+		return false
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		// Reported when the file is opened
+		return true
+	}
+
+	fingerprint, err := statsFingerprint(filename)
+	if err != nil {
+		return true
+	}
+
+	if offset := sp.published(inode(info), fingerprint); offset > 0 && offset >= info.Size() {
+		log.Debugw("Skipping stats log already processed under another name", "file", filename, "offset", offset)
+
+		return false
+	}
+
+	return true
+}
+
+// fingerprintLine hashes the first line of a file.
+func fingerprintLine(line string) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(line))
+
+	return hash.Sum64()
+}
+
+// statsFingerprint returns the fingerprint of the first line of the file as it is transformed.
+func statsFingerprint(filename string) (uint64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open %q: %w", filename, err)
+	}
+	defer file.Close()
+
+	source, _, err := decompress(file)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	line, err := bufio.NewReader(source).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("unable to read %q: %w", filename, err)
+	}
+
+	return fingerprintLine(line), nil
+}
+
+// Published remembers how far through the file has been published so it is not published again when it is rotated.
+func (sp *StatsPreprocessor) Published(filename string) {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	progress, ok := sp.pending[filename]
+	if !ok {
+		return
+	}
+
+	delete(sp.pending, filename)
+
+	sp.progress = slices.DeleteFunc(sp.progress, func(p statsProgress) bool {
+		return p.inode == progress.inode
+	})
+
+	sp.progress = append(sp.progress, progress)
+	if len(sp.progress) > maxProcessedStatsFiles {
+		sp.progress = sp.progress[len(sp.progress)-maxProcessedStatsFiles:]
+	}
+
+	if err := sp.saveState(); err != nil {
+		log.Warnw("Unable to save stats state so files may be processed again after a restart", "error", err)
+	}
+}
+
+func (sp *StatsPreprocessor) OutputPattern() string {
+	return "stats-processed-*.json"
+}
+
+// Transform reads one entry at a time so memory usage is bounded by the largest entry rather than the file.
+// Only the entries after those already published are written.
+func (sp *StatsPreprocessor) Transform(out io.Writer, source io.Reader, filename string) error {
+	reader := bufio.NewReader(source)
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+
+	var ino uint64
+	if info, err := os.Stat(filename); err == nil {
+		ino = inode(info)
+	}
+
+	var (
+		header []string
+		body   []string
+		// offset is where the next line starts, entryStart is where the current entry started
+		offset, entryStart, skip int64
+		fingerprint              uint64
+	)
+
+	flush := func() error {
+		if header == nil {
+			return nil
+		}
+
+		if err := encoder.Encode(newStatsRecord(header, body)); err != nil {
+			return fmt.Errorf("unable to write record from %q: %w", filename, err)
+		}
+
+		return nil
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("unable to read %q: %w", filename, err)
+		}
+
+		if offset == 0 {
+			fingerprint = fingerprintLine(line)
+			skip = sp.published(ino, fingerprint)
+			entryStart = skip
+		}
+
+		lineStart := offset
+		offset += int64(len(line))
+
+		if line != "" && lineStart >= skip {
+			line = strings.TrimRight(line, "\r\n")
+
+			if match := statsHeaderRegex.FindStringSubmatch(line); match != nil {
+				if err := flush(); err != nil {
+					return err
+				}
+
+				header, body, entryStart = match[1:], nil, lineStart
+			} else if header != nil {
+				body = append(body, line)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			// Couchbase may still be writing the last entry of the active log, it is published when the log is rotated
+			if filepath.Base(filename) != activeStatsFile || header == nil {
+				if err := flush(); err != nil {
+					return err
+				}
+
+				entryStart = max(offset, skip)
+			}
+
+			sp.lock.Lock()
+			defer sp.lock.Unlock()
+
+			if sp.pending == nil {
+				sp.pending = map[string]statsProgress{}
+			}
+
+			sp.pending[filename] = statsProgress{inode: ino, fingerprint: fingerprint, offset: entryStart}
+
+			return nil
+		}
+	}
+}
+
+// newStatsRecord converts an entry into a record.
+func newStatsRecord(header, body []string) statsRecord {
+	record := statsRecord{
+		Component: header[0],
+		Level:     header[1],
+		Timestamp: header[2],
+		Node:      header[3],
+		Source:    header[4],
+		Message:   strings.TrimSpace(header[5]),
+	}
+
+	text := strings.Join(body, "\n")
+	if strings.TrimSpace(text) == "" {
+		return record
+	}
+
+	if term, err := ParseErlangTerm(text); err == nil {
+		if nodes := nodeStatuses(term); nodes != nil {
+			record.Nodes = nodes
+		} else {
+			record.Term = term
+		}
+
+		return record
+	}
+
+	if stats := statsTable(body); stats != nil {
+		record.Stats = stats
+
+		return record
+	}
+
+	record.Body = text
+
+	return record
+}
+
+// nodeStatuses returns the status of each node, ordered by name, if the term is a status dump, i.e. an object of node name to object.
+func nodeStatuses(term any) []statsNode {
+	nodes, ok := term.(map[string]any)
+	if !ok || len(nodes) == 0 {
+		return nil
+	}
+
+	statuses := make([]statsNode, 0, len(nodes))
+
+	for node, value := range nodes {
+		status, ok := value.(map[string]any)
+		if !ok || !strings.Contains(node, "@") {
+			return nil
+		}
+
+		// Make the memory information queryable rather than one large string
+		if memInfo, ok := status["meminfo"].(string); ok {
+			status["meminfo"] = parseMemInfo(memInfo)
+		}
+
+		statuses = append(statuses, statsNode{Name: node, Status: status})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// parseMemInfo converts /proc/meminfo output into an object of name to value (usually in kB).
+func parseMemInfo(memInfo string) map[string]any {
+	result := map[string]any{}
+
+	for _, line := range strings.Split(memInfo, "\n") {
+		if match := memInfoRegex.FindStringSubmatch(line); match != nil {
+			result[match[1]] = json.Number(match[2])
+		}
+	}
+
+	return result
+}
+
+// statsTable converts lines of "name value" into an object, numbers are kept as numbers.
+func statsTable(lines []string) map[string]any {
+	stats := map[string]any{}
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		match := statsTableRegex.FindStringSubmatch(line)
+		if match == nil {
+			return nil
+		}
+
+		value := strings.TrimSpace(match[2])
+		if jsonNumberRegex.MatchString(value) {
+			stats[match[1]] = json.Number(value)
+		} else {
+			stats[match[1]] = value
+		}
+	}
+
+	if len(stats) == 0 {
+		return nil
+	}
+
+	return stats
+}
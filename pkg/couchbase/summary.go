@@ -0,0 +1,253 @@
+/*
+ *  Copyright 2021 Couchbase, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file  except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the  License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package couchbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSummaryErrors limits how many errors are kept so a report full of them does not use up memory.
+const maxSummaryErrors = 10
+
+// Rebalance completion status derived from the completion message.
+const (
+	RebalanceStatusCompleted = "completed"
+	RebalanceStatusStopped   = "stopped"
+	RebalanceStatusFailed    = "failed"
+	RebalanceStatusUnknown   = "unknown"
+)
+
+var (
+	// e.g. "Rebalance completed successfully." or "Failover completed successfully."
+	completedRegex = regexp.MustCompile(`(?i)completed successfully`)
+	stoppedRegex   = regexp.MustCompile(`(?i)stopped`)
+)
+
+// rebalanceSummary is computed from a report so the key information can be queried without the whole report.
+type rebalanceSummary struct {
+	Status            string           `json:"status"`
+	CompletionMessage string           `json:"completionMessage,omitempty"`
+	StartTime         string           `json:"startTime,omitempty"`
+	CompletedTime     string           `json:"completedTime,omitempty"`
+	DurationMs        int64            `json:"durationMs"`
+	ServiceTimeTaken  map[string]int64 `json:"serviceTimeTaken"`
+	SlowestStage      string           `json:"slowestStage,omitempty"`
+	SlowestTimeTaken  int64            `json:"slowestStageTimeTaken,omitempty"`
+	NodeCount         int              `json:"nodeCount"`
+	Nodes             []string         `json:"nodes"`
+	IncompleteStages  []string         `json:"incompleteStages,omitempty"`
+	Errors            []string         `json:"errors,omitempty"`
+}
+
+// summariser collects the values needed from a report as it is walked so the summary is computed without holding the report in memory.
+type summariser struct {
+	summary       rebalanceSummary
+	nodes         map[string]bool
+	progressNodes map[string]bool
+	incomplete    map[string]bool
+	start, end    time.Time
+}
+
+// summariseReport reads the whole report and returns its summary.
+func summariseReport(source io.Reader) (*rebalanceSummary, error) {
+	s := summariser{
+		summary:       rebalanceSummary{ServiceTimeTaken: map[string]int64{}},
+		nodes:         map[string]bool{},
+		progressNodes: map[string]bool{},
+		incomplete:    map[string]bool{},
+	}
+
+	if err := newJSONWalker(source, nil, s.visit).value(); err != nil {
+		return nil, fmt.Errorf("unable to summarise report: %w", err)
+	}
+
+	return s.finish(), nil
+}
+
+// visit records any scalar we need for the summary.
+func (s *summariser) visit(path []string, token json.Token) {
+	text, _ := token.(string)
+
+	if text != "" && isErrorPath(path) && len(s.summary.Errors) < maxSummaryErrors {
+		s.summary.Errors = append(s.summary.Errors, formatJSONPath(path)+": "+text)
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "completionMessage":
+		s.summary.CompletionMessage = text
+	case len(path) == 3 && path[0] == "nodesInfo" && isJSONIndex(path[2]) && text != "":
+		s.nodes[text] = true
+	case len(path) == 4 && path[0] == "stageInfo" && path[2] == "perNodeProgress":
+		s.progressNodes[path[3]] = true
+	case len(path) == 3 && path[0] == "stageInfo":
+		s.visitStage(path[1], path[2], token)
+	}
+}
+
+// isErrorPath returns true if the value is (part of) a member named as an error, e.g. error or errorMessage.
+func isErrorPath(path []string) bool {
+	for i := len(path) - 1; i >= 0; i-- {
+		if !isJSONIndex(path[i]) {
+			return strings.Contains(strings.ToLower(path[i]), "error")
+		}
+	}
+
+	return false
+}
+
+// visitStage records the timings and progress of a top level stage, i.e. a service.
+func (s *summariser) visitStage(stage, field string, token json.Token) {
+	switch field {
+	case "totalProgress":
+		number, _ := token.(json.Number)
+		if progress, err := number.Float64(); err == nil && progress < 100 {
+			s.incomplete[stage] = true
+		}
+	case "timeTaken":
+		number, _ := token.(json.Number)
+		if timeTaken, err := number.Int64(); err == nil {
+			s.summary.ServiceTimeTaken[stage] = timeTaken
+		}
+	case "startTime":
+		if t, ok := parseReportTime(token); ok && (s.start.IsZero() || t.Before(s.start)) {
+			s.start = t
+		}
+	case "completedTime":
+		if t, ok := parseReportTime(token); ok && t.After(s.end) {
+			s.end = t
+		}
+	}
+}
+
+func parseReportTime(token json.Token) (time.Time, bool) {
+	text, ok := token.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, text)
+
+	return t, err == nil
+}
+
+// finish computes the summary from everything collected.
+func (s *summariser) finish() *rebalanceSummary {
+	summary := s.summary
+
+	switch {
+	case completedRegex.MatchString(summary.CompletionMessage):
+		summary.Status = RebalanceStatusCompleted
+	case stoppedRegex.MatchString(summary.CompletionMessage):
+		summary.Status = RebalanceStatusStopped
+	case summary.CompletionMessage != "":
+		summary.Status = RebalanceStatusFailed
+	default:
+		summary.Status = RebalanceStatusUnknown
+	}
+
+	if !s.start.IsZero() {
+		summary.StartTime = s.start.Format(time.RFC3339Nano)
+	}
+
+	if !s.end.IsZero() {
+		summary.CompletedTime = s.end.Format(time.RFC3339Nano)
+	}
+
+	if !s.start.IsZero() && !s.end.IsZero() {
+		summary.DurationMs = s.end.Sub(s.start).Milliseconds()
+	}
+
+	for stage, timeTaken := range summary.ServiceTimeTaken {
+		// Ties are broken by name so the result is stable
+		if summary.SlowestStage == "" || timeTaken > summary.SlowestTimeTaken ||
+			(timeTaken == summary.SlowestTimeTaken && stage < summary.SlowestStage) {
+			summary.SlowestStage, summary.SlowestTimeTaken = stage, timeTaken
+		}
+	}
+
+	// Older reports may not list the nodes so fall back to the ones with progress
+	nodes := s.nodes
+	if len(nodes) == 0 {
+		nodes = s.progressNodes
+	}
+
+	summary.Nodes = make([]string, 0, len(nodes))
+	for node := range nodes {
+		summary.Nodes = append(summary.Nodes, node)
+	}
+
+	sort.Strings(summary.Nodes)
+	summary.NodeCount = len(summary.Nodes)
+
+	for stage := range s.incomplete {
+		summary.IncompleteStages = append(summary.IncompleteStages, stage)
+	}
+
+	sort.Strings(summary.IncompleteStages)
+
+	return &summary
+}
+
+// backgroundSummary computes the summary of everything written to it in the background,
+// so a report can be summarised whilst it is being streamed to the output.
+type backgroundSummary struct {
+	writer *io.PipeWriter
+	result chan summaryResult
+}
+
+type summaryResult struct {
+	summary *rebalanceSummary
+	err     error
+}
+
+func newBackgroundSummary() *backgroundSummary {
+	reader, writer := io.Pipe()
+	bs := &backgroundSummary{writer: writer, result: make(chan summaryResult, 1)}
+
+	go func() {
+		summary, err := summariseReport(reader)
+		// Never block the writer, even if we have finished or failed early
+		_, _ = io.Copy(io.Discard, reader)
+		bs.result <- summaryResult{summary: summary, err: err}
+	}()
+
+	return bs
+}
+
+func (bs *backgroundSummary) Write(p []byte) (int, error) {
+	return bs.writer.Write(p)
+}
+
+// Summary waits for everything written so far to be summarised.
+func (bs *backgroundSummary) Summary() (*rebalanceSummary, error) {
+	_ = bs.writer.Close()
+	result := <-bs.result
+
+	return result.summary, result.err
+}
+
+// Abort stops summarising, e.g. because the report could not be read.
+func (bs *backgroundSummary) Abort() {
+	_ = bs.writer.CloseWithError(io.ErrUnexpectedEOF)
+	<-bs.result
+}
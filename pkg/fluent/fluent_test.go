@@ -17,12 +17,15 @@
 package fluent_test
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/couchbase/fluent-bit/pkg/common"
 	"github.com/couchbase/fluent-bit/pkg/fluent"
 	"github.com/couchbase/fluent-bit/pkg/logging"
 	"github.com/oklog/run"
@@ -294,3 +297,33 @@ func TestTLSWatcherSkippedWhenNotConfigured(t *testing.T) {
 		t.Errorf("AddTLSCertsWatcher should not return error for empty dir: %v", err)
 	}
 }
+
+// Check Fluent Bit is started on the generated config and falls back to the mounted one if it cannot be generated.
+func TestStartConfig(t *testing.T) {
+	t.Parallel()
+
+	configDir := t.TempDir()
+	scratchDir := t.TempDir()
+
+	valid := filepath.Join(configDir, "fluent-bit.conf")
+	if err := os.WriteFile(valid, []byte("[INPUT]\n    Name tail\n    Path /var/log/test.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := filepath.Join(configDir, "relative.conf")
+	if err := os.WriteFile(invalid, []byte("[INPUT]\n    Name tail\n    DB tail.db\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if path, err := fluent.StartConfig(valid, ""); err != nil || path != valid {
+		t.Errorf("expected the mounted config without a scratch directory but got %q: %v", path, err)
+	}
+
+	if path, err := fluent.StartConfig(valid, scratchDir); err != nil || !strings.HasPrefix(path, scratchDir) {
+		t.Errorf("expected a generated config but got %q: %v", path, err)
+	}
+
+	if path, err := fluent.StartConfig(invalid, scratchDir); !errors.Is(err, common.ErrRelativePath) || path != invalid {
+		t.Errorf("expected to fall back to the mounted config but got %q: %v", path, err)
+	}
+}
@@ -46,23 +46,26 @@ type Config struct {
 	restartTimes               int
 	timer                      *time.Timer
 	binPath, cfgPath, watchDir string
-	totalStarts                int
-	cleanStop                  bool
-	cleanStart                 bool
+	// startedCfgPath is the config Fluent Bit was last started with, generated from cfgPath if possible.
+	startedCfgPath string
+	totalStarts    int
+	cleanStop      bool
+	cleanStart     bool
 }
 
 func NewFluentBitConfig(binary, config, watchDir string) *Config {
 	fb := Config{
-		cmd:          nil,
-		restartTimes: 0,
-		mutex:        sync.Mutex{},
-		timer:        time.NewTimer(0),
-		binPath:      binary,
-		cfgPath:      config,
-		watchDir:     watchDir,
-		totalStarts:  0,
-		cleanStop:    false,
-		cleanStart:   false,
+		cmd:            nil,
+		restartTimes:   0,
+		mutex:          sync.Mutex{},
+		timer:          time.NewTimer(0),
+		binPath:        binary,
+		cfgPath:        config,
+		startedCfgPath: config,
+		watchDir:       watchDir,
+		totalStarts:    0,
+		cleanStop:      false,
+		cleanStart:     false,
 	}
 
 	return &fb
@@ -82,6 +85,21 @@ func (fb *Config) IsCleanStart() bool {
 	return fb.cleanStart
 }
 
+// StartConfig returns the config to start Fluent Bit with, the one generated under dir unless it is empty.
+// If the config cannot be generated it falls back to the mounted one, which Fluent Bit may still accept, and returns why.
+func StartConfig(cfgPath, dir string) (string, error) {
+	if dir == "" {
+		return cfgPath, nil
+	}
+
+	generated, err := common.GenerateConfigFile(cfgPath, dir)
+	if err != nil {
+		return cfgPath, err
+	}
+
+	return generated, nil
+}
+
 func Start(fb *Config) {
 	if fb == nil {
 		return
@@ -94,17 +112,25 @@ func Start(fb *Config) {
 		return
 	}
 
-	common.CheckAndEnableMemoryBufLimits()
+	common.CheckAndEnableMemoryBufLimits(fb.cfgPath)
+	common.CheckAndEnableStorageLimits(fb.cfgPath)
+
+	startedCfgPath, err := StartConfig(fb.cfgPath, common.GetGeneratedConfigDir())
+	if err != nil {
+		log.Errorw("Unable to generate Fluent Bit config so starting it on the mounted one", "error", err, "config", fb.cfgPath, "generated", common.GetGeneratedConfigDir())
+	}
+
+	fb.startedCfgPath = startedCfgPath
 
-	configContents, configErr := os.ReadFile(fb.cfgPath)
+	configContents, configErr := os.ReadFile(fb.startedCfgPath)
 	if configErr != nil {
-		log.Errorw("Unable to retrieve Fluent bit config contents", "error", configErr, "config", fb.cfgPath)
+		log.Errorw("Unable to retrieve Fluent bit config contents", "error", configErr, "config", fb.startedCfgPath)
 	} else {
-		log.Infow("Starting Fluent Bit", "binary", fb.binPath, "config", fb.cfgPath, "contents", string(configContents))
+		log.Infow("Starting Fluent Bit", "binary", fb.binPath, "config", fb.startedCfgPath, "contents", string(configContents))
 	}
 
 	// #nosec G204
-	fb.cmd = exec.Command(fb.binPath, "-c", fb.cfgPath)
+	fb.cmd = exec.Command(fb.binPath, "-c", fb.startedCfgPath)
 	// Pick up any customised environment loaded in as well
 	fb.cmd.Env = os.Environ()
 	fb.cmd.Stdout = os.Stdout
@@ -116,9 +142,9 @@ func Start(fb *Config) {
 
 	if err := fb.cmd.Start(); err != nil {
 		if configErr != nil {
-			log.Errorw("Start Fluent bit error", "error", err, "binary", fb.binPath, "config", fb.cfgPath, "configError", configErr)
+			log.Errorw("Start Fluent bit error", "error", err, "binary", fb.binPath, "config", fb.startedCfgPath, "configError", configErr)
 		} else {
-			log.Errorw("Start Fluent bit error", "error", err, "binary", fb.binPath, "config", fb.cfgPath, "contents", string(configContents))
+			log.Errorw("Start Fluent bit error", "error", err, "binary", fb.binPath, "config", fb.startedCfgPath, "contents", string(configContents))
 		}
 
 		fb.cmd = nil
@@ -127,7 +153,7 @@ func Start(fb *Config) {
 	}
 
 	fb.cleanStart = true
-	log.Infow("Fluent bit started", "binary", fb.binPath, "config", fb.cfgPath)
+	log.Infow("Fluent bit started", "binary", fb.binPath, "config", fb.startedCfgPath)
 }
 
 func Wait(fb *Config) {
@@ -140,11 +166,11 @@ func Wait(fb *Config) {
 	// If killed by us this is normal
 	if !fb.cleanStop {
 		// If not killed by us then grab the config as well to check if that is the cause
-		config, err := os.ReadFile(fb.cfgPath)
+		config, err := os.ReadFile(fb.startedCfgPath)
 		if err != nil {
-			log.Errorw("Fluent bit exited", "error", fb.cmd.Wait(), "binary", fb.binPath, "config", fb.cfgPath, "configError", err)
+			log.Errorw("Fluent bit exited", "error", fb.cmd.Wait(), "binary", fb.binPath, "config", fb.startedCfgPath, "configError", err)
 		} else {
-			log.Errorw("Fluent bit exited", "error", fb.cmd.Wait(), "binary", fb.binPath, "config", fb.cfgPath, "contents", string(config))
+			log.Errorw("Fluent bit exited", "error", fb.cmd.Wait(), "binary", fb.binPath, "config", fb.startedCfgPath, "contents", string(config))
 		}
 	}
 	// Once the fluent bit has executed for 10 minutes without any problems,
@@ -254,9 +280,11 @@ func AddDynamicConfigWatcher(g *run.Group, fb *Config) error {
 		return fmt.Errorf("unable to create dynamic config watcher: %w", err)
 	}
 
-	// Start watcher.
-	err = watcher.Add(fb.watchDir)
+	// Start watcher, the directory may be mounted after we start so wait for it if need be.
+	waiter, err := common.NewPathWaiter(watcher, fb.watchDir)
 	if err != nil {
+		_ = watcher.Close()
+
 		return fmt.Errorf("unable to add %q to dynamic config watcher: %w", fb.watchDir, err)
 	}
 
@@ -269,7 +297,14 @@ func AddDynamicConfigWatcher(g *run.Group, fb *Config) error {
 				case <-cancel:
 					return nil
 				case event := <-watcher.Events:
-					if !common.IsValidEvent(event) {
+					waiter.Removed(event)
+
+					if !waiter.Found() {
+						// Once the directory appears treat it the same as a config change
+						if !directoryAppeared(waiter) {
+							continue
+						}
+					} else if !common.IsValidEvent(event) {
 						continue
 					}
 
@@ -299,6 +334,16 @@ func AddDynamicConfigWatcher(g *run.Group, fb *Config) error {
 	return nil
 }
 
+// directoryAppeared moves the watch towards the directory being waited for and returns true once it exists.
+func directoryAppeared(waiter *common.PathWaiter) bool {
+	found, err := waiter.Update()
+	if err != nil {
+		log.Errorw("Unable to wait for directory", "dir", waiter.Path(), "error", err)
+	}
+
+	return found
+}
+
 // AddTLSCertsWatcher adds a watcher for TLS certificate changes.
 // When TLS certificates are updated (e.g., rotated), this watcher will
 // detect the change and restart FluentBit to pick up the new certificates.
@@ -315,9 +360,11 @@ func AddTLSCertsWatcher(g *run.Group, fb *Config, tlsCertsDir string) error {
 		return fmt.Errorf("unable to create TLS certs watcher: %w", err)
 	}
 
-	// Start watcher on the TLS certs directory.
-	err = watcher.Add(tlsCertsDir)
+	// Start watcher on the TLS certs directory, waiting for it if need be.
+	waiter, err := common.NewPathWaiter(watcher, tlsCertsDir)
 	if err != nil {
+		_ = watcher.Close()
+
 		return fmt.Errorf("unable to add %q to TLS certs watcher: %w", tlsCertsDir, err)
 	}
 
@@ -330,7 +377,14 @@ func AddTLSCertsWatcher(g *run.Group, fb *Config, tlsCertsDir string) error {
 				case <-cancel:
 					return nil
 				case event := <-watcher.Events:
-					if !common.IsValidEvent(event) {
+					waiter.Removed(event)
+
+					if !waiter.Found() {
+						// Once the directory appears treat it the same as a certificate change
+						if !directoryAppeared(waiter) {
+							continue
+						}
+					} else if !common.IsValidEvent(event) {
 						continue
 					}
 
@@ -129,8 +129,10 @@ fi
 # Deal with any rebalance reports by invoking the watcher
 if [[ -d "${COUCHBASE_LOGS}/rebalance" ]]; then
     # Test the removal of old files once we have >5 - create some dummy ones if we don't have an existing directory mounted in
+    dummyRebalanceFiles="no"
     if [[ ! -d "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}" ]]; then
         echo "Creating dummy files to test rotation of old files in rebalance processing"
+        dummyRebalanceFiles="yes"
         # Add a sub-directory to test that as well
         mkdir -p "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}"/1
         # Does not work for busybox: `touch "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}"/{2..10}.test`
@@ -148,8 +150,8 @@ if [[ -d "${COUCHBASE_LOGS}/rebalance" ]]; then
     fi
 
     echo "Testing rebalance processing"
-    # Run the watcher in the special mode to process existing and exit
-    if /fluent-bit/bin/couchbase-watcher --ignoreExisting=false; then
+    # Run the watcher in the special mode to process existing and exit, the dummy files are too new to remove by default
+    if COUCHBASE_LOGS_REBALANCE_MIN_AGE=0 /fluent-bit/bin/couchbase-watcher --ignoreExisting=false; then
         countOfInput=$(find "${COUCHBASE_LOGS}/rebalance" -type f -name "rebalance_report_*.json" -print |wc -l)
         countOfOutput=$(find "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}" -type f -name "rebalance-processed-*.json" -print |wc -l)
 
@@ -160,6 +162,17 @@ if [[ -d "${COUCHBASE_LOGS}/rebalance" ]]; then
             echo "FAILED: Unable to process rebalance reports, $countOfInput != $countOfOutput"
             exitCode=1
         fi
+
+        # There are more than the files to keep so the oldest dummy one is removed, the sub-directory is left alone
+        if [[ "$dummyRebalanceFiles" == "yes" ]]; then
+            if [[ -f "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}/2.test" ]] || [[ ! -d "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}/1" ]]; then
+                echo "FAILED: Old files were not rotated in rebalance processing"
+                ls -l "${COUCHBASE_LOGS_REBALANCE_TMP_DIR}"
+                exitCode=1
+            else
+                echo "PASSED: Rotated old files in rebalance processing"
+            fi
+        fi
     else
         echo "FAILED: Unable to run rebalance processing"
         exitCode=1
@@ -171,6 +184,26 @@ fi
 # Make sure to wipe actuals otherwise we will just append
 rm -f "${COUCHBASE_LOGS}"/*.log.actual
 
+# The stats pre-processor output is checked against stats.log.expected, it runs on a copy as a rotated log so every entry is complete.
+# Anything else the watcher processes goes to the scratch directory so it is not counted twice.
+if [[ -f "${COUCHBASE_LOGS}/stats.log" ]]; then
+    statsTestDir=$(mktemp -d)
+    mkdir -p "${statsTestDir}/logs" "${statsTestDir}/output"
+    cp "${COUCHBASE_LOGS}/stats.log" "${statsTestDir}/logs/stats.log.1"
+
+    if COUCHBASE_LOGS_PREPROCESS_DIRS="stats:${statsTestDir}/logs:${statsTestDir}/output" \
+        COUCHBASE_LOGS_REBALANCE_TMP_DIR="${statsTestDir}/rebalance" \
+        /fluent-bit/bin/couchbase-watcher --ignoreExisting=false; then
+        cat "${statsTestDir}"/output/stats-processed-*.json > "${COUCHBASE_LOGS}/stats.log.actual"
+        echo "PASSED: Processed stats log"
+    else
+        echo "FAILED: Unable to run stats processing"
+        exitCode=1
+    fi
+
+    rm -rf "${statsTestDir}"
+fi
+
 # Now run tests per input configuration so we can verify individually otherwise if any failed we would just exit with a failure.
 for i in /fluent-bit/etc/couchbase/input/in-*.conf; do
     # Ignore invalid/non-files